@@ -1,12 +1,13 @@
 package app
 
 import (
-	"encoding/json"
+	"cmp"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
@@ -14,9 +15,12 @@ import (
 	"strings"
 
 	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/blocklist"
 	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/localzone"
 	"github.com/thenaterhood/spuddns/models"
 	"github.com/thenaterhood/spuddns/resolver"
+	"github.com/thenaterhood/spuddns/rpz"
 	"github.com/thenaterhood/spuddns/system"
 )
 
@@ -70,27 +74,142 @@ type AppConfig struct {
 	// DNS doesn't cause a full network failure. Enabling this
 	// also enables PredictiveCache.
 	ResilientCache bool `json:"resilient_cache"`
+	// Answer from expired cache entries when upstream resolution
+	// fails (RFC 8767). Unlike ResilientCache, this applies to every
+	// cache entry rather than only frequently used ones.
+	ServeStale bool `json:"serve_stale"`
+	// How long, in seconds, an expired entry may be served stale
+	ServeStaleMaxAge int `json:"serve_stale_max_age"`
+	// TTL, in seconds, given to stale answers
+	ServeStaleTtl int `json:"serve_stale_ttl"`
+	// Longest time, in seconds, a negative answer (NXDOMAIN or
+	// NODATA) is cached for regardless of its SOA (RFC 2308). Zero
+	// disables negative caching.
+	NegativeCacheMaxTtl int `json:"negative_cache_max_ttl"`
+	// Maximum number of entries in the cache. Zero is unlimited.
+	CacheMaxEntries int `json:"cache_max_entries"`
+	// Maximum size, in bytes, of the entries in the cache. Zero
+	// is unlimited.
+	CacheMaxBytes int `json:"cache_max_bytes"`
+	// Which entries are evicted when the cache is full: "lru"
+	// (least recently used) or "lfu" (least frequently used)
+	CacheEvictionPolicy string `json:"cache_eviction_policy"`
+	// How often, in seconds, expired entries are swept from the
+	// cache. Zero disables sweeping.
+	CacheSweepInterval int `json:"cache_sweep_interval"`
 	// If not empty, spuddns will periodically flush its cache to
 	// this path and will load it at start to persist the cache between
 	// restarts.
-	PersistentCacheFile string              `json:"persistent_cache_file"`
+	PersistentCacheFile string `json:"persistent_cache_file"`
+	// Whether the persistent cache file is flushed to disk each
+	// time it's written. Disabling this saves wear on flash storage,
+	// but the file may be lost (though not corrupted) on power loss.
+	PersistentCacheSync bool `json:"persistent_cache_sync"`
+	// Upstream resolvers may be plain DNS servers in the form
+	// [udp://|tcp://]address[:port] (IPv6 addresses with a port
+	// are written as [::1]:5300), DNS over HTTPS URLs, or DNS over
+	// TLS endpoints in the form tls://[servername@]host[:port]
 	UpstreamResolvers   []string            `json:"upstream_resolvers"`
 	ConditionalForwards map[string][]string `json:"conditional_forwards"`
-	RespectResolveConf  bool                `json:"respect_resolvconf"`
-	ResolvConfPath      string              `json:"resolvconf_path"`
-
-	skip_cache_nets  []net.IPNet        `json:"-"`
-	skip_cache_regex *regexp.Regexp     `json:"-"`
-	ResolvConf       *system.ResolvConf `json:"-"`
-	EtcHosts         *system.EtcHosts   `json:"-"`
+	// How queries are distributed between upstream resolvers:
+	// sequential (default), parallel, fastest or round_robin
+	UpstreamStrategy string `json:"upstream_strategy"`
+	// Upstream strategy for individual conditional forwards, keyed
+	// by the same domain as in ConditionalForwards. Forwards without
+	// an entry use UpstreamStrategy.
+	ConditionalForwardStrategies map[string]string `json:"conditional_forward_strategies"`
+	// Number of consecutive failures after which an upstream
+	// resolver is considered down and skipped until it recovers
+	UpstreamFailureThreshold int `json:"upstream_failure_threshold"`
+	// How often, in seconds, upstream resolvers that are down
+	// are probed to see whether they've recovered
+	UpstreamProbeInterval int    `json:"upstream_probe_interval"`
+	RespectResolveConf    bool   `json:"respect_resolvconf"`
+	ResolvConfPath        string `json:"resolvconf_path"`
+	// Files of names to block, keyed by a name for the list used in
+	// logs and metrics. Lists may be in hosts (0.0.0.0 ads.example),
+	// domains (ads.example or *.ads.example) or Adblock Plus
+	// (||ads.example^) format, and are reloaded when they change.
+	Blocklists map[string]string `json:"blocklists"`
+	// Files of names that are never blocked, in the same formats
+	Allowlists []string `json:"allowlists"`
+	// How blocked names are answered: "null" (0.0.0.0 or ::),
+	// "nxdomain" or "refused"
+	BlocklistResponse string `json:"blocklist_response"`
+	// Response policy zones (RPZ), whose policies are applied in
+	// the order the zones are listed
+	RpzZones []RpzZone `json:"rpz_zones"`
+	// Zones answered authoritatively from RFC 1035 zone files,
+	// which are reloaded when they change
+	LocalZones []LocalZone `json:"local_zones"`
+	// Records answered without resolving, for names that don't
+	// need a zone of their own
+	LocalRecords []LocalRecord `json:"local_records"`
+	// Serve the admin API, which can be used to inspect and flush
+	// the cache, on AdminApiAddress
+	AdminApiEnable bool `json:"admin_api_enable"`
+	// The host:port the admin API listens on
+	AdminApiAddress string `json:"admin_api_address"`
+	// The bearer token admin API clients must send in the
+	// Authorization header
+	AdminApiToken string `json:"admin_api_token"`
+	// A directory of *.json config fragments merged into this config
+	// in lexical order. Relative paths are relative to the directory
+	// of the config file.
+	ConfigDir string `json:"config_dir"`
+	// Deprecated and ignored. It was never used, but is still accepted
+	// so configs that set it keep loading.
+	SharedSecret *string `json:"shared_secret"`
+
+	skip_cache_nets  []net.IPNet             `json:"-"`
+	skip_cache_regex *regexp.Regexp          `json:"-"`
+	static_records   *resolver.StaticRecords `json:"-"`
+	ResolvConf       *system.ResolvConf      `json:"-"`
+	EtcHosts         *system.EtcHosts        `json:"-"`
 }
 
 // Access control list item
 type AclItem struct {
 	UpstreamResolvers []string `json:"upstream_resolvers"`
 	ForwardCpeId      bool     `json:"forward_cpe_id"`
-	AddCpeId          string   `json:"use_cpe_id"`
+	AddCpeId          string   `json:"add_cpe_id"`
 	UseSharedCache    bool     `json:"use_shared_cache"`
+	// Deprecated name of add_cpe_id, which is used if add_cpe_id
+	// isn't set
+	UseCpeId string `json:"use_cpe_id"`
+	// How names on a blocklist are answered for this client. Empty
+	// uses BlocklistResponse.
+	BlocklistResponse string `json:"blocklist_response"`
+}
+
+// A response policy zone file
+type RpzZone struct {
+	// A name for the zone used in logs and metrics
+	Name string `json:"name"`
+	File string `json:"file"`
+	// The zone's origin. Empty takes it from the zone's SOA.
+	Origin string `json:"origin"`
+}
+
+// A zone file served as a local zone
+type LocalZone struct {
+	// The name the zone is for
+	Origin string `json:"origin"`
+	File   string `json:"file"`
+}
+
+// Records for a name answered without resolving
+type LocalRecord struct {
+	// The name the records are for. A wildcard (*.example.com)
+	// answers for the names under a domain.
+	Name string `json:"name"`
+	// A, AAAA, CNAME, MX, TXT, SRV, PTR or CAA
+	Type string `json:"type"`
+	// The data for each record as written in a zone file, e.g.
+	// "10 mail.example.com" for MX
+	Values []string `json:"values"`
+	// Defaults to 10 seconds
+	Ttl uint32 `json:"ttl"`
 }
 
 var loadedConfig *AppConfig
@@ -123,19 +242,27 @@ func strToIpNet(data string) *net.IPNet {
 func (cfg *AppConfig) prepare() error {
 
 	var skip_cache_regexes = []string{}
+	errs := []error{}
 
-	for _, item := range cfg.DoNotCache {
+	for i, item := range cfg.DoNotCache {
+		if strings.TrimSpace(item) == "" {
+			errs = append(errs, fmt.Errorf("'do_not_cache[%d]' is empty", i))
+			continue
+		}
 
 		net := strToIpNet(item)
 		if net != nil {
 			cfg.skip_cache_nets = append(cfg.skip_cache_nets, *net)
+		} else if strings.Contains(item, "/") {
+			errs = append(errs, fmt.Errorf("'do_not_cache[%d]' '%s' is not a valid network", i, item))
 		} else {
 			if item[0] == '*' {
-				item = item[1:]
-
-				if item[0] == '.' {
-					item = item[1:]
+				item = strings.TrimPrefix(item[1:], ".")
+				if item == "" {
+					errs = append(errs, fmt.Errorf("'do_not_cache[%d]' has no domain after the wildcard", i))
+					continue
 				}
+
 				skip_cache_regexes = append(skip_cache_regexes, fmt.Sprintf(".+\\.%s(\\.)?", regexp.QuoteMeta(item)))
 			}
 			skip_cache_regexes = append(skip_cache_regexes, fmt.Sprintf("(^%s(\\.?)$)", regexp.QuoteMeta(item)))
@@ -145,50 +272,93 @@ func (cfg *AppConfig) prepare() error {
 	if len(skip_cache_regexes) > 0 {
 		skip_cache_regex, err := regexp.Compile(fmt.Sprintf("(?i)%s", strings.Join(skip_cache_regexes, "|")))
 		if err != nil {
-			fmt.Printf("failed to compile cache exclude regex: %s", err)
+			errs = append(errs, fmt.Errorf("'do_not_cache': %w", err))
+		}
+		cfg.skip_cache_regex = skip_cache_regex
+	}
+
+	cfg.static_records = resolver.NewStaticRecords()
+	for i, record := range cfg.LocalRecords {
+		if !resolver.IsValidStaticRecordName(record.Name) {
+			errs = append(errs, fmt.Errorf("'local_records[%d].name' '%s' is not a valid name", i, record.Name))
+			continue
 		}
-		if skip_cache_regex != nil {
-			cfg.skip_cache_regex = skip_cache_regex
+		if !resolver.IsValidStaticRecordType(record.Type) {
+			errs = append(errs, fmt.Errorf("'local_records[%d].type' '%s' is not A, AAAA, CNAME, MX, TXT, SRV, PTR or CAA", i, record.Type))
+			continue
+		}
+		if len(record.Values) == 0 {
+			errs = append(errs, fmt.Errorf("'local_records[%d].values' is empty", i))
+		}
+
+		for j, value := range record.Values {
+			rr, err := resolver.NewStaticRecord(record.Name, record.Type, value, record.Ttl)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("'local_records[%d].values[%d]' '%s' is not valid: %w", i, j, value, err))
+				continue
+			}
+			cfg.static_records.Add(rr)
 		}
 	}
 
+	for key, acl := range cfg.ACLs {
+		if acl.UseCpeId == "" {
+			continue
+		}
+		if acl.AddCpeId != "" && acl.AddCpeId != acl.UseCpeId {
+			errs = append(errs, fmt.Errorf("'acls.%s.use_cpe_id' conflicts with 'acls.%s.add_cpe_id', which replaces it", key, key))
+			continue
+		}
+		acl.AddCpeId = acl.UseCpeId
+		cfg.ACLs[key] = acl
+	}
+
 	if !cfg.RespectResolveConf && len(cfg.UpstreamResolvers) < 1 && len(cfg.ConditionalForwards) < 1 {
 		cfg.UpstreamResolvers = []string{"8.8.8.8"}
 	}
-	return nil
+
+	return errors.Join(errs...)
 }
 
 func (cfg AppConfig) IsCacheable(query dns.Question, data *models.DnsResponse) bool {
-	if cfg.DisableCache || data == nil || !data.IsSuccess() || data.FromCache {
+	if cfg.DisableCache || data == nil || data.FromCache || data.Blocked || data.Authoritative {
 		return false
 	}
 
-	answers, err := data.Answers()
-	if err != nil {
+	// FQDN (in question)
+	if cfg.skip_cache_regex != nil && cfg.skip_cache_regex.MatchString(query.Name) {
 		return false
 	}
 
-	for _, item := range answers {
-		// FQDN (in question)
-		if cfg.skip_cache_regex != nil && cfg.skip_cache_regex.MatchString(query.Name) {
-			return false
-		}
+	if data.IsNegative() {
+		// Without an SOA there's no way to know how long the
+		// answer may be cached for
+		return cfg.NegativeCacheMaxTtl > 0 && data.Soa() != nil
+	}
+
+	if !data.IsSuccess() {
+		return false
+	}
 
+	for _, rr := range data.AnswerRRs() {
 		// Network (in response)
-		if item.Type == dns.TypeA || item.Type == dns.TypeAAAA {
-			answerNet := strToIpNet(item.Data)
-			if answerNet == nil {
-				return false
-			}
+		var dns_ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			dns_ip = record.A
+		case *dns.AAAA:
+			dns_ip = record.AAAA
+		default:
+			continue
+		}
 
-			dns_ip := answerNet.IP
+		if dns_ip == nil {
+			return false
+		}
 
-			if dns_ip != nil {
-				for _, skip_net := range cfg.skip_cache_nets {
-					if skip_net.Contains(dns_ip) {
-						return false
-					}
-				}
+		for _, skip_net := range cfg.skip_cache_nets {
+			if skip_net.Contains(dns_ip) {
+				return false
 			}
 		}
 	}
@@ -206,14 +376,16 @@ func (cfg AppConfig) GetFullyQualifiedNames(name string) []string {
 
 func (cfg AppConfig) GetResolverConfig(appState *AppState, qname string, clientId *string, clientIp *string) (*resolver.DnsResolverConfig, error) {
 	appCache := appState.Cache
+	cachePartition := ""
 
-	accessControl, err := cfg.GetACItem(clientId, clientIp)
+	aclKey, accessControl, err := cfg.getACMatch(clientId, clientIp)
 	if err != nil {
 		return nil, err
 	}
 
 	if accessControl != nil && !accessControl.UseSharedCache {
 		appCache = &cache.DummyCache{}
+		cachePartition = "acl:" + aclKey
 	}
 	resolverConfig := resolver.DnsResolverConfig{
 		Servers:          cfg.GetUpstreamResolvers(qname, clientId, clientIp),
@@ -222,6 +394,10 @@ func (cfg AppConfig) GetResolverConfig(appState *AppState, qname string, clientI
 		ForceMimimumTtl:  cfg.ForceMinimumTtl,
 		Cache:            appCache,
 		DefaultForwarder: appState.DefaultForwarder,
+		StaticRecords:    cfg.static_records,
+		Strategy:         cfg.GetUpstreamStrategy(qname, clientId, clientIp),
+		Health:           appState.UpstreamHealth,
+		CachePartition:   cachePartition,
 		Mdns: &resolver.MdnsConfig{
 			Enable: cfg.MdnsEnable,
 		},
@@ -230,20 +406,10 @@ func (cfg AppConfig) GetResolverConfig(appState *AppState, qname string, clientI
 	return &resolverConfig, nil
 }
 
-func (cfg AppConfig) GetUpstreamResolvers(name string, clientId *string, clientIp *string) []string {
-	upstreamResolvers := []string{}
-	accessControl, err := cfg.GetACItem(clientId, clientIp)
-
-	if err != nil {
-		return []string{}
-	}
-
-	if accessControl != nil {
-		if len(accessControl.UpstreamResolvers) > 0 {
-			return accessControl.UpstreamResolvers
-		}
-	}
-
+// Get the conditional forward (the domain it was configured for, and
+// its resolvers) that applies to a name, if any. This is the least
+// specific forward the name is under, not counting the name itself.
+func (cfg AppConfig) getConditionalForward(name string) (string, []string, bool) {
 	if len(cfg.ConditionalForwards) > 0 {
 		subs := strings.Split(name, ".")
 		slices.Reverse(subs)
@@ -255,7 +421,7 @@ func (cfg AppConfig) GetUpstreamResolvers(name string, clientId *string, clientI
 			}
 			resolvers, ok := cfg.ConditionalForwards[host]
 			if ok {
-				return resolvers
+				return host, resolvers, true
 			}
 
 			if host == "" {
@@ -266,6 +432,44 @@ func (cfg AppConfig) GetUpstreamResolvers(name string, clientId *string, clientI
 		}
 	}
 
+	return "", nil, false
+}
+
+// Get the strategy used to distribute a query between the
+// upstream resolvers selected for it
+func (cfg AppConfig) GetUpstreamStrategy(name string, clientId *string, clientIp *string) string {
+	accessControl, err := cfg.GetACItem(clientId, clientIp)
+	if err == nil && accessControl != nil && len(accessControl.UpstreamResolvers) > 0 {
+		return cfg.UpstreamStrategy
+	}
+
+	if domain, _, ok := cfg.getConditionalForward(name); ok {
+		if strategy, ok := cfg.ConditionalForwardStrategies[domain]; ok {
+			return strategy
+		}
+	}
+
+	return cfg.UpstreamStrategy
+}
+
+func (cfg AppConfig) GetUpstreamResolvers(name string, clientId *string, clientIp *string) []string {
+	upstreamResolvers := []string{}
+	accessControl, err := cfg.GetACItem(clientId, clientIp)
+
+	if err != nil {
+		return []string{}
+	}
+
+	if accessControl != nil {
+		if len(accessControl.UpstreamResolvers) > 0 {
+			return accessControl.UpstreamResolvers
+		}
+	}
+
+	if _, resolvers, ok := cfg.getConditionalForward(name); ok {
+		return resolvers
+	}
+
 	if cfg.ResolvConf != nil {
 		if len(cfg.ResolvConf.Nameservers) > 0 {
 			return cfg.ResolvConf.Nameservers
@@ -279,61 +483,136 @@ func (cfg AppConfig) GetUpstreamResolvers(name string, clientId *string, clientI
 	return upstreamResolvers
 }
 
+// Get every upstream the config can send queries to, whichever
+// client or name they're for
+func (cfg AppConfig) GetAllUpstreamResolvers() []string {
+	upstreamResolvers := slices.Clone(cfg.UpstreamResolvers)
+
+	for _, resolvers := range cfg.ConditionalForwards {
+		upstreamResolvers = append(upstreamResolvers, resolvers...)
+	}
+
+	for _, acl := range cfg.ACLs {
+		upstreamResolvers = append(upstreamResolvers, acl.UpstreamResolvers...)
+	}
+
+	if cfg.ResolvConf != nil {
+		upstreamResolvers = append(upstreamResolvers, cfg.ResolvConf.Nameservers...)
+	}
+
+	return upstreamResolvers
+}
+
+// Get the response policy zones in the form used to read them
+func (cfg AppConfig) GetRpzZones() []rpz.ZoneConfig {
+	zones := []rpz.ZoneConfig{}
+	for _, zone := range cfg.RpzZones {
+		zones = append(zones, rpz.ZoneConfig{Name: zone.Name, File: zone.File, Origin: zone.Origin})
+	}
+	return zones
+}
+
+// Get the local zones in the form used to read them
+func (cfg AppConfig) GetLocalZones() []localzone.ZoneConfig {
+	zones := []localzone.ZoneConfig{}
+	for _, zone := range cfg.LocalZones {
+		zones = append(zones, localzone.ZoneConfig{Origin: zone.Origin, File: zone.File})
+	}
+	return zones
+}
+
+// Get how a blocked name is answered for a client
+func (cfg AppConfig) GetBlocklistResponse(clientId *string, clientIp *string) string {
+	accessControl, err := cfg.GetACItem(clientId, clientIp)
+	if err == nil && accessControl != nil && accessControl.BlocklistResponse != "" {
+		return accessControl.BlocklistResponse
+	}
+
+	return cmp.Or(cfg.BlocklistResponse, blocklist.ResponseNull)
+}
+
 // Get the access control item for the given key
 func (cfg AppConfig) GetACItem(key *string, ip *string) (*AclItem, error) {
+	_, acl, err := cfg.getACMatch(key, ip)
+	return acl, err
+}
+
+// Get the access control item for a client along with the key
+// in ACLs it matched
+func (cfg AppConfig) getACMatch(key *string, ip *string) (string, *AclItem, error) {
 	if !cfg.EnableACLs {
-		return nil, nil
+		return "", nil, nil
 	}
 
 	if key != nil {
 		acl, ok := cfg.ACLs[*key]
 		if ok {
-			return &acl, nil
+			return *key, &acl, nil
 		}
 	}
 
 	if ip != nil {
 		acl, ok := cfg.ACLs["ip:"+*ip]
 		if ok {
-			return &acl, nil
+			return "ip:" + *ip, &acl, nil
 		}
 	}
 
 	acl, ok := cfg.ACLs["*"]
 	if ok {
-		return &acl, nil
+		return "*", &acl, nil
 	}
 
-	return nil, fmt.Errorf("unrecognized client")
+	return "", nil, fmt.Errorf("unrecognized client")
 }
 
 func GetDefaultConfig() AppConfig {
 	return AppConfig{
-		EnableACLs:          false,
-		ACLs:                map[string]AclItem{},
-		AddCpeId:            "",
-		BindAddress:         "",
-		DnsServerPort:       53,
-		DnsOverHttpEnable:   false,
-		DnsOverHttpPort:     8080,
-		DnsOverTlsEnable:    false,
-		DnsOverTlsPort:      853,
-		DoNotCache:          []string{"127.0.0.1/16"},
-		DisableCache:        false,
-		DisableMetrics:      true,
-		ForceMinimumTtl:     -1,
-		LogLevel:            int(slog.LevelInfo),
-		MdnsEnable:          true,
-		MdnsForward:         false,
-		PredictiveCache:     true,
-		PredictiveThreshold: 10,
-		PersistentCacheFile: "",
-		ResilientCache:      true,
-		UpstreamResolvers:   []string{},
-		ConditionalForwards: map[string][]string{},
-		RespectResolveConf:  true,
-		ResolvConfPath:      "/etc/resolv.conf",
-		skip_cache_nets:     []net.IPNet{},
+		EnableACLs:               false,
+		ACLs:                     map[string]AclItem{},
+		AddCpeId:                 "",
+		BindAddress:              "",
+		DnsServerPort:            53,
+		DnsOverHttpEnable:        false,
+		DnsOverHttpPort:          8080,
+		DnsOverTlsEnable:         false,
+		DnsOverTlsPort:           853,
+		DoNotCache:               []string{"127.0.0.1/16"},
+		DisableCache:             false,
+		DisableMetrics:           true,
+		ForceMinimumTtl:          -1,
+		LogLevel:                 int(slog.LevelInfo),
+		MdnsEnable:               true,
+		MdnsForward:              false,
+		PredictiveCache:          true,
+		PredictiveThreshold:      10,
+		PersistentCacheFile:      "",
+		PersistentCacheSync:      true,
+		ResilientCache:           true,
+		ServeStale:               true,
+		ServeStaleMaxAge:         86400,
+		ServeStaleTtl:            30,
+		NegativeCacheMaxTtl:      3600,
+		CacheMaxEntries:          100000,
+		CacheMaxBytes:            0,
+		CacheEvictionPolicy:      cache.EvictionLRU,
+		CacheSweepInterval:       60,
+		UpstreamResolvers:        []string{},
+		ConditionalForwards:      map[string][]string{},
+		UpstreamStrategy:         resolver.StrategySequential,
+		UpstreamFailureThreshold: 3,
+		UpstreamProbeInterval:    10,
+		RespectResolveConf:       true,
+		ResolvConfPath:           "/etc/resolv.conf",
+		Blocklists:               map[string]string{},
+		Allowlists:               []string{},
+		BlocklistResponse:        blocklist.ResponseNull,
+		RpzZones:                 []RpzZone{},
+		LocalZones:               []LocalZone{},
+		LocalRecords:             []LocalRecord{},
+		AdminApiEnable:           false,
+		AdminApiAddress:          "127.0.0.1:5380",
+		skip_cache_nets:          []net.IPNet{},
 	}
 }
 
@@ -400,8 +679,10 @@ func getEnvironmentConfig() AppConfig {
 	config.DisableMetrics = getEnvBool("DISABLE_METRICS", config.DisableMetrics)
 
 	config.ResolvConf = &system.ResolvConf{
-		Search:      getEnvList("SEARCH_DOMAINS", []string{}),
-		Nameservers: config.UpstreamResolvers,
+		Search: getEnvList("SEARCH_DOMAINS", []string{}),
+		// Left empty so the upstream resolvers, which may still be
+		// overridden, are used
+		Nameservers: []string{},
 		Options:     map[string]string{},
 	}
 
@@ -414,26 +695,52 @@ func GetConfig(path string) (*AppConfig, error) {
 		return loadedConfig, nil
 	}
 
+	config, err := ReadConfig(path)
+	if config != nil {
+		loadedConfig = config
+	}
+
+	return config, err
+}
+
+// Read the config from a file (or the legacy environment variables,
+// if the file doesn't exist) and the fragments in its config_dir, with
+// any SPUDDNS_* environment variables applied on top, without replacing
+// the loaded config
+func ReadConfig(path string) (*AppConfig, error) {
 	config := GetDefaultConfig()
 
 	data, err := os.ReadFile(path)
 	if errors.Is(err, os.ErrNotExist) {
 		config = getEnvironmentConfig()
-		loadedConfig = &config
-		return &config, nil
+	} else if err != nil {
+		return nil, err
+	} else if err := decodeConfig(data, &config); err != nil {
+		return nil, err
 	}
 
-	if err != nil {
-		return nil, err
+	// The environment is applied last, but may say where the
+	// fragments are
+	configDir := config.ConfigDir
+	if dir := os.Getenv(envPrefix + "CONFIG_DIR"); dir != "" {
+		configDir = dir
+	}
+	if configDir != "" {
+		if !filepath.IsAbs(configDir) {
+			configDir = filepath.Join(filepath.Dir(path), configDir)
+		}
+		if err := mergeConfigDir(&config, configDir, path, data); err != nil {
+			return nil, err
+		}
 	}
 
-	err = json.Unmarshal(data, &config)
-	if err != nil {
+	if err := applyEnvironment(&config, os.Environ()); err != nil {
 		return nil, err
 	}
 
-	loadedConfig = &config
-	err = loadedConfig.prepare()
+	if err := errors.Join(config.prepare(), config.Validate()); err != nil {
+		return nil, err
+	}
 
-	return &config, err
+	return &config, nil
 }
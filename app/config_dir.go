@@ -0,0 +1,144 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// Merge the *.json fragments in dir into config in lexical order.
+// Lists are appended to, skipping values that are already present,
+// maps are merged by key and any other setting is replaced. A fragment
+// setting a value (or map entry) that the main config file or an
+// earlier fragment set to something else is a conflict.
+func mergeConfigDir(config *AppConfig, dir string, path string, data []byte) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("'config_dir': %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("'config_dir': %w", err)
+	}
+	sort.Strings(files)
+
+	// Where each setting and map entry was set, to report conflicts
+	origins := map[string]string{}
+	if data != nil {
+		base := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &base); err != nil {
+			return err
+		}
+		recordOrigins(origins, config, base, path)
+	}
+
+	errs := []error{}
+	for _, file := range files {
+		if err := mergeConfigFragment(config, file, origins); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func recordOrigins(origins map[string]string, config *AppConfig, keys map[string]json.RawMessage, file string) {
+	target := reflect.ValueOf(config).Elem()
+	fields := jsonFields(target.Type())
+
+	for key := range keys {
+		field := target.Field(fields[key])
+		if field.Kind() == reflect.Map {
+			for _, entry := range field.MapKeys() {
+				origins[joinKeyPath(key, entry.String())] = file
+			}
+		} else if field.Kind() != reflect.Slice {
+			origins[key] = file
+		}
+	}
+}
+
+func mergeConfigFragment(config *AppConfig, file string, origins map[string]string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	fragment := AppConfig{}
+	if err := decodeConfig(data, &fragment); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	if _, ok := keys["config_dir"]; ok {
+		return fmt.Errorf("%s: 'config_dir' can only be set in the main config file", file)
+	}
+
+	target := reflect.ValueOf(config).Elem()
+	source := reflect.ValueOf(fragment)
+	fields := jsonFields(target.Type())
+	errs := []error{}
+
+	names := []string{}
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		field := target.Field(fields[key])
+		value := source.Field(fields[key])
+
+		switch field.Kind() {
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				if !containsValue(field, value.Index(i)) {
+					field.Set(reflect.Append(field, value.Index(i)))
+				}
+			}
+		case reflect.Map:
+			if field.IsNil() {
+				field.Set(reflect.MakeMap(field.Type()))
+			}
+			entries := value.MapKeys()
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].String() < entries[j].String()
+			})
+			for _, entry := range entries {
+				path := joinKeyPath(key, entry.String())
+				existing := field.MapIndex(entry)
+				if origin, ok := origins[path]; ok && existing.IsValid() && !reflect.DeepEqual(existing.Interface(), value.MapIndex(entry).Interface()) {
+					errs = append(errs, fmt.Errorf("%s: '%s' conflicts with the value set in %s", file, path, origin))
+					continue
+				}
+				field.SetMapIndex(entry, value.MapIndex(entry))
+				origins[path] = file
+			}
+		default:
+			if origin, ok := origins[key]; ok && !reflect.DeepEqual(field.Interface(), value.Interface()) {
+				errs = append(errs, fmt.Errorf("%s: '%s' conflicts with the value set in %s", file, key, origin))
+				continue
+			}
+			field.Set(value)
+			origins[key] = file
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func containsValue(list reflect.Value, value reflect.Value) bool {
+	for i := 0; i < list.Len(); i++ {
+		if reflect.DeepEqual(list.Index(i).Interface(), value.Interface()) {
+			return true
+		}
+	}
+	return false
+}
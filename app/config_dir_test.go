@@ -0,0 +1,99 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeTestConfigDir(t *testing.T, base string, fragments map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "spuddns.d"), 0700); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+
+	for name, data := range fragments {
+		if err := os.WriteFile(filepath.Join(dir, "spuddns.d", name), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write config fragment: %v", err)
+		}
+	}
+
+	path := filepath.Join(dir, "spuddns.json")
+	if err := os.WriteFile(path, []byte(base), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	return path
+}
+
+func TestConfigDirFragmentsAreMerged(t *testing.T) {
+	path := writeTestConfigDir(t, `{
+		"config_dir": "spuddns.d",
+		"upstream_resolvers": ["1.1.1.1"],
+		"conditional_forwards": {"corp.example": ["10.0.0.1"]},
+		"do_not_cache": []
+	}`, map[string]string{
+		"10-lab.json": `{
+			"conditional_forwards": {"lab.example": ["10.1.0.1", "10.1.0.2"]},
+			"do_not_cache": ["*.lab.example"],
+			"upstream_resolvers": ["1.1.1.1", "9.9.9.9"]
+		}`,
+		"20-acls.json": `{
+			"enable_acls": true,
+			"acls": {"*": {"use_shared_cache": true}},
+			"do_not_cache": ["10.0.0.0/8"]
+		}`,
+		"30-same.json": `{"conditional_forwards": {"corp.example": ["10.0.0.1"]}}`,
+		"notes.txt":    `not a fragment`,
+	})
+
+	config, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if !slices.Equal(config.UpstreamResolvers, []string{"1.1.1.1", "9.9.9.9"}) {
+		t.Errorf("upstream_resolvers were not merged, got %v", config.UpstreamResolvers)
+	}
+	if !slices.Equal(config.DoNotCache, []string{"*.lab.example", "10.0.0.0/8"}) {
+		t.Errorf("do_not_cache was not merged in order, got %v", config.DoNotCache)
+	}
+	if len(config.ConditionalForwards) != 2 || len(config.ConditionalForwards["lab.example"]) != 2 {
+		t.Errorf("conditional_forwards were not merged, got %v", config.ConditionalForwards)
+	}
+	if !config.EnableACLs || !config.ACLs["*"].UseSharedCache {
+		t.Errorf("acls were not merged, got %v", config.ACLs)
+	}
+}
+
+func TestConfigDirReportsConflicts(t *testing.T) {
+	path := writeTestConfigDir(t, `{
+		"config_dir": "spuddns.d",
+		"dns_server_port": 53,
+		"conditional_forwards": {"corp.example": ["10.0.0.1"]}
+	}`, map[string]string{
+		"10-a.json": `{"dns_server_port": 5353, "log_level": -4}`,
+		"20-b.json": `{"log_level": 4, "conditional_forwards": {"corp.example": ["10.0.0.2"]}}`,
+		"30-c.json": `{"config_dir": "/etc"}`,
+		"40-d.json": `{"upstream_resolver": ["1.1.1.1"]}`,
+	})
+
+	_, err := ReadConfig(path)
+	expectConfigErrors(
+		t,
+		err,
+		"10-a.json: 'dns_server_port' conflicts with the value set in "+path,
+		"20-b.json: 'log_level' conflicts with the value set in "+filepath.Join(filepath.Dir(path), "spuddns.d", "10-a.json"),
+		"20-b.json: 'conditional_forwards.corp.example' conflicts",
+		"30-c.json: 'config_dir' can only be set in the main config file",
+		"40-d.json: unknown key 'upstream_resolver'",
+	)
+}
+
+func TestConfigDirMustExist(t *testing.T) {
+	_, err := readTestConfig(t, `{"config_dir": "missing.d"}`)
+	expectConfigErrors(t, err, "'config_dir'")
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -174,3 +175,121 @@ func TestIsCacheableDnsResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUpstreamStrategy(t *testing.T) {
+	appConfig := GetDefaultConfig()
+	appConfig.UpstreamResolvers = []string{"1.1.1.1", "8.8.8.8"}
+	appConfig.UpstreamStrategy = "parallel"
+	appConfig.ConditionalForwards = map[string][]string{
+		"example.com":      {"192.168.1.1", "192.168.1.2"},
+		"example.net":      {"192.168.2.1"},
+		"corp.example.org": {"192.168.3.1", "192.168.3.2"},
+	}
+	appConfig.ConditionalForwardStrategies = map[string]string{
+		"example.com":      "round_robin",
+		"corp.example.org": "fastest",
+	}
+	appConfig.prepare()
+
+	testCases := map[string]string{
+		"rit.edu.":            "parallel",
+		"example.com.":        "parallel",
+		"test.example.com.":   "round_robin",
+		"test.example.net.":   "parallel",
+		"a.corp.example.org.": "fastest",
+	}
+
+	for input, expected := range testCases {
+		t.Run(fmt.Sprintf("GetUpstreamStrategy(%s) = %s", input, expected), func(t *testing.T) {
+			strategy := appConfig.GetUpstreamStrategy(input, nil, nil)
+			if strategy != expected {
+				t.Errorf("wrong strategy for %s: actual = %s, expected = %s", input, strategy, expected)
+			}
+		})
+	}
+}
+
+func TestNestedConditionalForwards(t *testing.T) {
+	appConfig := GetDefaultConfig()
+	appConfig.UpstreamResolvers = []string{"1.1.1.1"}
+	appConfig.ConditionalForwards = map[string][]string{
+		"corp":   {"10.0.0.1"},
+		"a.corp": {"10.0.1.1"},
+	}
+	appConfig.prepare()
+
+	// The least specific forward applies, and not to its own name
+	testCases := map[string]string{
+		"corp.":        "1.1.1.1",
+		"www.corp.":    "10.0.0.1",
+		"a.corp.":      "10.0.0.1",
+		"host.a.corp.": "10.0.0.1",
+		"example.com.": "1.1.1.1",
+	}
+
+	for input, expected := range testCases {
+		resolvers := appConfig.GetUpstreamResolvers(input, nil, nil)
+		if len(resolvers) != 1 || resolvers[0] != expected {
+			t.Errorf("wrong resolvers for %s: actual = %v, expected = %s", input, resolvers, expected)
+		}
+	}
+}
+
+func TestInvalidUpstreamStrategyIsRejected(t *testing.T) {
+	appConfig := GetDefaultConfig()
+	appConfig.UpstreamStrategy = "fastest-please"
+	appConfig.prepare()
+
+	err := appConfig.Validate()
+	if err == nil || !strings.Contains(err.Error(), "upstream_strategy") {
+		t.Errorf("invalid upstream strategy was not rejected: %v", err)
+	}
+}
+
+func TestIsCacheableNegativeResponse(t *testing.T) {
+	q := dns.Question{
+		Name:   "missing.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60")
+	withSoa, _ := models.NewNegativeDnsResponse(dns.RcodeNameError, soa)
+	nodata, _ := models.NewNegativeDnsResponse(dns.RcodeSuccess, soa)
+	withoutSoa := models.NewNXDomainDnsResponse()
+
+	appConfig := GetDefaultConfig()
+	appConfig.prepare()
+
+	if !appConfig.IsCacheable(q, withSoa) {
+		t.Errorf("NXDOMAIN with an SOA should be cacheable")
+	}
+
+	if !appConfig.IsCacheable(q, nodata) {
+		t.Errorf("NODATA with an SOA should be cacheable")
+	}
+
+	if appConfig.IsCacheable(q, withoutSoa) {
+		t.Errorf("NXDOMAIN without an SOA should not be cacheable")
+	}
+
+	appConfig.NegativeCacheMaxTtl = 0
+	if appConfig.IsCacheable(q, withSoa) {
+		t.Errorf("negative answers should not be cacheable when negative caching is disabled")
+	}
+}
+
+func TestLocalRecordsAreGivenToTheResolver(t *testing.T) {
+	config, err := readTestConfig(t, `{"local_records": [{"name": "*.apps.home.example", "type": "A", "values": ["192.0.2.20"], "ttl": 120}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolverConfig, err := config.GetResolverConfig(&AppState{}, "grafana.apps.home.example.", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg := resolverConfig.StaticRecords.Lookup(dns.Question{Name: "grafana.apps.home.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != 120 {
+		t.Errorf("expected the record to be given to the resolver, got %v", msg)
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Every config setting can be overridden by an environment variable
+// named after its key, e.g. SPUDDNS_DNS_SERVER_PORT for dns_server_port
+const envPrefix = "SPUDDNS_"
+
+// Apply SPUDDNS_* environment variables on top of config. Each
+// variable replaces the whole setting rather than merging with it.
+func applyEnvironment(config *AppConfig, environ []string) error {
+	fields := map[string]reflect.Value{}
+	target := reflect.ValueOf(config).Elem()
+	for name, index := range jsonFields(target.Type()) {
+		fields[envPrefix+strings.ToUpper(name)] = target.Field(index)
+	}
+
+	errs := []error{}
+
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, envPrefix) || value == "" {
+			continue
+		}
+
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown environment variable '%s'", name))
+			continue
+		}
+
+		if err := decodeEnvValue(value, field); err != nil {
+			errs = append(errs, fmt.Errorf("'%s' %w", name, err))
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return errors.Join(errs...)
+}
+
+// Decode an environment variable into a setting. Lists are separated
+// by commas or whitespace, maps are written as space-separated
+// key=value pairs (with a comma-separated list as the value for a map
+// of lists), and any list, map or object may instead be given as JSON.
+func decodeEnvValue(value string, target reflect.Value) error {
+	kind := target.Kind()
+
+	trimmed := strings.TrimSpace(value)
+	isJson := (strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")) && json.Valid([]byte(trimmed))
+	if isJson && (kind == reflect.Slice || kind == reflect.Map || kind == reflect.Struct) {
+		decoded := reflect.New(target.Type())
+		decoder := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(decoded.Interface()); err != nil {
+			return fmt.Errorf("is invalid: %w", describeJsonError([]byte(trimmed), err))
+		}
+		target.Set(decoded.Elem())
+		return nil
+	}
+
+	switch kind {
+	case reflect.Bool:
+		switch strings.ToLower(trimmed) {
+		case "1", "true", "yes", "on":
+			target.SetBool(true)
+		case "0", "false", "no", "off":
+			target.SetBool(false)
+		default:
+			return fmt.Errorf("must be %s, not '%s'", describeJsonType(target.Type()), value)
+		}
+	case reflect.Int:
+		number, err := strconv.Atoi(trimmed)
+		if err != nil {
+			return fmt.Errorf("must be %s, not '%s'", describeJsonType(target.Type()), value)
+		}
+		target.SetInt(int64(number))
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Slice:
+		if target.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("must be a JSON list")
+		}
+		target.Set(reflect.ValueOf(splitEnvList(value)))
+	case reflect.Map:
+		decoded, err := decodeEnvMap(value, target.Type())
+		if err != nil {
+			return err
+		}
+		target.Set(decoded)
+	default:
+		return fmt.Errorf("must be JSON")
+	}
+
+	return nil
+}
+
+func splitEnvList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// Decode space-separated key=value pairs into a map of strings or a
+// map of lists of strings
+func decodeEnvMap(value string, t reflect.Type) (reflect.Value, error) {
+	if t.Key().Kind() != reflect.String {
+		return reflect.Value{}, fmt.Errorf("must be a JSON object")
+	}
+
+	elem := t.Elem()
+	isList := elem.Kind() == reflect.Slice && elem.Elem().Kind() == reflect.String
+	if elem.Kind() != reflect.String && !isList {
+		return reflect.Value{}, fmt.Errorf("must be a JSON object")
+	}
+
+	decoded := reflect.MakeMap(t)
+	for _, pair := range strings.Fields(value) {
+		key, item, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return reflect.Value{}, fmt.Errorf("'%s' is not in the form key=value", pair)
+		}
+
+		if isList {
+			decoded.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(splitEnvList(item)))
+		} else {
+			decoded.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(item))
+		}
+	}
+
+	return decoded, nil
+}
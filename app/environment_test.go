@@ -0,0 +1,100 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEnvironmentOverridesConfigFile(t *testing.T) {
+	t.Setenv("SPUDDNS_DNS_SERVER_PORT", "5353")
+	t.Setenv("SPUDDNS_DNS_OVER_HTTP_ENABLE", "yes")
+	t.Setenv("SPUDDNS_UPSTREAM_RESOLVERS", "1.1.1.1, [::1]:5300")
+	t.Setenv("SPUDDNS_CONDITIONAL_FORWARDS", "corp.example=10.0.0.1,10.0.0.2 lan=192.168.1.1")
+	t.Setenv("SPUDDNS_ACLS", `{"*": {"upstream_resolvers": ["9.9.9.9"], "use_shared_cache": true}}`)
+	t.Setenv("SPUDDNS_DO_NOT_CACHE", `["*.internal", "10.0.0.0/8"]`)
+
+	config, err := readTestConfig(t, `{
+		"dns_server_port": 53,
+		"log_level": -4,
+		"upstream_resolvers": ["8.8.8.8"]
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if config.DnsServerPort != 5353 {
+		t.Errorf("dns_server_port was not overridden, got %d", config.DnsServerPort)
+	}
+	if !config.DnsOverHttpEnable {
+		t.Errorf("dns_over_http_enable was not overridden")
+	}
+	if config.LogLevel != -4 {
+		t.Errorf("log_level from the config file was lost, got %d", config.LogLevel)
+	}
+	if !slices.Equal(config.UpstreamResolvers, []string{"1.1.1.1", "[::1]:5300"}) {
+		t.Errorf("upstream_resolvers was not overridden, got %v", config.UpstreamResolvers)
+	}
+	if !slices.Equal(config.ConditionalForwards["corp.example"], []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("conditional_forwards was not overridden, got %v", config.ConditionalForwards)
+	}
+	if !slices.Equal(config.ConditionalForwards["lan"], []string{"192.168.1.1"}) {
+		t.Errorf("conditional_forwards was not overridden, got %v", config.ConditionalForwards)
+	}
+	if acl, ok := config.ACLs["*"]; !ok || !acl.UseSharedCache || !slices.Equal(acl.UpstreamResolvers, []string{"9.9.9.9"}) {
+		t.Errorf("acls was not overridden, got %v", config.ACLs)
+	}
+	if !slices.Equal(config.DoNotCache, []string{"*.internal", "10.0.0.0/8"}) {
+		t.Errorf("do_not_cache was not overridden, got %v", config.DoNotCache)
+	}
+}
+
+func TestEnvironmentOverridesWithoutConfigFile(t *testing.T) {
+	t.Setenv("SPUDDNS_PERSISTENT_CACHE_FILE", "/var/cache/spuddns/cache")
+	t.Setenv("SPUDDNS_UPSTREAM_RESOLVERS", "tls://1.1.1.1")
+
+	config, err := ReadConfig(t.TempDir() + "/missing.json")
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if config.PersistentCacheFile != "/var/cache/spuddns/cache" {
+		t.Errorf("persistent_cache_file was not set, got '%s'", config.PersistentCacheFile)
+	}
+
+	upstreams := config.GetUpstreamResolvers("example.com", nil, nil)
+	if !slices.Equal(upstreams, []string{"tls://1.1.1.1"}) {
+		t.Errorf("expected the overridden upstream to be used, got %v", upstreams)
+	}
+}
+
+func TestEnvironmentRejectsInvalidValues(t *testing.T) {
+	t.Setenv("SPUDDNS_DNS_SERVER_PORTS", "53")
+	t.Setenv("SPUDDNS_SERVE_STALE", "maybe")
+	t.Setenv("SPUDDNS_CACHE_MAX_ENTRIES", "lots")
+	t.Setenv("SPUDDNS_ACLS", "example")
+	t.Setenv("SPUDDNS_CONDITIONAL_FORWARDS", "corp.example")
+
+	_, err := readTestConfig(t, `{}`)
+	expectConfigErrors(
+		t,
+		err,
+		"unknown environment variable 'SPUDDNS_DNS_SERVER_PORTS'",
+		"'SPUDDNS_SERVE_STALE' must be true or false",
+		"'SPUDDNS_CACHE_MAX_ENTRIES' must be a whole number",
+		"'SPUDDNS_ACLS' must be a JSON object",
+		"'SPUDDNS_CONDITIONAL_FORWARDS' 'corp.example' is not in the form key=value",
+	)
+}
+
+func TestEnvironmentOverridesAreValidated(t *testing.T) {
+	t.Setenv("SPUDDNS_UPSTREAM_STRATEGY", "random")
+
+	_, err := readTestConfig(t, `{}`)
+	expectConfigErrors(t, err, "'upstream_strategy' 'random' is not a known strategy")
+
+	t.Setenv("SPUDDNS_UPSTREAM_STRATEGY", "")
+	t.Setenv("SPUDDNS_ACLS", `{"*": {"add_cpe": "abc"}}`)
+
+	_, err = readTestConfig(t, `{}`)
+	expectConfigErrors(t, err, "'SPUDDNS_ACLS' is invalid", "add_cpe")
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// The running config, which can be replaced by reloading the config
+// file while queries are being answered. Each query should Get the
+// config once and use it throughout, so that it isn't answered
+// partly with one config and partly with another.
+type LiveConfig struct {
+	current atomic.Pointer[AppConfig]
+	path    string
+	// Called, in order, after the config is replaced
+	listeners []func(previous *AppConfig, current *AppConfig)
+	// Serializes reloads
+	mutex sync.Mutex
+}
+
+func NewLiveConfig(path string, config *AppConfig) *LiveConfig {
+	live := &LiveConfig{path: path}
+	live.current.Store(config)
+	return live
+}
+
+func (c *LiveConfig) Get() *AppConfig {
+	return c.current.Load()
+}
+
+// Register a function to be called after the config is reloaded
+func (c *LiveConfig) OnReload(fn func(previous *AppConfig, current *AppConfig)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.listeners = append(c.listeners, fn)
+}
+
+// Re-read the config file and, if it's valid, replace the running
+// config with it. An invalid config leaves the running one in place.
+func (c *LiveConfig) Reload() error {
+	config, err := ReadConfig(c.path)
+	if err != nil {
+		return err
+	}
+
+	return c.Replace(config)
+}
+
+// Replace the running config, if the new one is valid
+func (c *LiveConfig) Replace(config *AppConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous := c.current.Load()
+
+	// The admin API is started once, and reloads can come through it
+	if config.AdminApiEnable != previous.AdminApiEnable || config.AdminApiAddress != previous.AdminApiAddress {
+		return fmt.Errorf("'admin_api_enable' and 'admin_api_address' can't be changed by reloading - restart spuddns to change them")
+	}
+
+	// resolv.conf is read and watched from start, so it can only be
+	// dropped by a reload
+	if config.RespectResolveConf && (!previous.RespectResolveConf || config.ResolvConfPath != previous.ResolvConfPath) {
+		return fmt.Errorf("'respect_resolvconf' can't be turned on and 'resolvconf_path' can't be changed by reloading - restart spuddns to change them")
+	}
+
+	// These are set up at start rather than read from the config file
+	if config.ResolvConf == nil && config.RespectResolveConf {
+		config.ResolvConf = previous.ResolvConf
+	}
+	if config.EtcHosts == nil {
+		config.EtcHosts = previous.EtcHosts
+	}
+
+	c.current.Store(config)
+
+	for _, fn := range c.listeners {
+		fn(previous, config)
+	}
+
+	return nil
+}
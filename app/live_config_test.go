@@ -0,0 +1,94 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/thenaterhood/spuddns/system"
+)
+
+func TestLiveConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spuddns.json")
+	os.WriteFile(path, []byte(`{"upstream_resolvers": ["192.0.2.1"]}`), 0600)
+
+	config, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("reading the config errored: %v", err)
+	}
+	config.EtcHosts = system.NewEtcHosts(nil)
+
+	live := NewLiveConfig(path, config)
+
+	reloads := 0
+	live.OnReload(func(previous *AppConfig, current *AppConfig) {
+		reloads++
+		if previous != config || current != live.Get() {
+			t.Errorf("listener was not given the previous and current config")
+		}
+	})
+
+	os.WriteFile(path, []byte(`{"upstream_resolvers": ["192.0.2.2"]}`), 0600)
+	if err := live.Reload(); err != nil {
+		t.Fatalf("reloading the config errored: %v", err)
+	}
+
+	if !slices.Equal(live.Get().UpstreamResolvers, []string{"192.0.2.2"}) {
+		t.Errorf("config was not reloaded, upstreams are %v", live.Get().UpstreamResolvers)
+	}
+
+	if live.Get().EtcHosts != config.EtcHosts {
+		t.Errorf("hosts file was not carried over to the reloaded config")
+	}
+
+	if reloads != 1 {
+		t.Errorf("expected the listener to be called once, it was called %d times", reloads)
+	}
+}
+
+func TestLiveConfigKeepsRunningConfigWhenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spuddns.json")
+	config := GetDefaultConfig()
+	live := NewLiveConfig(path, &config)
+
+	live.OnReload(func(*AppConfig, *AppConfig) {
+		t.Errorf("listener should not be called for an invalid config")
+	})
+
+	invalid := []string{
+		`{"upstream_resolvers": [`,
+		`{"dns_server_port": 70000}`,
+		`{"dns_over_tls_enable": true, "dns_over_tls_cert_file": "/nonexistent"}`,
+		`{"admin_api_enable": true, "admin_api_token": "secret"}`,
+		`{"admin_api_address": "127.0.0.1:5381"}`,
+		`{"resolvconf_path": "/run/resolv.conf"}`,
+	}
+
+	for _, data := range invalid {
+		os.WriteFile(path, []byte(data), 0600)
+		if err := live.Reload(); err == nil {
+			t.Errorf("reloading %s should have errored", data)
+		}
+
+		if live.Get() != &config {
+			t.Errorf("running config was replaced by %s", data)
+		}
+	}
+}
+
+func TestLiveConfigRejectsRespectingResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spuddns.json")
+	config := GetDefaultConfig()
+	config.RespectResolveConf = false
+	live := NewLiveConfig(path, &config)
+
+	os.WriteFile(path, []byte(`{"respect_resolvconf": true}`), 0600)
+	if err := live.Reload(); err == nil {
+		t.Errorf("turning respect_resolvconf on should have errored")
+	}
+
+	if live.Get() != &config {
+		t.Errorf("running config was replaced")
+	}
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+	"github.com/thenaterhood/spuddns/resolver"
+)
+
+// Get the addresses of the nameservers for a delegation from a local
+// zone, resolving their names when the zone has no glue for them
+func (appState *AppState) delegationServers(query models.DnsQuery, nameservers []string, forwarder models.DnsQueryClient) []string {
+	servers := []string{}
+
+	for _, nameserver := range nameservers {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			nsQuery, err := query.WithDifferentQuestion(dns.Question{Name: nameserver, Qtype: qtype, Qclass: dns.ClassINET})
+			if err != nil {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			response, err := nsQuery.ResolveWith(forwarder, ctx)
+			cancel()
+			if err != nil || response == nil {
+				continue
+			}
+
+			for _, rr := range response.AnswerRRs() {
+				switch record := rr.(type) {
+				case *dns.A:
+					servers = append(servers, record.A.String())
+				case *dns.AAAA:
+					servers = append(servers, record.AAAA.String())
+				}
+			}
+		}
+	}
+
+	return servers
+}
+
+// Get the answer for a name in a local zone, if it's in one. Names
+// delegated from the zone are asked of the nameservers they're
+// delegated to, and CNAMEs that leave the zone are followed.
+func (appState *AppState) resolveLocal(query models.DnsQuery, resolverConfig resolver.DnsResolverConfig) (*models.DnsResponse, error) {
+	if appState.LocalZones == nil {
+		return nil, nil
+	}
+
+	question := query.FirstQuestion()
+	response, delegation := appState.LocalZones.Lookup(*question)
+	forwarder := resolver.GetDnsResolver(resolverConfig)
+
+	if response != nil {
+		return followCname(response, query, forwarder), nil
+	}
+	if delegation == nil {
+		return nil, nil
+	}
+
+	servers := delegation.Addresses
+	if len(servers) == 0 {
+		servers = appState.delegationServers(query, delegation.Nameservers, forwarder)
+	}
+
+	appState.Log.Debug("forwarding query for delegated name", "query", question.Name, "qtype", question.Qtype, "zone", delegation.Zone, "servers", servers)
+	if len(servers) == 0 {
+		return models.NewServFailDnsResponse(), nil
+	}
+
+	delegatedConfig := resolverConfig
+	delegatedConfig.Servers = servers
+	delegatedConfig.DefaultForwarder = nil
+	delegatedConfig.Mdns = &resolver.MdnsConfig{Enable: false}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return query.ResolveWith(resolver.GetDnsResolver(delegatedConfig), ctx)
+}
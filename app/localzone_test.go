@@ -0,0 +1,77 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+	"github.com/thenaterhood/spuddns/localzone"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+func TestResolveQueryAnswersFromLocalZones(t *testing.T) {
+	path := testfile.Write(t, "home.zone", `$TTL 300
+@   SOA ns.home.example. hostmaster.home.example. 1 3600 600 86400 60
+nas A 192.0.2.10
+web CNAME fine.example.
+`)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	appState := AppState{
+		Cache:            &cache.DummyCache{},
+		DefaultForwarder: policyTestResolver{},
+		LocalZones: localzone.NewLocalZones(localzone.LocalZonesConfig{
+			Zones:  []localzone.ZoneConfig{{Origin: "home.example.", File: path}},
+			Logger: logger,
+		}),
+		Log:     logger,
+		Metrics: metrics.DummyMetrics{},
+	}
+	appConfig := GetDefaultConfig()
+	appConfig.RespectResolveConf = false
+	appConfig.MdnsEnable = false
+
+	resolve := func(name string) models.DnsResponse {
+		query, err := models.NewDnsQueryFromQuestions([]dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+		if err != nil {
+			t.Fatalf("invalid dns question: %v", err)
+		}
+
+		exchange, err := appState.ResolveQueryOnly(*query, &appConfig)
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %v", name, err)
+		}
+		return exchange.Response
+	}
+
+	response := resolve("nas.home.example.")
+	if !response.Authoritative || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected an authoritative answer from the zone")
+	}
+	if appConfig.IsCacheable(dns.Question{Name: "nas.home.example.", Qtype: dns.TypeA}, &response) {
+		t.Errorf("expected answers from local zones not to be cached")
+	}
+
+	// The resolver would answer for any name, so this must come
+	// from the zone
+	response = resolve("missing.home.example.")
+	if !response.Authoritative || response.Rcode() != dns.RcodeNameError || response.Soa() == nil {
+		t.Errorf("expected an authoritative NXDOMAIN with the zone's SOA, got %s", dns.RcodeToString[response.Rcode()])
+	}
+
+	answers := resolve("web.home.example.").AnswerRRs()
+	if len(answers) != 2 {
+		t.Fatalf("expected the CNAME out of the zone to be followed, got %v", answers)
+	}
+	if a, ok := answers[1].(*dns.A); !ok || a.Hdr.Name != "fine.example." {
+		t.Errorf("expected the address of fine.example., got %v", answers[1])
+	}
+
+	if response := resolve("fine.example."); response.Authoritative {
+		t.Errorf("expected names outside the zone to be resolved normally")
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+	"github.com/thenaterhood/spuddns/rpz"
+)
+
+// Log and count a query that matched a response policy
+func (appState *AppState) logRpzHit(hit *rpz.Hit, question *dns.Question) {
+	appState.Log.Info(
+		"response policy applied",
+		"query", question.Name,
+		"qtype", question.Qtype,
+		"zone", hit.Zone,
+		"trigger", hit.Trigger,
+		"match", hit.Match,
+		"action", hit.Action,
+	)
+	appState.Metrics.IncRpzHits(hit.Zone, hit.Trigger, hit.Action)
+}
+
+// Get the answer given by a response policy, or nil if the query
+// should be answered normally. A local data CNAME is followed through
+// the resolver, as the client would have done.
+func (appState *AppState) rpzResponse(hit *rpz.Hit, query models.DnsQuery, forwarder models.DnsQueryClient) *models.DnsResponse {
+	response := hit.Response(*query.FirstQuestion())
+	if response == nil {
+		return nil
+	}
+
+	return followCname(response, query, forwarder)
+}
+
+// Get the names of the nameservers for the zone a name is in, walking
+// up from the name until a zone cut is found. The whole walk is bound
+// by the context, which is the query's, so it can't outlast the query.
+func (appState *AppState) lookupNameservers(ctx context.Context, query models.DnsQuery, forwarder models.DnsQueryClient) []string {
+	name := query.FirstQuestion().Name
+	// Whether name is the apex of the zone from a negative answer
+	atCut := false
+
+	for range dns.CountLabel(name) + 1 {
+		nsQuestion := dns.Question{Name: name, Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+		nsQuery, err := query.WithDifferentQuestion(nsQuestion)
+		if err != nil {
+			return nil
+		}
+
+		response, err := nsQuery.ResolveWith(forwarder, ctx)
+		if err != nil || response == nil {
+			return nil
+		}
+
+		// Cache the lookup like any other answer, since it's
+		// repeated for every query
+		if appState.DnsPipeline != nil && !response.FromCache {
+			go func() {
+				*appState.DnsPipeline <- models.DnsExchange{Question: nsQuestion, Response: *response}
+			}()
+		}
+
+		nameservers := []string{}
+		for _, rr := range response.AnswerRRs() {
+			if ns, ok := rr.(*dns.NS); ok {
+				nameservers = append(nameservers, ns.Ns)
+			}
+		}
+		if len(nameservers) > 0 || atCut {
+			return nameservers
+		}
+
+		// A negative answer gives the zone the name is in
+		if soa := response.Soa(); soa != nil && soa.Hdr.Name != name && dns.IsSubDomain(soa.Hdr.Name, name) {
+			name = soa.Hdr.Name
+			atCut = true
+			continue
+		}
+
+		labels := dns.Split(name)
+		if len(labels) < 2 {
+			return nil
+		}
+		name = name[labels[1]:]
+	}
+
+	return nil
+}
+
+// Get the answer given by a response policy matching the addresses in
+// an answer or the nameservers of the name that was queried, if any
+func (appState *AppState) resolveResponsePolicy(ctx context.Context, query models.DnsQuery, answer *models.DnsResponse, forwarder models.DnsQueryClient) *models.DnsResponse {
+	if appState.Rpz == nil {
+		return nil
+	}
+
+	hit := appState.Rpz.MatchResponse(answer)
+	if hit == nil && appState.Rpz.HasNsdnameTriggers() {
+		hit = appState.Rpz.MatchNsdname(appState.lookupNameservers(ctx, query, forwarder))
+	}
+	if hit == nil {
+		return nil
+	}
+
+	appState.logRpzHit(hit, query.FirstQuestion())
+	return appState.rpzResponse(hit, query, forwarder)
+}
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+	"github.com/thenaterhood/spuddns/rpz"
+)
+
+// Answers A queries with 192.0.2.66 for phish.example and 192.0.2.1
+// otherwise, and has the zone evil.example served by a nameserver
+// under evil-host.example
+type policyTestResolver struct{}
+
+func (policyTestResolver) QueryDns(query models.DnsQuery) (*models.DnsResponse, error) {
+	question := query.FirstQuestion()
+	msg := new(dns.Msg)
+
+	record := func(data string) dns.RR {
+		rr, _ := dns.NewRR(data)
+		return rr
+	}
+
+	switch question.Qtype {
+	case dns.TypeA:
+		address := "192.0.2.1"
+		if question.Name == "phish.example." {
+			address = "192.0.2.66"
+		}
+		msg.Answer = []dns.RR{record(question.Name + " 300 IN A " + address)}
+	case dns.TypeNS:
+		if question.Name == "evil.example." {
+			msg.Answer = []dns.RR{record("evil.example. 300 IN NS ns1.evil-host.example.")}
+		} else if dns.IsSubDomain("evil.example.", question.Name) {
+			msg.Ns = []dns.RR{record("evil.example. 300 IN SOA ns1.evil-host.example. root.evil.example. 1 3600 600 86400 60")}
+		} else {
+			msg.Answer = []dns.RR{record(question.Name + " 300 IN NS ns.example.net.")}
+		}
+	}
+
+	return models.NewDnsResponseFromMsg(msg)
+}
+
+func TestResolveQueryAppliesResponsePolicies(t *testing.T) {
+	path := testfile.Write(t, "policy.rpz", `$ORIGIN rpz.example.
+$TTL 60
+@ SOA localhost. root.localhost. 1 3600 600 86400 60
+32.66.2.0.192.rpz-ip CNAME .
+*.evil-host.example.rpz-nsdname CNAME .
+walled.example CNAME safe.example.
+allowed.evil.example CNAME rpz-passthru.
+`)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	appState := AppState{
+		Cache:            &cache.DummyCache{},
+		DefaultForwarder: policyTestResolver{},
+		Log:              logger,
+		Metrics:          metrics.DummyMetrics{},
+		Rpz: rpz.NewRpz(rpz.RpzConfig{
+			Zones:   []rpz.ZoneConfig{{Name: "test", File: path}},
+			Logger:  logger,
+			Metrics: metrics.DummyMetrics{},
+		}),
+	}
+	appConfig := GetDefaultConfig()
+	appConfig.RespectResolveConf = false
+	appConfig.MdnsEnable = false
+
+	resolve := func(name string) models.DnsResponse {
+		query, err := models.NewDnsQueryFromQuestions([]dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+		if err != nil {
+			t.Fatalf("invalid dns question: %v", err)
+		}
+
+		exchange, err := appState.ResolveQueryOnly(*query, &appConfig)
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %v", name, err)
+		}
+		return exchange.Response
+	}
+
+	if response := resolve("fine.example."); response.Blocked || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected a name without a policy to resolve normally")
+	}
+
+	if response := resolve("phish.example."); response.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected the answer address to trigger NXDOMAIN, got %s", dns.RcodeToString[response.Rcode()])
+	}
+
+	if response := resolve("www.evil.example."); response.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected the nameserver to trigger NXDOMAIN, got %s", dns.RcodeToString[response.Rcode()])
+	}
+
+	if response := resolve("allowed.evil.example."); response.Rcode() != dns.RcodeSuccess || response.Blocked {
+		t.Errorf("expected passthru to skip the nameserver policy, got %s", dns.RcodeToString[response.Rcode()])
+	}
+
+	answers := resolve("walled.example.").AnswerRRs()
+	if len(answers) != 2 {
+		t.Fatalf("expected the local data CNAME to be followed, got %v", answers)
+	}
+	if cname, ok := answers[0].(*dns.CNAME); !ok || cname.Target != "safe.example." {
+		t.Errorf("expected a CNAME to safe.example., got %v", answers[0])
+	}
+	if a, ok := answers[1].(*dns.A); !ok || a.Hdr.Name != "safe.example." {
+		t.Errorf("expected the address of safe.example., got %v", answers[1])
+	}
+}
+
+// Answers NS queries for names under example. with the SOA of
+// example., which has no NS records of its own, after a delay
+type nsWalkResolver struct {
+	delay   time.Duration
+	queries *atomic.Int32
+}
+
+func (r nsWalkResolver) QueryDns(query models.DnsQuery) (*models.DnsResponse, error) {
+	r.queries.Add(1)
+	time.Sleep(r.delay)
+
+	msg := new(dns.Msg)
+	if query.FirstQuestion().Name != "example." {
+		soa, _ := dns.NewRR("example. 300 IN SOA ns.example. root.example. 1 3600 600 86400 60")
+		msg.Ns = []dns.RR{soa}
+	}
+
+	return models.NewDnsResponseFromMsg(msg)
+}
+
+func TestLookupNameserversStopsAtZoneCut(t *testing.T) {
+	appState := AppState{Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "a.b.c.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+
+	queries := &atomic.Int32{}
+	nameservers := appState.lookupNameservers(context.Background(), *query, nsWalkResolver{queries: queries})
+	if len(nameservers) != 0 {
+		t.Errorf("expected no nameservers, got %v", nameservers)
+	}
+	if queries.Load() != 2 {
+		t.Errorf("expected the name and the zone cut to be looked up, got %d lookups", queries.Load())
+	}
+}
+
+func TestLookupNameserversIsBoundByTheQuery(t *testing.T) {
+	appState := AppState{Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "a.b.c.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	queries := &atomic.Int32{}
+	started := time.Now()
+	appState.lookupNameservers(ctx, *query, nsWalkResolver{delay: 100 * time.Millisecond, queries: queries})
+	if elapsed := time.Since(started); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the lookup to stop at the query's deadline, took %s", elapsed)
+	}
+}
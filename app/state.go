@@ -6,18 +6,116 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/blocklist"
 	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/localzone"
 	"github.com/thenaterhood/spuddns/metrics"
 	"github.com/thenaterhood/spuddns/models"
 	"github.com/thenaterhood/spuddns/resolver"
+	"github.com/thenaterhood/spuddns/rpz"
 )
 
 type AppState struct {
+	Blocklist        *blocklist.Blocklist
 	Cache            cache.Cache
 	DefaultForwarder models.DnsQueryClient
 	DnsPipeline      *chan models.DnsExchange
+	LocalZones       *localzone.LocalZones
 	Log              *slog.Logger
 	Metrics          metrics.MetricsInterface
+	Rpz              *rpz.Rpz
+	UpstreamHealth   *resolver.UpstreamHealth
+}
+
+// Get an expired answer from the cache to serve when upstream
+// resolution failed, if serving stale answers is enabled
+func (appState *AppState) resolveStale(query models.DnsQuery, resolverConfig *resolver.DnsResolverConfig, appConfig *AppConfig, resolveErr error) *models.DnsResponse {
+	if !appConfig.ServeStale {
+		return nil
+	}
+
+	staleCache, ok := resolverConfig.Cache.(cache.Cache)
+	if !ok {
+		return nil
+	}
+
+	response, err := staleCache.QueryStale(query)
+	if err != nil || response == nil || !response.IsSuccess() {
+		return nil
+	}
+
+	appState.Log.Info("upstream resolution failed - serving stale answer", "query", query.FirstQuestion().Name, "qtype", query.FirstQuestion().Qtype, "err", resolveErr)
+	appState.Metrics.IncQueriesAnsweredStale()
+
+	response.Stale = true
+	response.SetTtl(time.Duration(appConfig.ServeStaleTtl) * time.Second)
+
+	return response
+}
+
+// Follow a CNAME that ends an answer through the resolver, as the
+// client would have done, for answers made up locally
+func followCname(response *models.DnsResponse, query models.DnsQuery, forwarder models.DnsQueryClient) *models.DnsResponse {
+	question := *query.FirstQuestion()
+	answers := response.AnswerRRs()
+	if len(answers) == 0 || question.Qtype == dns.TypeCNAME {
+		return response
+	}
+
+	cname, ok := answers[len(answers)-1].(*dns.CNAME)
+	if !ok {
+		return response
+	}
+
+	target := question
+	target.Name = cname.Target
+	targetQuery, err := query.WithDifferentQuestion(target)
+	if err != nil {
+		return response
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resolved, err := targetQuery.ResolveWith(forwarder, ctx)
+	if err != nil || resolved == nil {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	msg.Rcode = resolved.Rcode()
+	msg.Answer = append(answers, resolved.AnswerRRs()...)
+
+	followed, err := models.NewDnsResponseFromMsg(msg)
+	if err != nil {
+		return response
+	}
+	followed.Blocked = response.Blocked
+	followed.Authoritative = response.Authoritative
+	followed.RecursionAvailable = response.RecursionAvailable
+	followed.Resolver = resolved.Resolver
+
+	return followed
+}
+
+// Get the answer to a client's question for a name on a blocklist,
+// if it is
+func (appState *AppState) resolveBlocked(query models.DnsQuery, question *dns.Question, appConfig *AppConfig) *models.DnsResponse {
+	if appState.Blocklist == nil {
+		return nil
+	}
+
+	list, blocked := appState.Blocklist.Match(question.Name)
+	if !blocked {
+		return nil
+	}
+
+	response := appConfig.GetBlocklistResponse(query.ClientId, query.ClientIp)
+	appState.Log.Debug("blocked query", "query", question.Name, "qtype", question.Qtype, "list", list, "response", response)
+	appState.Metrics.IncQueriesBlocked(list)
+
+	return blocklist.BlockedResponse(*question, response)
 }
 
 func (appState *AppState) ResolveQueryOnly(query models.DnsQuery, appConfig *AppConfig) (*models.DnsExchange, error) {
@@ -53,6 +151,10 @@ func (appState *AppState) ResolveQueryOnly(query models.DnsQuery, appConfig *App
 
 	names := appConfig.GetFullyQualifiedNames(question.Name)
 
+	// First negative answer with an SOA, which is returned (and can be
+	// cached) if none of the names resolve
+	var negative *models.DnsExchange
+
 	for _, alternateName := range names {
 		resolverConfig, err := appConfig.GetResolverConfig(appState, alternateName, query.ClientId, query.ClientIp)
 		if err != nil {
@@ -65,23 +167,77 @@ func (appState *AppState) ResolveQueryOnly(query models.DnsQuery, appConfig *App
 			continue
 		}
 
+		// Local zones are authoritative, so nothing else applies to
+		// the names in them
+		local, localErr := appState.resolveLocal(*modifiedQuery, *resolverConfig)
+		if localErr != nil {
+			return &models.DnsExchange{Response: *models.NewServFailDnsResponse(), Question: *modifiedQuery.FirstQuestion()}, localErr
+		}
+		if local != nil {
+			if local.IsNegative() && local.Soa() != nil {
+				if negative == nil {
+					negative = &models.DnsExchange{Response: *local, Question: *modifiedQuery.FirstQuestion()}
+				}
+				continue
+			}
+			return &models.DnsExchange{Response: *local, Question: *modifiedQuery.FirstQuestion()}, nil
+		}
+
+		if blocked := appState.resolveBlocked(query, modifiedQuery.FirstQuestion(), appConfig); blocked != nil {
+			return &models.DnsExchange{Response: *blocked, Question: *modifiedQuery.FirstQuestion()}, nil
+		}
+
+		forwarder := resolver.GetDnsResolver(*resolverConfig)
+
+		// A passthru policy exempts the query from any other policy
+		passthru := false
+		if appState.Rpz != nil {
+			if hit := appState.Rpz.MatchQname(alternateName); hit != nil {
+				appState.logRpzHit(hit, modifiedQuery.FirstQuestion())
+				if response := appState.rpzResponse(hit, *modifiedQuery, forwarder); response != nil {
+					return &models.DnsExchange{Response: *response, Question: *modifiedQuery.FirstQuestion()}, nil
+				}
+				passthru = true
+			}
+		}
+
 		if len(resolverConfig.Servers) > 0 {
 			hasUpstreams = true
 		}
 
-		forwarder := resolver.GetDnsResolver(*resolverConfig)
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		answer, err = modifiedQuery.ResolveWith(forwarder, ctx)
 
+		// Answers from upstream, stale or not, are subject to the
+		// response policies
+		withPolicy := func(answer *models.DnsResponse) *models.DnsExchange {
+			if !passthru {
+				if response := appState.resolveResponsePolicy(ctx, *modifiedQuery, answer, forwarder); response != nil {
+					return &models.DnsExchange{Response: *response, Question: *modifiedQuery.FirstQuestion()}
+				}
+			}
+			return &models.DnsExchange{Response: *answer, Question: *modifiedQuery.FirstQuestion()}
+		}
+
 		if answer != nil && answer.IsSuccess() {
-			return &models.DnsExchange{Response: *answer, Question: *modifiedQuery.FirstQuestion()}, nil
+			return withPolicy(answer), nil
 		}
 
 		if err != nil {
+			if stale := appState.resolveStale(*modifiedQuery, resolverConfig, appConfig, err); stale != nil {
+				return withPolicy(stale), nil
+			}
 			return &models.DnsExchange{Response: *models.NewServFailDnsResponse(), Question: *modifiedQuery.FirstQuestion()}, err
 		}
 
+		if answer != nil && answer.IsNegative() && answer.Soa() != nil {
+			if negative == nil {
+				negative = &models.DnsExchange{Response: *answer, Question: *modifiedQuery.FirstQuestion()}
+			}
+			continue
+		}
+
 		exists := modifiedQuery.NameExists(forwarder)
 		if exists {
 			answer := models.NewNoErrorDnsResponse()
@@ -93,6 +249,10 @@ func (appState *AppState) ResolveQueryOnly(query models.DnsQuery, appConfig *App
 		}
 	}
 
+	if negative != nil {
+		return negative, nil
+	}
+
 	answer = models.NewNXDomainDnsResponse()
 	answer.RecursionAvailable = hasUpstreams
 
@@ -106,8 +266,15 @@ func (appState *AppState) ResolveQueryComplete(query models.DnsQuery, appConfig
 		appState.Log.Error("error resolving query", "err", err)
 	}
 
-	if dnsExchange != nil && dnsExchange.Response.IsSuccess() {
+	// Negative answers with an SOA are real answers, unlike the
+	// NXDOMAIN given when nothing could answer the query
+	negative := dnsExchange != nil && dnsExchange.Response.IsNegative() && dnsExchange.Response.Soa() != nil
+
+	if dnsExchange != nil && (dnsExchange.Response.IsSuccess() || negative) {
 		if dnsExchange.Response.FromCache {
+			if negative {
+				appState.Metrics.IncQueriesAnsweredNegativeFromCache()
+			}
 			appState.Metrics.IncQueriesAnsweredFromCache()
 		} else {
 			if appState.DnsPipeline != nil {
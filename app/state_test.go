@@ -0,0 +1,100 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+	"github.com/thenaterhood/spuddns/rpz"
+)
+
+// Start an upstream resolver that answers every query with SERVFAIL
+func startServFailUpstream(t *testing.T) string {
+	t.Helper()
+
+	started := sync.Mutex{}
+	started.Lock()
+	server := &dns.Server{
+		Addr:              "127.0.0.1:0",
+		Net:               "udp",
+		NotifyStartedFunc: started.Unlock,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ListenAndServe()
+	started.Lock()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return server.PacketConn.LocalAddr().String()
+}
+
+func TestServeStaleWhenUpstreamsServFail(t *testing.T) {
+	path := testfile.Write(t, "policy.rpz", `$ORIGIN rpz.example.
+$TTL 60
+@ SOA localhost. root.localhost. 1 3600 600 86400 60
+32.66.2.0.192.rpz-ip CNAME .
+`)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	staleCache, err := cache.GetCache(cache.CacheConfig{
+		Enable:   true,
+		Logger:   logger,
+		Metrics:  metrics.DummyMetrics{},
+		MaxStale: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to get cache: %v", err)
+	}
+
+	// Entries that have already expired
+	for name, address := range map[string]string{"fine.example.": "192.0.2.1", "phish.example.": "192.0.2.66"} {
+		response, _ := models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{{Name: name, Type: dns.TypeA, TTL: 0, Data: address}})
+		staleCache.CacheDnsResponse(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, *response)
+	}
+
+	appState := AppState{
+		Cache:   staleCache,
+		Log:     logger,
+		Metrics: metrics.DummyMetrics{},
+		Rpz: rpz.NewRpz(rpz.RpzConfig{
+			Zones:   []rpz.ZoneConfig{{Name: "test", File: path}},
+			Logger:  logger,
+			Metrics: metrics.DummyMetrics{},
+		}),
+	}
+	appConfig := GetDefaultConfig()
+	appConfig.RespectResolveConf = false
+	appConfig.MdnsEnable = false
+	appConfig.UpstreamResolvers = []string{startServFailUpstream(t)}
+
+	resolve := func(name string) models.DnsResponse {
+		query, err := models.NewDnsQueryFromQuestions([]dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+		if err != nil {
+			t.Fatalf("invalid dns question: %v", err)
+		}
+
+		exchange, err := appState.ResolveQueryOnly(*query, &appConfig)
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %v", name, err)
+		}
+		return exchange.Response
+	}
+
+	if response := resolve("fine.example."); !response.Stale || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected the stale answer when the upstream answers SERVFAIL, got %s", dns.RcodeToString[response.Rcode()])
+	}
+
+	if response := resolve("phish.example."); response.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected the stale answer's address to trigger NXDOMAIN, got %s", dns.RcodeToString[response.Rcode()])
+	}
+}
@@ -0,0 +1,334 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/blocklist"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/resolver"
+)
+
+// Decode a config file into config, rejecting keys that don't
+// correspond to a setting and values of the wrong type
+func decodeConfig(data []byte, config *AppConfig) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return describeJsonError(data, err)
+	}
+
+	unknown := unknownKeys(raw, reflect.TypeOf(*config), "")
+	if len(unknown) > 0 {
+		errs := []error{}
+		for _, key := range unknown {
+			errs = append(errs, fmt.Errorf("unknown key '%s'", key))
+		}
+		return errors.Join(errs...)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return describeJsonError(data, err)
+	}
+
+	return nil
+}
+
+func describeJsonError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset := int(syntaxErr.Offset)
+		line := bytes.Count(data[:offset], []byte("\n")) + 1
+		column := offset - bytes.LastIndexByte(data[:offset], '\n') - 1
+		return fmt.Errorf("invalid json at line %d, column %d: %w", line, column, err)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("'%s' must be %s, not %s", typeErr.Field, describeJsonType(typeErr.Type), typeErr.Value)
+	default:
+		return err
+	}
+}
+
+func describeJsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	default:
+		return t.String()
+	}
+}
+
+// Find the keys (as paths such as acls.example.add_cpe_id) in a
+// decoded JSON value that have no matching field in t
+func unknownKeys(value any, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	unknown := []string{}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return unknown
+		}
+
+		fields := jsonFields(t)
+		for key, child := range object {
+			index, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, joinKeyPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(child, t.Field(index).Type, joinKeyPath(path, key))...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return unknown
+		}
+
+		for key, child := range object {
+			unknown = append(unknown, unknownKeys(child, t.Elem(), joinKeyPath(path, key))...)
+		}
+	case reflect.Slice:
+		list, ok := value.([]any)
+		if !ok {
+			return unknown
+		}
+
+		for i, child := range list {
+			unknown = append(unknown, unknownKeys(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Map the json keys of a struct's exported fields to the fields' indexes
+func jsonFields(t reflect.Type) map[string]int {
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+func joinKeyPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func validPort(port int) bool {
+	return port >= 0 && port <= 65535
+}
+
+// Check that the config can be used to run the server, returning
+// every problem found
+func (cfg *AppConfig) Validate() error {
+	errs := []error{}
+
+	ports := map[string]int{
+		"dns_server_port":    cfg.DnsServerPort,
+		"dns_over_http_port": cfg.DnsOverHttpPort,
+		"dns_over_tls_port":  cfg.DnsOverTlsPort,
+	}
+	for name, port := range ports {
+		if !validPort(port) {
+			errs = append(errs, fmt.Errorf("'%s' %d is not a valid port", name, port))
+		}
+	}
+
+	if cfg.DnsOverTlsEnable {
+		if cfg.DnsOverTlsCertFile == "" || cfg.DnsOverTlsKeyFile == "" {
+			errs = append(errs, fmt.Errorf("'dns_over_tls_cert_file' and 'dns_over_tls_key_file' are required when dns over tls is enabled"))
+		} else if _, err := tls.LoadX509KeyPair(cfg.DnsOverTlsCertFile, cfg.DnsOverTlsKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("failed to load the dns over tls certificate: %w", err))
+		}
+	}
+
+	if cfg.AdminApiEnable {
+		if cfg.AdminApiToken == "" {
+			errs = append(errs, fmt.Errorf("'admin_api_token' is required when the admin api is enabled"))
+		}
+		if _, port, err := net.SplitHostPort(cfg.AdminApiAddress); err != nil {
+			errs = append(errs, fmt.Errorf("'admin_api_address' '%s' is not a valid address: %w", cfg.AdminApiAddress, err))
+		} else if number, err := strconv.Atoi(port); err != nil || !validPort(number) {
+			errs = append(errs, fmt.Errorf("'admin_api_address' '%s' does not have a valid port", cfg.AdminApiAddress))
+		}
+	}
+
+	nonNegative := map[string]int{
+		"predictive_threshold":       cfg.PredictiveThreshold,
+		"serve_stale_max_age":        cfg.ServeStaleMaxAge,
+		"serve_stale_ttl":            cfg.ServeStaleTtl,
+		"negative_cache_max_ttl":     cfg.NegativeCacheMaxTtl,
+		"cache_max_entries":          cfg.CacheMaxEntries,
+		"cache_max_bytes":            cfg.CacheMaxBytes,
+		"cache_sweep_interval":       cfg.CacheSweepInterval,
+		"upstream_failure_threshold": cfg.UpstreamFailureThreshold,
+		"upstream_probe_interval":    cfg.UpstreamProbeInterval,
+	}
+	for name, value := range nonNegative {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("'%s' must not be negative", name))
+		}
+	}
+
+	// Down upstreams are only marked up again by probing them
+	if cfg.UpstreamFailureThreshold > 0 && cfg.UpstreamProbeInterval == 0 {
+		errs = append(errs, fmt.Errorf("'upstream_probe_interval' must be set while 'upstream_failure_threshold' is, or a down upstream never recovers"))
+	}
+
+	for i, upstream := range cfg.UpstreamResolvers {
+		if err := resolver.ValidateUpstream(upstream); err != nil {
+			errs = append(errs, fmt.Errorf("'upstream_resolvers[%d]': %w", i, err))
+		}
+	}
+
+	for domain, upstreams := range cfg.ConditionalForwards {
+		for i, upstream := range upstreams {
+			if err := resolver.ValidateUpstream(upstream); err != nil {
+				errs = append(errs, fmt.Errorf("'conditional_forwards.%s[%d]': %w", domain, i, err))
+			}
+		}
+	}
+
+	for key, acl := range cfg.ACLs {
+		for i, upstream := range acl.UpstreamResolvers {
+			if err := resolver.ValidateUpstream(upstream); err != nil {
+				errs = append(errs, fmt.Errorf("'acls.%s.upstream_resolvers[%d]': %w", key, i, err))
+			}
+		}
+	}
+
+	if !resolver.IsValidStrategy(cfg.UpstreamStrategy) {
+		errs = append(errs, fmt.Errorf("'upstream_strategy' '%s' is not a known strategy", cfg.UpstreamStrategy))
+	}
+
+	for domain, strategy := range cfg.ConditionalForwardStrategies {
+		if !resolver.IsValidStrategy(strategy) {
+			errs = append(errs, fmt.Errorf("'conditional_forward_strategies.%s' '%s' is not a known strategy", domain, strategy))
+		}
+		if _, ok := cfg.ConditionalForwards[domain]; !ok {
+			errs = append(errs, fmt.Errorf("'conditional_forward_strategies.%s' has no matching conditional forward", domain))
+		}
+	}
+
+	if !blocklist.IsValidResponse(cfg.BlocklistResponse) {
+		errs = append(errs, fmt.Errorf("'blocklist_response' '%s' is not null, nxdomain or refused", cfg.BlocklistResponse))
+	}
+
+	for key, acl := range cfg.ACLs {
+		if !blocklist.IsValidResponse(acl.BlocklistResponse) {
+			errs = append(errs, fmt.Errorf("'acls.%s.blocklist_response' '%s' is not null, nxdomain or refused", key, acl.BlocklistResponse))
+		}
+	}
+
+	for name, path := range cfg.Blocklists {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("'blocklists.%s': %w", name, err))
+		}
+	}
+
+	for i, path := range cfg.Allowlists {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("'allowlists[%d]': %w", i, err))
+		}
+	}
+
+	rpzNames := map[string]bool{}
+	for i, zone := range cfg.RpzZones {
+		if zone.Name == "" {
+			errs = append(errs, fmt.Errorf("'rpz_zones[%d].name' is required", i))
+		} else if rpzNames[zone.Name] {
+			errs = append(errs, fmt.Errorf("'rpz_zones[%d].name' '%s' is used by another zone", i, zone.Name))
+		}
+		rpzNames[zone.Name] = true
+
+		if _, err := os.Stat(zone.File); err != nil {
+			errs = append(errs, fmt.Errorf("'rpz_zones[%d].file': %w", i, err))
+		}
+		if _, ok := dns.IsDomainName(zone.Origin); zone.Origin != "" && !ok {
+			errs = append(errs, fmt.Errorf("'rpz_zones[%d].origin' '%s' is not a valid domain", i, zone.Origin))
+		}
+	}
+
+	localOrigins := map[string]bool{}
+	for i, zone := range cfg.LocalZones {
+		origin := strings.ToLower(dns.Fqdn(zone.Origin))
+		if zone.Origin == "" {
+			errs = append(errs, fmt.Errorf("'local_zones[%d].origin' is required", i))
+		} else if _, ok := dns.IsDomainName(zone.Origin); !ok {
+			errs = append(errs, fmt.Errorf("'local_zones[%d].origin' '%s' is not a valid domain", i, zone.Origin))
+		} else if localOrigins[origin] {
+			errs = append(errs, fmt.Errorf("'local_zones[%d].origin' '%s' is used by another zone", i, zone.Origin))
+		}
+		localOrigins[origin] = true
+
+		if _, err := os.Stat(zone.File); err != nil {
+			errs = append(errs, fmt.Errorf("'local_zones[%d].file': %w", i, err))
+		}
+	}
+
+	if !cache.IsValidEvictionPolicy(cfg.CacheEvictionPolicy) {
+		errs = append(errs, fmt.Errorf("'cache_eviction_policy' '%s' is not lru or lfu", cfg.CacheEvictionPolicy))
+	}
+
+	// Map iteration makes the order vary between runs otherwise
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return errors.Join(errs...)
+}
+
+// Describe the deprecated settings the config uses, which still work
+// but should be replaced
+func (cfg *AppConfig) Deprecations() []string {
+	deprecations := []string{}
+
+	if cfg.SharedSecret != nil {
+		deprecations = append(deprecations, "'shared_secret' is deprecated and ignored, remove it")
+	}
+
+	for key, acl := range cfg.ACLs {
+		if acl.UseCpeId != "" {
+			deprecations = append(deprecations, fmt.Sprintf("'acls.%s.use_cpe_id' is deprecated, use 'add_cpe_id' instead", key))
+		}
+	}
+
+	sort.Strings(deprecations)
+	return deprecations
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTestConfig(t *testing.T, data string) (*AppConfig, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "spuddns.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	return ReadConfig(path)
+}
+
+func expectConfigErrors(t *testing.T, err error, expected ...string) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("expected config errors mentioning %v", expected)
+	}
+
+	for _, text := range expected {
+		if !strings.Contains(err.Error(), text) {
+			t.Errorf("expected an error mentioning %s, got: %v", text, err)
+		}
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	if _, err := ReadConfig("../spuddns.example.json"); err != nil {
+		t.Errorf("example config is invalid: %v", err)
+	}
+}
+
+func TestReadConfigRejectsUnknownKeys(t *testing.T) {
+	_, err := readTestConfig(t, `{
+		"upstream_resolver": ["1.1.1.1"],
+		"acls": {"example": {"add_cpe": "abc123"}}
+	}`)
+
+	expectConfigErrors(t, err, "'upstream_resolver'", "'acls.example.add_cpe'")
+}
+
+func TestReadConfigDescribesInvalidValues(t *testing.T) {
+	_, err := readTestConfig(t, `{"acls": {"example": {"forward_cpe_id": "yes"}}}`)
+	expectConfigErrors(t, err, "acls.example.forward_cpe_id", "true or false")
+
+	_, err = readTestConfig(t, "{\n\t\"dns_server_port\": 53,\n}")
+	expectConfigErrors(t, err, "line 3")
+}
+
+func TestAclAddCpeIdIsRead(t *testing.T) {
+	config, err := readTestConfig(t, `{"acls": {"example": {"add_cpe_id": "abc123"}}}`)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if config.ACLs["example"].AddCpeId != "abc123" {
+		t.Errorf("add_cpe_id was not read, got '%s'", config.ACLs["example"].AddCpeId)
+	}
+}
+
+func TestAclUseCpeIdIsADeprecatedAlias(t *testing.T) {
+	config, err := readTestConfig(t, `{"acls": {"example": {"use_cpe_id": "abc123"}}}`)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if config.ACLs["example"].AddCpeId != "abc123" {
+		t.Errorf("use_cpe_id was not used as add_cpe_id, got '%s'", config.ACLs["example"].AddCpeId)
+	}
+	if deprecations := config.Deprecations(); len(deprecations) != 1 || !strings.Contains(deprecations[0], "acls.example.use_cpe_id") {
+		t.Errorf("expected use_cpe_id to be reported as deprecated, got %v", deprecations)
+	}
+
+	_, err = readTestConfig(t, `{"acls": {"example": {"use_cpe_id": "abc123", "add_cpe_id": "def456"}}}`)
+	expectConfigErrors(t, err, "'acls.example.use_cpe_id' conflicts")
+}
+
+func TestSharedSecretIsDeprecatedAndIgnored(t *testing.T) {
+	config, err := readTestConfig(t, `{"shared_secret": ""}`)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+
+	if deprecations := config.Deprecations(); len(deprecations) != 1 || !strings.Contains(deprecations[0], "'shared_secret'") {
+		t.Errorf("expected shared_secret to be reported as deprecated, got %v", deprecations)
+	}
+}
+
+func TestPrepareRejectsInvalidDoNotCache(t *testing.T) {
+	appConfig := GetDefaultConfig()
+	appConfig.DoNotCache = []string{"", "*", "*.", "10.0.0.0/99", "*.example.com"}
+
+	expectConfigErrors(
+		t,
+		appConfig.prepare(),
+		"'do_not_cache[0]'",
+		"'do_not_cache[1]'",
+		"'do_not_cache[2]'",
+		"'do_not_cache[3]' '10.0.0.0/99'",
+	)
+
+	if appConfig.skip_cache_regex == nil || !appConfig.skip_cache_regex.MatchString("www.example.com.") {
+		t.Errorf("valid do_not_cache entries should still be used")
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	_, err := readTestConfig(t, `{
+		"dns_server_port": 70000,
+		"dns_over_tls_enable": true,
+		"cache_max_entries": -1,
+		"upstream_resolvers": ["1.1.1.1", "dns.example"],
+		"conditional_forwards": {"example.com": ["tls://"]},
+		"conditional_forward_strategies": {"example.org": "parallel"},
+		"cache_eviction_policy": "random"
+	}`)
+
+	expectConfigErrors(
+		t,
+		err,
+		"'dns_server_port' 70000",
+		"'dns_over_tls_cert_file'",
+		"'cache_max_entries'",
+		"'upstream_resolvers[1]'",
+		"'conditional_forwards.example.com[0]'",
+		"'conditional_forward_strategies.example.org'",
+		"'cache_eviction_policy'",
+	)
+}
+
+func TestValidateAdminApi(t *testing.T) {
+	_, err := readTestConfig(t, `{"admin_api_enable": true, "admin_api_address": "localhost"}`)
+	expectConfigErrors(t, err, "'admin_api_token' is required", "'admin_api_address' 'localhost'")
+
+	if _, err := readTestConfig(t, `{"admin_api_enable": true, "admin_api_token": "secret"}`); err != nil {
+		t.Errorf("unexpected error for a valid admin api config: %v", err)
+	}
+}
+
+func TestValidateUpstreamProbing(t *testing.T) {
+	_, err := readTestConfig(t, `{"upstream_probe_interval": 0}`)
+	expectConfigErrors(t, err, "'upstream_probe_interval' must be set while 'upstream_failure_threshold' is")
+
+	if _, err := readTestConfig(t, `{"upstream_probe_interval": 0, "upstream_failure_threshold": 0}`); err != nil {
+		t.Errorf("unexpected error without upstream health tracking: %v", err)
+	}
+}
+
+func TestValidateBlocklists(t *testing.T) {
+	_, err := readTestConfig(t, `{"blocklists": {"ads": "/nonexistent/ads.txt"}, "allowlists": ["/nonexistent/allow.txt"], "blocklist_response": "drop", "acls": {"*": {"blocklist_response": "zero"}}}`)
+	expectConfigErrors(t, err, "'blocklists.ads'", "'allowlists[0]'", "'blocklist_response' 'drop'", "'acls.*.blocklist_response' 'zero'")
+}
+
+func TestValidateRpzZones(t *testing.T) {
+	_, err := readTestConfig(t, `{"rpz_zones": [{"file": "/nonexistent/policy.rpz"}, {"name": "a", "file": "../spuddns.example.json", "origin": "bad..origin"}, {"name": "a", "file": "../spuddns.example.json"}]}`)
+	expectConfigErrors(t, err, "'rpz_zones[0].name' is required", "'rpz_zones[0].file'", "'rpz_zones[1].origin'", "'rpz_zones[2].name' 'a' is used")
+}
+
+func TestValidateLocalZones(t *testing.T) {
+	_, err := readTestConfig(t, `{"local_zones": [{"file": "../spuddns.example.json"}, {"origin": "bad..origin", "file": "/nonexistent/home.zone"}, {"origin": "home.example", "file": "../spuddns.example.json"}, {"origin": "HOME.example.", "file": "../spuddns.example.json"}]}`)
+	expectConfigErrors(t, err, "'local_zones[0].origin' is required", "'local_zones[1].origin' 'bad..origin'", "'local_zones[1].file'", "'local_zones[3].origin' 'HOME.example.' is used")
+}
+
+func TestValidateLocalRecords(t *testing.T) {
+	_, err := readTestConfig(t, `{"local_records": [
+		{"name": "www.*.example", "type": "A", "values": ["192.0.2.1"]},
+		{"name": "nas.home.example", "type": "NS", "values": ["ns.example."]},
+		{"name": "nas.home.example", "type": "A", "values": []},
+		{"name": "nas.home.example", "type": "mx", "values": ["10 mail.home.example", "mail.home.example"]}
+	]}`)
+	expectConfigErrors(t, err, "'local_records[0].name' 'www.*.example'", "'local_records[1].type' 'NS'", "'local_records[2].values' is empty", "'local_records[3].values[1]' 'mail.home.example' is not valid")
+}
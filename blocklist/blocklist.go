@@ -0,0 +1,244 @@
+package blocklist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/thenaterhood/spuddns/filewatch"
+	"github.com/thenaterhood/spuddns/metrics"
+)
+
+type BlocklistConfig struct {
+	// Blocklist files, keyed by a name for the list that's used in
+	// logs and metrics
+	Lists map[string]string
+	// Files of names that are never blocked, in the same formats
+	Allowlists []string
+	Logger     *slog.Logger
+	Metrics    metrics.MetricsInterface
+}
+
+// The files the rules are read from
+type listFiles struct {
+	lists      map[string]string
+	allowlists []string
+}
+
+func (f listFiles) paths() []string {
+	return append(slices.Collect(maps.Values(f.lists)), f.allowlists...)
+}
+
+func (f listFiles) equal(other listFiles) bool {
+	return maps.Equal(f.lists, other.lists) && slices.Equal(f.allowlists, other.allowlists)
+}
+
+// The names blocked by a list (the index of the list, plus one, for
+// each way the name is matched, or zero if it isn't)
+type blockedName struct {
+	exact   uint16
+	subtree uint16
+}
+
+// The rules from every list
+type ruleSet struct {
+	listNames []string
+	blocked   map[string]blockedName
+	allowed   map[string]uint8
+	// Number of names blocked by each list that was read
+	entries map[string]int
+}
+
+// Match names against blocklists and allowlists. Lookups take time
+// proportional to the number of labels in the name, whatever the
+// number of entries in the lists.
+type Blocklist struct {
+	rules  *filewatch.Reloader[listFiles, ruleSet]
+	config BlocklistConfig
+}
+
+func NewBlocklist(config BlocklistConfig) *Blocklist {
+	blocklist := &Blocklist{config: config}
+	blocklist.rules = filewatch.NewReloader(listFiles{config.Lists, config.Allowlists}, filewatch.Source[listFiles, ruleSet]{
+		Name:   "blocklists",
+		Logger: config.Logger,
+		Files:  listFiles.paths,
+		Read:   blocklist.read,
+		Equal:  listFiles.equal,
+		Loaded: blocklist.exportEntries,
+	})
+
+	return blocklist
+}
+
+// Read every list, returning the rules from the ones that could be
+// read along with an error for the ones that couldn't
+func (b *Blocklist) read(files listFiles) (*ruleSet, error) {
+	rules := &ruleSet{
+		blocked: map[string]blockedName{},
+		allowed: map[string]uint8{},
+		entries: map[string]int{},
+	}
+
+	// Lists are numbered in order of name, so a name on several
+	// lists is always counted against the same one
+	rules.listNames = slices.Sorted(maps.Keys(files.lists))
+	if len(rules.listNames) >= 1<<16-1 {
+		return rules, fmt.Errorf("too many blocklists")
+	}
+
+	errs := []error{}
+
+	for i, listName := range rules.listNames {
+		path := files.lists[listName]
+		index := uint16(i + 1)
+		entries := 0
+
+		invalid, err := readFile(path, func(parsed rule) {
+			if parsed.allow {
+				rules.allowed[parsed.name] |= parsed.match
+				return
+			}
+
+			blocked := rules.blocked[parsed.name]
+			if parsed.match == matchExact && blocked.exact == 0 {
+				blocked.exact = index
+			}
+			if parsed.match == matchSubtree && blocked.subtree == 0 {
+				blocked.subtree = index
+			}
+			rules.blocked[parsed.name] = blocked
+			entries++
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("blocklist '%s': %w", listName, err))
+			continue
+		}
+
+		b.config.Logger.Info("read blocklist", "list", listName, "file", path, "entries", entries, "invalid_lines", invalid)
+		rules.entries[listName] = entries
+	}
+
+	for _, path := range files.allowlists {
+		invalid, err := readFile(path, func(parsed rule) {
+			rules.allowed[parsed.name] |= parsed.match
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("allowlist: %w", err))
+			continue
+		}
+
+		b.config.Logger.Info("read allowlist", "file", path, "invalid_lines", invalid)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// Export the number of entries in each list once its rules are in
+// use, removing lists that are no longer used
+func (b *Blocklist) exportEntries(previous *ruleSet, current *ruleSet) {
+	if previous != nil {
+		for listName := range previous.entries {
+			if _, ok := current.entries[listName]; !ok {
+				b.config.Metrics.DeleteBlocklistEntries(listName)
+			}
+		}
+	}
+
+	for listName, entries := range current.entries {
+		b.config.Metrics.SetBlocklistEntries(listName, entries)
+	}
+}
+
+func readFile(path string, add func(rule)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return parseList(file, add)
+}
+
+// Re-read the lists. If any can't be read, the rules already in use
+// are kept.
+func (b *Blocklist) Reload() error {
+	return b.rules.Reload()
+}
+
+// Replace the lists that are used, re-reading them if they changed
+func (b *Blocklist) Reconfigure(lists map[string]string, allowlists []string) error {
+	return b.rules.Reconfigure(listFiles{lists, allowlists})
+}
+
+// Reload the lists whenever their files change
+func (b *Blocklist) Watch() context.CancelFunc {
+	return b.rules.Watch()
+}
+
+// Get the list that blocks a name, if any. Names on an allowlist, or
+// allowed by an exception in any list, are never blocked.
+func (b *Blocklist) Match(name string) (string, bool) {
+	rules := b.rules.Get()
+	if rules == nil || len(rules.blocked) == 0 {
+		return "", false
+	}
+
+	name = strings.ToLower(name)
+	if name == "" || name[len(name)-1] != '.' {
+		name += "."
+	}
+
+	// The name itself, then each of its parent domains
+	var index uint16
+	for suffix, exact := name, true; ; exact = false {
+		if allowed := rules.allowed[suffix]; allowed&matchSubtree != 0 || (exact && allowed&matchExact != 0) {
+			return "", false
+		}
+
+		if index == 0 {
+			if blocked, ok := rules.blocked[suffix]; ok {
+				if exact && blocked.exact != 0 {
+					index = blocked.exact
+				} else if blocked.subtree != 0 {
+					index = blocked.subtree
+				}
+			}
+		}
+
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 || dot == len(suffix)-1 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+
+	if index == 0 {
+		return "", false
+	}
+
+	return rules.listNames[index-1], true
+}
+
+// Number of names blocked across every list
+func (b *Blocklist) Len() int {
+	rules := b.rules.Get()
+	if rules == nil {
+		return 0
+	}
+	return len(rules.blocked)
+}
+
+// Names of the lists, in the order they're matched
+func (b *Blocklist) Lists() []string {
+	rules := b.rules.Get()
+	if rules == nil {
+		return []string{}
+	}
+	return slices.Clone(rules.listNames)
+}
@@ -0,0 +1,239 @@
+package blocklist
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+	"github.com/thenaterhood/spuddns/metrics"
+)
+
+func writeTestList(t *testing.T, dir string, name string, lines ...string) string {
+	t.Helper()
+
+	return testfile.WriteIn(t, dir, name, strings.Join(lines, "\n")+"\n")
+}
+
+func getTestBlocklist(lists map[string]string, allowlists []string) *Blocklist {
+	return NewBlocklist(BlocklistConfig{
+		Lists:      lists,
+		Allowlists: allowlists,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:    metrics.DummyMetrics{},
+	})
+}
+
+func TestParseLine(t *testing.T) {
+	tests := map[string]struct {
+		rules []rule
+		ok    bool
+	}{
+		"# a comment":                                  {nil, true},
+		"! Title: adblock list":                        {nil, true},
+		"[Adblock Plus 2.0]":                           {nil, true},
+		"0.0.0.0 ads.example.com":                      {[]rule{{name: "ads.example.com.", match: matchExact}}, true},
+		"127.0.0.1\tA.example.com b.example.com # two": {[]rule{{name: "a.example.com.", match: matchExact}, {name: "b.example.com.", match: matchExact}}, true},
+		"127.0.0.1 localhost":                          {[]rule{}, true},
+		"tracker.example.com":                          {[]rule{{name: "tracker.example.com.", match: matchExact}}, true},
+		"*.tracker.example.com":                        {[]rule{{name: "tracker.example.com.", match: matchSubtree}}, true},
+		"||ads.example.org^":                           {[]rule{{name: "ads.example.org.", match: matchSubtree}}, true},
+		"@@||good.ads.example.org^":                    {[]rule{{name: "good.ads.example.org.", match: matchSubtree, allow: true}}, true},
+		"||ads.example.org^$third-party":               {nil, false},
+		"/banner/*/ad.gif":                             {nil, false},
+		"two words":                                    {nil, false},
+		"192.0.2.1":                                    {[]rule{}, true},
+	}
+
+	for line, expected := range tests {
+		rules, ok := parseLine(line)
+		if ok != expected.ok {
+			t.Errorf("%q: expected ok to be %v", line, expected.ok)
+			continue
+		}
+		if fmt.Sprint(rules) != fmt.Sprint(expected.rules) {
+			t.Errorf("%q: expected rules %v, got %v", line, expected.rules, rules)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := getTestBlocklist(map[string]string{
+		"hosts":   writeTestList(t, dir, "hosts", "0.0.0.0 ads.example.com", "0.0.0.0 tracker.example.net"),
+		"adblock": writeTestList(t, dir, "adblock", "||example.org^", "@@||allowed.example.org^"),
+		"domains": writeTestList(t, dir, "domains", "ads.example.com", "*.metrics.example.com"),
+	}, []string{
+		writeTestList(t, dir, "allow", "tracker.example.net"),
+	})
+
+	tests := map[string]string{
+		"ads.example.com.":         "domains",
+		"ADS.Example.com":          "domains",
+		"sub.ads.example.com.":     "",
+		"example.com.":             "",
+		"metrics.example.com.":     "domains",
+		"a.b.metrics.example.com.": "domains",
+		"example.org.":             "adblock",
+		"www.example.org.":         "adblock",
+		"allowed.example.org.":     "",
+		"www.allowed.example.org.": "",
+		"tracker.example.net.":     "",
+		"example.net.":             "",
+		".":                        "",
+	}
+
+	for name, expected := range tests {
+		list, blocked := blocklist.Match(name)
+		if blocked != (expected != "") || list != expected {
+			t.Errorf("%s: expected to be blocked by '%s', got '%s' (%v)", name, expected, list, blocked)
+		}
+	}
+
+	if blocklist.Len() != 4 {
+		t.Errorf("expected 4 blocked names, got %d", blocklist.Len())
+	}
+}
+
+func TestMatchLargeList(t *testing.T) {
+	lines := make([]string, 0, 100000)
+	for i := 0; i < cap(lines); i++ {
+		lines = append(lines, fmt.Sprintf("0.0.0.0 host%d.ads.example.com", i))
+	}
+	blocklist := getTestBlocklist(map[string]string{"large": writeTestList(t, t.TempDir(), "large", lines...)}, nil)
+
+	if blocklist.Len() != len(lines) {
+		t.Fatalf("expected %d names, got %d", len(lines), blocklist.Len())
+	}
+
+	if _, blocked := blocklist.Match("host99999.ads.example.com."); !blocked {
+		t.Errorf("expected the last name to be blocked")
+	}
+	if _, blocked := blocklist.Match("host100000.ads.example.com."); blocked {
+		t.Errorf("expected a name not on the list to be allowed")
+	}
+}
+
+func TestReloadKeepsRulesWhenListIsMissing(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestList(t, dir, "list", "ads.example.com")
+	blocklist := getTestBlocklist(map[string]string{"list": path}, nil)
+
+	writeTestList(t, dir, "list", "tracker.example.com")
+	if err := blocklist.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if _, blocked := blocklist.Match("tracker.example.com."); !blocked {
+		t.Errorf("expected the reloaded list to be used")
+	}
+	if _, blocked := blocklist.Match("ads.example.com."); blocked {
+		t.Errorf("expected the previous list to be replaced")
+	}
+
+	os.Remove(path)
+	if err := blocklist.Reload(); err == nil {
+		t.Errorf("expected an error reloading a missing list")
+	}
+	if _, blocked := blocklist.Match("tracker.example.com."); !blocked {
+		t.Errorf("expected the previous rules to be kept")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := getTestBlocklist(map[string]string{}, nil)
+
+	if _, blocked := blocklist.Match("ads.example.com."); blocked {
+		t.Errorf("expected nothing to be blocked without lists")
+	}
+
+	if err := blocklist.Reconfigure(map[string]string{"new": writeTestList(t, dir, "new", "ads.example.com")}, nil); err != nil {
+		t.Fatalf("unexpected error reconfiguring: %v", err)
+	}
+	if list, _ := blocklist.Match("ads.example.com."); list != "new" {
+		t.Errorf("expected the new list to be used, got '%s'", list)
+	}
+
+	if err := blocklist.Reconfigure(map[string]string{"missing": filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Errorf("expected an error for a missing list")
+	}
+	if list, _ := blocklist.Match("ads.example.com."); list != "new" {
+		t.Errorf("expected the previous list to be kept, got '%s'", list)
+	}
+}
+
+func TestBlockedResponse(t *testing.T) {
+	a := BlockedResponse(dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, ResponseNull)
+	if answers := a.AnswerRRs(); len(answers) != 1 || answers[0].(*dns.A).A.String() != "0.0.0.0" {
+		t.Errorf("expected a null A record, got %v", answers)
+	}
+
+	aaaa := BlockedResponse(dns.Question{Name: "ads.example.com.", Qtype: dns.TypeAAAA}, "")
+	if answers := aaaa.AnswerRRs(); len(answers) != 1 || answers[0].(*dns.AAAA).AAAA.String() != "::" {
+		t.Errorf("expected a null AAAA record, got %v", answers)
+	}
+
+	mx := BlockedResponse(dns.Question{Name: "ads.example.com.", Qtype: dns.TypeMX}, ResponseNull)
+	if !mx.IsSuccess() || !mx.IsEmpty() {
+		t.Errorf("expected no records for other types")
+	}
+
+	if rcode := BlockedResponse(dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, ResponseNxdomain).Rcode(); rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", dns.RcodeToString[rcode])
+	}
+
+	refused := BlockedResponse(dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, ResponseRefused)
+	if refused.Rcode() != dns.RcodeRefused || !refused.Blocked {
+		t.Errorf("expected a blocked REFUSED response")
+	}
+}
+
+// Records the blocklist entries gauge for each list
+type entriesMetrics struct {
+	metrics.DummyMetrics
+	entries map[string]int
+}
+
+func (m entriesMetrics) SetBlocklistEntries(list string, count int) {
+	m.entries[list] = count
+}
+
+func (m entriesMetrics) DeleteBlocklistEntries(list string) {
+	delete(m.entries, list)
+}
+
+func TestEntriesMetricFollowsRulesInUse(t *testing.T) {
+	dir := t.TempDir()
+	recorded := entriesMetrics{entries: map[string]int{}}
+	blocklist := NewBlocklist(BlocklistConfig{
+		Lists:   map[string]string{"ads": writeTestList(t, dir, "ads", "ads.example.com", "tracker.example.com")},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: recorded,
+	})
+
+	if len(recorded.entries) != 1 || recorded.entries["ads"] != 2 {
+		t.Errorf("expected the entries of the list, got %v", recorded.entries)
+	}
+
+	// Rules that aren't used aren't counted
+	renamed := map[string]string{"trackers": writeTestList(t, dir, "trackers", "tracker.example.com")}
+	missing := map[string]string{"trackers": renamed["trackers"], "missing": filepath.Join(dir, "missing")}
+	if err := blocklist.Reconfigure(missing, nil); err == nil {
+		t.Errorf("expected an error for a missing list")
+	}
+	if len(recorded.entries) != 1 || recorded.entries["ads"] != 2 {
+		t.Errorf("expected the entries of the list in use, got %v", recorded.entries)
+	}
+
+	if err := blocklist.Reconfigure(renamed, nil); err != nil {
+		t.Fatalf("unexpected error reconfiguring: %v", err)
+	}
+	if len(recorded.entries) != 1 || recorded.entries["trackers"] != 1 {
+		t.Errorf("expected only the renamed list's entries, got %v", recorded.entries)
+	}
+}
@@ -0,0 +1,170 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// How a rule matches names
+const (
+	// Only the name itself
+	matchExact uint8 = 1 << iota
+	// The name and every name under it
+	matchSubtree
+)
+
+// Names found in hosts files that refer to the local machine
+// rather than something to block
+var hostsLocalNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// A rule read from a list
+type rule struct {
+	name  string
+	match uint8
+	// The rule is an exception (Adblock Plus @@) rather than a block
+	allow bool
+}
+
+// Normalize a domain from a list, returning false if it isn't one
+func normalizeName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || strings.ContainsAny(name, "/:*?=&$|^@!") {
+		return "", false
+	}
+
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok || name == "." || net.ParseIP(strings.TrimSuffix(name, ".")) != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Parse an Adblock Plus rule. Only rules blocking whole domains
+// (||example.com^) and their exceptions (@@||example.com^) apply to
+// DNS, and rules with options are skipped since they can't be
+// applied to a DNS query.
+func parseAdblockRule(line string) (rule, bool) {
+	allow := false
+	if strings.HasPrefix(line, "@@") {
+		allow = true
+		line = line[2:]
+	}
+
+	domain, ok := strings.CutPrefix(line, "||")
+	if !ok {
+		return rule{}, false
+	}
+
+	domain, ok = strings.CutSuffix(strings.TrimSuffix(domain, "|"), "^")
+	if !ok {
+		return rule{}, false
+	}
+
+	name, ok := normalizeName(domain)
+	if !ok {
+		return rule{}, false
+	}
+
+	return rule{name: name, match: matchSubtree, allow: allow}, true
+}
+
+// Parse a line of a list in hosts (0.0.0.0 ads.example), domains
+// (ads.example, or *.ads.example for the domain and everything under
+// it) or Adblock Plus (||ads.example^) format. The format is detected
+// for each line, so lists may mix them.
+func parseLine(line string) ([]rule, bool) {
+	line = strings.TrimSpace(line)
+
+	// Comments, and Adblock Plus headers such as [Adblock Plus 2.0]
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, true
+	}
+
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") {
+		parsed, ok := parseAdblockRule(line)
+		if !ok {
+			return nil, false
+		}
+		return []rule{parsed}, true
+	}
+
+	if comment := strings.IndexByte(line, '#'); comment >= 0 {
+		line = line[:comment]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, true
+	}
+
+	if net.ParseIP(fields[0]) != nil {
+		rules := []rule{}
+		for _, field := range fields[1:] {
+			name, ok := normalizeName(field)
+			if !ok {
+				return nil, false
+			}
+			if !hostsLocalNames[name] {
+				rules = append(rules, rule{name: name, match: matchExact})
+			}
+		}
+		return rules, true
+	}
+
+	if len(fields) != 1 {
+		return nil, false
+	}
+
+	match := matchExact
+	domain := fields[0]
+	if wildcard, ok := strings.CutPrefix(domain, "*."); ok {
+		match = matchSubtree
+		domain = wildcard
+	}
+
+	name, ok := normalizeName(domain)
+	if !ok {
+		return nil, false
+	}
+
+	return []rule{{name: name, match: match}}, true
+}
+
+// Read the rules in a list, calling add for each one and returning
+// how many lines couldn't be understood
+func parseList(reader io.Reader, add func(rule)) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	invalid := 0
+
+	for scanner.Scan() {
+		rules, ok := parseLine(scanner.Text())
+		if !ok {
+			invalid++
+			continue
+		}
+
+		for _, parsed := range rules {
+			add(parsed)
+		}
+	}
+
+	return invalid, scanner.Err()
+}
@@ -0,0 +1,58 @@
+package blocklist
+
+import (
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// How blocked names are answered
+const (
+	// Answer A and AAAA queries with the unspecified address (0.0.0.0
+	// or ::) and other types with no records (the default)
+	ResponseNull = "null"
+	// Answer that the name doesn't exist
+	ResponseNxdomain = "nxdomain"
+	// Refuse to answer
+	ResponseRefused = "refused"
+)
+
+// TTL, in seconds, of blocked answers, kept short so unblocking a
+// name takes effect quickly
+const blockedTtl = 60
+
+func IsValidResponse(response string) bool {
+	return slices.Contains([]string{"", ResponseNull, ResponseNxdomain, ResponseRefused}, response)
+}
+
+// Get the answer to a blocked question
+func BlockedResponse(question dns.Question, response string) *models.DnsResponse {
+	var blocked *models.DnsResponse
+
+	switch response {
+	case ResponseNxdomain:
+		blocked = models.NewNXDomainDnsResponse()
+	case ResponseRefused:
+		blocked = models.NewRefusedDnsResponse()
+	default:
+		msg := new(dns.Msg)
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: blockedTtl}
+		switch question.Qtype {
+		case dns.TypeA:
+			msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+
+		var err error
+		blocked, err = models.NewDnsResponseFromMsg(msg)
+		if err != nil {
+			blocked = models.NewNoErrorDnsResponse()
+		}
+	}
+
+	blocked.Blocked = true
+	return blocked
+}
@@ -3,6 +3,8 @@ package cache
 import (
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,27 +18,159 @@ type CacheConfig struct {
 	Enable  bool
 	Logger  *slog.Logger
 	Metrics metrics.MetricsInterface
+	// How long entries are kept after they expire so they can be
+	// served stale (RFC 8767) if upstream resolution fails. Zero
+	// disables serving stale entries.
+	MaxStale time.Duration
+	// Maximum number of entries kept. Zero or less is unlimited.
+	MaxEntries int
+	// Maximum size, in bytes, of the stored entries. Zero or
+	// less is unlimited.
+	MaxBytes int
+	// Which entries are evicted when the cache is full
+	EvictionPolicy string
+	// How many parts the cache is split into, each with its own
+	// lock. Zero or less uses the default.
+	Shards int
+	// Whether the persisted cache is flushed to disk when it's
+	// written, so it survives a power loss
+	PersistSync bool
+	// Clock used to schedule the expire callback. If nil, the
+	// system clock is used.
+	Clock Clock
+}
+
+// Policies for choosing which entry is evicted from a full cache
+const (
+	// Evict the least recently used entry (the default)
+	EvictionLRU = "lru"
+	// Evict the least frequently used entry
+	EvictionLFU = "lfu"
+)
+
+func IsValidEvictionPolicy(policy string) bool {
+	return policy == "" || policy == EvictionLRU || policy == EvictionLFU
 }
 
 type Cache interface {
 	CacheDnsResponse(dns.Question, models.DnsResponse) error
 	SetExpireCallback(cb ExpireCallbackFn)
 	QueryDns(models.DnsQuery) (*models.DnsResponse, error)
+	// Get an expired entry that is still within the max stale
+	// window. Unexpired entries are returned as well.
+	QueryStale(models.DnsQuery) (*models.DnsResponse, error)
 	Persist(string) error
 	Load(string) error
+	// Remove entries that have expired (and are beyond the max
+	// stale window), returning how many were removed
+	Sweep() int
+	Stats() CacheStats
+	// Every entry in the cache, including expired entries that
+	// haven't been removed yet
+	Entries() []CacheEntryInfo
+	// Remove the entries (of any type) for a name, returning how
+	// many were removed
+	Delete(name string) int
+	// Remove the entries for a domain and every name under it,
+	// returning how many were removed. "." removes everything.
+	DeleteSuffix(suffix string) int
 }
 
+// An entry in the cache, as it's reported to administrators
+type CacheEntryInfo struct {
+	Question dns.Question
+	Response models.DnsResponse
+	Expires  time.Time
+	// How many times the entry has been used to answer a query
+	Hits     int
+	Resolver string
+}
+
+// A summary of the cache's contents and how it has been used
+type CacheStats struct {
+	Entries    int `json:"entries"`
+	Bytes      int `json:"bytes"`
+	MaxEntries int `json:"max_entries"`
+	MaxBytes   int `json:"max_bytes"`
+	// Queries answered from the cache, including stale answers
+	Hits      int `json:"hits"`
+	Misses    int `json:"misses"`
+	Evictions int `json:"evictions"`
+}
+
+// An entry as it's persisted to disk
 type cacheEntry struct {
-	Dns          []models.DNSAnswer
+	// The complete response in wire format. Negative answers keep
+	// their SOA in its authority section, so they need nothing more.
+	Msg          []byte
 	Expires      time.Time
 	RequestCount int
 	Resolver     string
+	// When the record TTLs in Msg were given. Each record's TTL
+	// counts down from then.
+	Received time.Time
+}
+
+// Get the response an entry holds, with its TTLs counted down
+func (entry cacheEntry) response() (*models.DnsResponse, error) {
+	response, err := models.NewDnsResponseFromBytes(entry.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	response.FromCache = true
+	response.Resolver = entry.Resolver
+	if entry.Received.IsZero() {
+		// Written before the time was kept
+		response.SetTtl(time.Until(entry.Expires))
+	} else {
+		response.CountDownFrom(entry.Received)
+	}
+	response.Expires = entry.Expires
+
+	return response, nil
 }
 
 func getDnsQuestionCacheKey(question dns.Question) string {
 	return fmt.Sprintf("%s::%d", question.Name, question.Qtype)
 }
 
+// Describe a stored entry, if it can be decoded
+func newCacheEntryInfo(key string, entry cacheEntry) (CacheEntryInfo, bool) {
+	question, ok := parseDnsQuestionCacheKey(key)
+	if !ok {
+		return CacheEntryInfo{}, false
+	}
+
+	response, err := entry.response()
+	if err != nil {
+		return CacheEntryInfo{}, false
+	}
+
+	return CacheEntryInfo{
+		Question: question,
+		Response: *response,
+		Expires:  entry.Expires,
+		Hits:     entry.RequestCount,
+		Resolver: entry.Resolver,
+	}, true
+}
+
+// Get the question a cache key was made from
+func parseDnsQuestionCacheKey(key string) (dns.Question, bool) {
+	name, qtype, ok := strings.Cut(key, "::")
+	if !ok {
+		return dns.Question{}, false
+	}
+
+	number, err := strconv.ParseUint(qtype, 10, 16)
+	if err != nil {
+		return dns.Question{}, false
+	}
+
+	return dns.Question{Name: name, Qtype: uint16(number), Qclass: dns.ClassINET}, true
+}
+
 func GetCache(config CacheConfig) (Cache, error) {
 	if config.Enable {
 		cache, err := getSpudcache(false, config)
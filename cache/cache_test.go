@@ -1,8 +1,12 @@
 package cache
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -211,8 +215,15 @@ func TestCacheDoesNotReturnMangledEntry(t *testing.T) {
 		t.Errorf("cache set errored: %s", err)
 	}
 
+	// Mangle the stored message, keeping the rest of the entry
 	raw_cache := activeSpudCache
-	raw_cache.set(getDnsQuestionCacheKey(question), []byte("asdf"))
+	key := getDnsQuestionCacheKey(question)
+	_, entry, err := raw_cache.get(key)
+	if err != nil {
+		t.Fatalf("expected the response to be cached: %v", err)
+	}
+	entry.Msg = []byte("asdf")
+	raw_cache.setEntry(key, entry)
 
 	if cache == nil {
 		t.Errorf("failed to get cache again")
@@ -264,3 +275,697 @@ func TestCacheEmptyDnsResponseDoesNotCrash(t *testing.T) {
 		t.Errorf("got a empty/invalid cache value")
 	}
 }
+
+func TestCacheServesStaleWithinWindow(t *testing.T) {
+	config := getCacheConfig()
+	config.MaxStale = time.Hour
+	cache, _ := getSpudcache(false, config)
+
+	question := dns.Question{
+		Name:   "example.com.",
+		Qtype:  1,
+		Qclass: 0,
+	}
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "example.com.",
+				Type: 1,
+				TTL:  0,
+				Data: "0.0.0.0",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	err = cache.CacheDnsResponse(question, *response)
+	if err != nil {
+		t.Errorf("cache set errored: %s", err)
+	}
+
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+	cachedValue, err := cache.QueryDns(*dnsQuery)
+	if err != nil {
+		t.Errorf("cache retrieve error: %s", err)
+	}
+
+	if cachedValue != nil {
+		t.Errorf("expired value should not be returned for a normal query")
+	}
+
+	staleValue, err := cache.QueryStale(*dnsQuery)
+	if err != nil {
+		t.Errorf("stale cache retrieve error: %s", err)
+	}
+
+	if staleValue == nil {
+		t.Fatalf("expired value within the max stale window should be returned for a stale query")
+	}
+
+	if !staleValue.FromCache {
+		t.Errorf("stale value should be marked as from the cache")
+	}
+}
+
+func TestCacheDoesNotServeStaleWhenDisabled(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	question := dns.Question{
+		Name:   "example.com.",
+		Qtype:  1,
+		Qclass: 0,
+	}
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "example.com.",
+				Type: 1,
+				TTL:  0,
+				Data: "0.0.0.0",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	err = cache.CacheDnsResponse(question, *response)
+	if err != nil {
+		t.Errorf("cache set errored: %s", err)
+	}
+
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+	staleValue, err := cache.QueryStale(*dnsQuery)
+	if err != nil {
+		t.Errorf("stale cache retrieve error: %s", err)
+	}
+
+	if staleValue != nil {
+		t.Errorf("expired value should not be returned when serving stale is disabled")
+	}
+}
+
+func TestCacheNegativeResponse(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	question := dns.Question{
+		Name:   "missing.example.com.",
+		Qtype:  dns.TypeAAAA,
+		Qclass: dns.ClassINET,
+	}
+
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60")
+	response, err := models.NewNegativeDnsResponse(dns.RcodeNameError, soa)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	err = cache.CacheDnsResponse(question, *response)
+	if err != nil {
+		t.Errorf("cache set errored: %s", err)
+	}
+
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+	cachedValue, err := cache.QueryDns(*dnsQuery)
+	if err != nil {
+		t.Errorf("cache retrieve error: %s", err)
+	}
+
+	if cachedValue == nil {
+		t.Fatalf("negative response was not cached")
+	}
+
+	if cachedValue.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected cached NXDOMAIN, got rcode %d", cachedValue.Rcode())
+	}
+
+	if cachedValue.Soa() == nil || cachedValue.Soa().Minttl != 60 {
+		t.Errorf("cached negative response lost its SOA: %v", cachedValue.Soa())
+	}
+}
+
+func TestCacheKeepsCompleteMessage(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	records := []string{
+		`_sip._tcp.example.com. 300 IN SRV 10 60 5060 sip.example.com.`,
+		`example.com. 300 IN SOA ns.example.com. admin.example.com. 2024010101 7200 3600 1209600 300`,
+		`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+		`example.com. 300 IN SVCB 1 svc.example.com. alpn="h2,h3" port="8443"`,
+		`example.com. 300 IN HTTPS 1 . alpn="h2" ipv4hint="192.0.2.1" ech="AEj+DQBEAQAgACAdd+scUi0IYFsXnUIU7ko2Nd9+F8M26pAGZVpz/KrWPgAEAAEAAWQVZWNoLXNpdGVzLmV4YW1wbGUubmV0AAA="`,
+		`example.com. 300 IN NAPTR 100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`,
+		`example.com. 300 IN DS 12345 13 2 2BB183AF5F22588179A53B0A98631FAD1A292118A1F3C8C1F0B48A2E9C1E2D4C`,
+		`example.com. 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==`,
+		`example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. oJB1W6WNGv+ldvQ3WDG0MQkg5IEhjRip8WTrPYGv07h108dUKGMeDPKijVCHX3DDKdfb+v6oB9wfuh3DTJXUAfI=`,
+		`example.com. 300 IN TXT "v=spf1 include:example.net ~all" "two  spaces"`,
+	}
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", record, err)
+		}
+
+		question := dns.Question{
+			Name:   rr.Header().Name,
+			Qtype:  rr.Header().Rrtype,
+			Qclass: dns.ClassINET,
+		}
+
+		msg := new(dns.Msg)
+		msg.Answer = []dns.RR{rr}
+		msg.Extra = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "sip.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   []byte{192, 0, 2, 10},
+		}}
+
+		response, err := models.NewDnsResponseFromMsg(msg)
+		if err != nil {
+			t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+		}
+
+		err = cache.CacheDnsResponse(question, *response)
+		if err != nil {
+			t.Errorf("cache set errored for %s: %s", record, err)
+		}
+
+		dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+		cachedValue, err := cache.QueryDns(*dnsQuery)
+		if err != nil {
+			t.Errorf("cache retrieve error for %s: %s", record, err)
+		}
+
+		if cachedValue == nil {
+			t.Fatalf("failed to get cached value for %s", record)
+		}
+
+		reply := cachedValue.AsReplyToMsg(dnsQuery.PreparedMsg())
+		if len(reply.Answer) != 1 {
+			t.Fatalf("expected 1 answer for %s, got %d", record, len(reply.Answer))
+		}
+
+		// TTLs count down while cached, so only the data is compared
+		reply.Answer[0].Header().Ttl = rr.Header().Ttl
+		if reply.Answer[0].String() != rr.String() {
+			t.Errorf("record did not survive the cache\n  want %s\n  got  %s", rr, reply.Answer[0])
+		}
+
+		if len(reply.Extra) != 1 {
+			t.Errorf("additional section did not survive the cache for %s: %v", record, reply.Extra)
+		}
+	}
+}
+
+func TestCacheDecrementsTtlOnRead(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	question := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "example.com.",
+				Type: dns.TypeA,
+				TTL:  300 * time.Second,
+				Data: "192.0.2.1",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	cache.CacheDnsResponse(question, *response)
+	backdateTestEntry(t, question, 280*time.Second)
+
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+	cachedValue, _ := cache.QueryDns(*dnsQuery)
+	if cachedValue == nil {
+		t.Fatalf("failed to get cached value")
+	}
+
+	ttl := cachedValue.AnswerRRs()[0].Header().Ttl
+	if ttl > 20 || ttl < 19 {
+		t.Errorf("cached ttl should have counted down to 20, got %d", ttl)
+	}
+}
+
+func TestCacheKeepsTtlOfEachRecord(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	question := dns.Question{
+		Name:   "www.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	msg := new(dns.Msg)
+	for _, record := range []string{
+		"www.example.com. 3600 IN CNAME web.example.com.",
+		"web.example.com. 60 IN A 192.0.2.1",
+		"web.example.com. 120 IN A 192.0.2.2",
+	} {
+		rr, _ := dns.NewRR(record)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	ns, _ := dns.NewRR("example.com. 86400 IN NS ns.example.com.")
+	glue, _ := dns.NewRR("ns.example.com. 7200 IN A 192.0.2.53")
+	msg.Ns = []dns.RR{ns}
+	msg.Extra = []dns.RR{glue}
+
+	response, err := models.NewDnsResponseFromMsg(msg)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+	cache.CacheDnsResponse(question, *response)
+
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+	ttls := func() []uint32 {
+		cachedValue, _ := cache.QueryDns(*dnsQuery)
+		if cachedValue == nil {
+			t.Fatalf("failed to get cached value")
+		}
+		reply := cachedValue.AsReplyToMsg(dnsQuery.PreparedMsg())
+		ttls := []uint32{}
+		for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+			for _, rr := range section {
+				ttls = append(ttls, rr.Header().Ttl)
+			}
+		}
+		return ttls
+	}
+
+	if got := ttls(); !slices.Equal(got, []uint32{3600, 60, 120, 86400, 7200}) {
+		t.Errorf("expected every record to keep its TTL, got %v", got)
+	}
+
+	backdateTestEntry(t, question, 30*time.Second)
+	if got := ttls(); !slices.Equal(got, []uint32{3570, 30, 90, 86370, 7170}) {
+		t.Errorf("expected every TTL to count down by 30 seconds, got %v", got)
+	}
+}
+
+// Make a cached entry look like it was stored age ago
+func backdateTestEntry(t *testing.T, question dns.Question, age time.Duration) {
+	t.Helper()
+
+	key := getDnsQuestionCacheKey(question)
+	_, entry, err := activeSpudCache.get(key)
+	if err != nil {
+		t.Fatalf("expected the response to be cached: %v", err)
+	}
+	entry.Received = entry.Received.Add(-age)
+	entry.Expires = entry.Expires.Add(-age)
+	activeSpudCache.setEntry(key, entry)
+}
+
+func cacheTestEntry(t *testing.T, c Cache, name string, ttl time.Duration) dns.Question {
+	question := dns.Question{
+		Name:   name,
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: name,
+				Type: dns.TypeA,
+				TTL:  ttl,
+				Data: "192.0.2.1",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	if err := c.CacheDnsResponse(question, *response); err != nil {
+		t.Fatalf("cache set errored: %s", err)
+	}
+
+	return question
+}
+
+func isCachedTest(c Cache, question dns.Question) bool {
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+	cachedValue, _ := c.QueryDns(*dnsQuery)
+	return cachedValue != nil
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	config := getCacheConfig()
+	config.MaxEntries = 2
+	config.EvictionPolicy = EvictionLRU
+	cache, _ := getSpudcache(false, config)
+
+	first := cacheTestEntry(t, cache, "first.example.com.", 300*time.Second)
+	second := cacheTestEntry(t, cache, "second.example.com.", 300*time.Second)
+
+	// Using the first entry makes the second the least recently used
+	isCachedTest(cache, first)
+
+	third := cacheTestEntry(t, cache, "third.example.com.", 300*time.Second)
+
+	if !isCachedTest(cache, first) {
+		t.Errorf("recently used entry was evicted")
+	}
+	if isCachedTest(cache, second) {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if !isCachedTest(cache, third) {
+		t.Errorf("new entry was evicted")
+	}
+}
+
+func TestCacheEvictsLeastFrequentlyUsed(t *testing.T) {
+	config := getCacheConfig()
+	config.MaxEntries = 2
+	config.EvictionPolicy = EvictionLFU
+	cache, _ := getSpudcache(false, config)
+
+	first := cacheTestEntry(t, cache, "first.example.com.", 300*time.Second)
+	second := cacheTestEntry(t, cache, "second.example.com.", 300*time.Second)
+
+	for i := 0; i < 3; i++ {
+		isCachedTest(cache, first)
+	}
+	// The second entry is more recently used, but less often
+	isCachedTest(cache, second)
+
+	third := cacheTestEntry(t, cache, "third.example.com.", 300*time.Second)
+
+	if !isCachedTest(cache, first) {
+		t.Errorf("frequently used entry was evicted")
+	}
+	if isCachedTest(cache, second) {
+		t.Errorf("least frequently used entry was not evicted")
+	}
+	if !isCachedTest(cache, third) {
+		t.Errorf("new entry was evicted")
+	}
+}
+
+func TestCacheEvictsToMaxBytes(t *testing.T) {
+	config := getCacheConfig()
+	cache, _ := getSpudcache(false, config)
+
+	cacheTestEntry(t, cache, "first.example.com.", 300*time.Second)
+	entrySize := int(activeSpudCache.bytes.Load())
+
+	activeSpudCache.config.MaxBytes = entrySize * 3
+
+	for i := 0; i < 10; i++ {
+		cacheTestEntry(t, cache, fmt.Sprintf("%d.example.com.", i), 300*time.Second)
+	}
+
+	if int(activeSpudCache.bytes.Load()) > entrySize*3 {
+		t.Errorf("cache is %d bytes, should be at most %d", activeSpudCache.bytes.Load(), entrySize*3)
+	}
+
+	if activeSpudCache.len() < 2 {
+		t.Errorf("cache evicted more than needed, %d entries left", activeSpudCache.len())
+	}
+}
+
+func TestCacheSweepRemovesExpiredEntries(t *testing.T) {
+	config := getCacheConfig()
+	config.MaxStale = time.Second
+	cache, _ := getSpudcache(false, config)
+
+	cacheTestEntry(t, cache, "expired.example.com.", 0)
+	current := cacheTestEntry(t, cache, "current.example.com.", 300*time.Second)
+
+	if removed := cache.Sweep(); removed != 0 {
+		t.Errorf("entries within the stale window should not be swept, %d were", removed)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if removed := cache.Sweep(); removed != 1 {
+		t.Errorf("expected 1 expired entry to be swept, %d were", removed)
+	}
+
+	if activeSpudCache.len() != 1 || !isCachedTest(cache, current) {
+		t.Errorf("unexpired entry should have been kept")
+	}
+}
+
+func TestCachePersistAndLoad(t *testing.T) {
+	config := getCacheConfig()
+	cache, _ := getSpudcache(false, config)
+
+	question := cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+	isCachedTest(cache, question)
+	isCachedTest(cache, question)
+
+	path := t.TempDir() + "/cache.json"
+	if err := cache.Persist(path); err != nil {
+		t.Fatalf("persisting the cache errored: %v", err)
+	}
+
+	loaded, _ := getSpudcache(false, config)
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("loading the cache errored: %v", err)
+	}
+
+	if !isCachedTest(loaded, question) {
+		t.Errorf("entry was not loaded from the persisted cache")
+	}
+
+	if count := activeSpudCache.requestCount(getDnsQuestionCacheKey(question)); count != 3 {
+		t.Errorf("expected the request count to be kept, got %d", count)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	question := cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+	isCachedTest(cache, question)
+
+	entries := cache.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Question.Name != "example.com." || entry.Question.Qtype != dns.TypeA {
+		t.Errorf("unexpected question %v", entry.Question)
+	}
+	if entry.Hits != 1 {
+		t.Errorf("expected 1 hit, got %d", entry.Hits)
+	}
+	if ttl := time.Until(entry.Expires); ttl <= 50*time.Second || ttl > 60*time.Second {
+		t.Errorf("unexpected time remaining %v", ttl)
+	}
+	if len(entry.Response.AnswerRRs()) != 1 {
+		t.Errorf("expected the cached answer, got %v", entry.Response.AnswerRRs())
+	}
+}
+
+func TestCacheDelete(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+
+	example := cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+	www := cacheTestEntry(t, cache, "www.example.com.", 60*time.Second)
+	other := cacheTestEntry(t, cache, "example.org.", 60*time.Second)
+
+	if removed := cache.Delete("EXAMPLE.com"); removed != 1 {
+		t.Errorf("expected 1 entry to be removed, got %d", removed)
+	}
+	if isCachedTest(cache, example) || !isCachedTest(cache, www) {
+		t.Errorf("only the named entry should have been removed")
+	}
+
+	example = cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+	if removed := cache.DeleteSuffix("example.com."); removed != 2 {
+		t.Errorf("expected 2 entries to be removed, got %d", removed)
+	}
+	if isCachedTest(cache, example) || isCachedTest(cache, www) || !isCachedTest(cache, other) {
+		t.Errorf("only entries under the suffix should have been removed")
+	}
+
+	if removed := cache.DeleteSuffix("."); removed != 1 {
+		t.Errorf("expected every entry to be removed, got %d", removed)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("expected the cache to be empty, got %+v", stats)
+	}
+}
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	config := getCacheConfig()
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	config.MaxEntries = 50
+	config.Shards = 4
+	cache, _ := getSpudcache(false, config)
+	path := t.TempDir() + "/cache.json"
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "example.com.",
+				Type: dns.TypeA,
+				TTL:  300 * time.Second,
+				Data: "192.0.2.1",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				question := dns.Question{
+					Name:   fmt.Sprintf("%d.%d.example.com.", worker, i%80),
+					Qtype:  dns.TypeA,
+					Qclass: dns.ClassINET,
+				}
+				if err := cache.CacheDnsResponse(question, *response); err != nil {
+					t.Errorf("cache set errored: %s", err)
+				}
+				isCachedTest(cache, question)
+
+				switch i % 50 {
+				case 0:
+					cache.Sweep()
+				case 25:
+					cache.Persist(path)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored := 0
+	for _, shard := range activeSpudCache.shards {
+		stored += len(shard.items)
+	}
+
+	if stored != activeSpudCache.len() {
+		t.Errorf("cache counts %d entries, but holds %d", activeSpudCache.len(), stored)
+	}
+
+	if stored > config.MaxEntries {
+		t.Errorf("cache holds %d entries, should be at most %d", stored, config.MaxEntries)
+	}
+}
+
+func getBenchmarkCache(b *testing.B) (Cache, models.DnsQuery) {
+	config := getCacheConfig()
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	cache, _ := getSpudcache(false, config)
+
+	question := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	response, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "example.com.",
+				Type: dns.TypeA,
+				TTL:  300 * time.Second,
+				Data: "192.0.2.1",
+			},
+			{
+				Name: "example.com.",
+				Type: dns.TypeA,
+				TTL:  300 * time.Second,
+				Data: "192.0.2.2",
+			},
+		},
+	)
+	if err != nil {
+		b.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	cache.CacheDnsResponse(question, *response)
+	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+
+	return cache, *dnsQuery
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	cache, dnsQuery := getBenchmarkCache(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if response, _ := cache.QueryDns(dnsQuery); response == nil {
+			b.Fatal("expected a cache hit")
+		}
+	}
+}
+
+func BenchmarkCacheHitParallel(b *testing.B) {
+	cache, dnsQuery := getBenchmarkCache(b)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if response, _ := cache.QueryDns(dnsQuery); response == nil {
+				b.Fatal("expected a cache hit")
+			}
+		}
+	})
+}
+
+func BenchmarkCacheSet(b *testing.B) {
+	cache, dnsQuery := getBenchmarkCache(b)
+	response, _ := cache.QueryDns(dnsQuery)
+	response.FromCache = false
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		question := *dnsQuery.FirstQuestion()
+		question.Name = fmt.Sprintf("%d.example.com.", i%1000)
+		cache.CacheDnsResponse(question, *response)
+	}
+}
+
+func BenchmarkCacheHitParallelManyNames(b *testing.B) {
+	cache, dnsQuery := getBenchmarkCache(b)
+	response, _ := cache.QueryDns(dnsQuery)
+	response.FromCache = false
+
+	queries := make([]models.DnsQuery, 1000)
+	for i := range queries {
+		question := *dnsQuery.FirstQuestion()
+		question.Name = fmt.Sprintf("%d.example.com.", i)
+		cache.CacheDnsResponse(question, *response)
+
+		query, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+		queries[i] = *query
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.QueryDns(queries[i%len(queries)])
+			cache.CacheDnsResponse(*queries[(i+500)%len(queries)].FirstQuestion(), *response)
+			i++
+		}
+	})
+}
@@ -11,5 +11,11 @@ func (c *DummyCache) CacheDnsResponse(dns.Question, models.DnsResponse) error  {
 func (c *DummyCache) GetDnsResponse(dns.Question) (*models.DnsResponse, error) { return nil, nil }
 func (c *DummyCache) SetExpireCallback(ExpireCallbackFn)                       {}
 func (c *DummyCache) QueryDns(models.DnsQuery) (*models.DnsResponse, error)    { return nil, nil }
+func (c *DummyCache) QueryStale(models.DnsQuery) (*models.DnsResponse, error)  { return nil, nil }
 func (c *DummyCache) Persist(string) error                                     { return nil }
 func (c *DummyCache) Load(string) error                                        { return nil }
+func (c *DummyCache) Sweep() int                                               { return 0 }
+func (c *DummyCache) Stats() CacheStats                                        { return CacheStats{} }
+func (c *DummyCache) Entries() []CacheEntryInfo                                { return []CacheEntryInfo{} }
+func (c *DummyCache) Delete(string) int                                        { return 0 }
+func (c *DummyCache) DeleteSuffix(string) int                                  { return 0 }
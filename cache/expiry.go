@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Source of the current time and of timers, so that expiry can be
+// tested without waiting for it
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+type expiryItem struct {
+	key   string
+	at    time.Time
+	fire  func()
+	index int
+}
+
+// Scheduled items ordered by when they're due
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// Runs a function for each key when it's due, using a single timer
+// for every key rather than a goroutine each. Each key has at most
+// one pending function; scheduling a key again replaces it.
+type expiryScheduler struct {
+	clock Clock
+	items expiryHeap
+	byKey map[string]*expiryItem
+	// Whether the goroutine running due items is active. It exits
+	// when nothing is scheduled.
+	running bool
+	// Wakes the running goroutine when the earliest item changes
+	wake  chan struct{}
+	mutex sync.Mutex
+}
+
+func newExpiryScheduler(clock Clock) *expiryScheduler {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	return &expiryScheduler{
+		clock: clock,
+		byKey: map[string]*expiryItem{},
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Run fire at the given time, replacing anything already
+// scheduled for the key
+func (s *expiryScheduler) Schedule(key string, at time.Time, fire func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item, ok := s.byKey[key]; ok {
+		item.at = at
+		item.fire = fire
+		heap.Fix(&s.items, item.index)
+	} else {
+		item := &expiryItem{key: key, at: at, fire: fire}
+		heap.Push(&s.items, item)
+		s.byKey[key] = item
+	}
+
+	if !s.running {
+		s.running = true
+		go s.run()
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *expiryScheduler) Cancel(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, ok := s.byKey[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&s.items, item.index)
+	delete(s.byKey, key)
+}
+
+// Number of keys with something scheduled
+func (s *expiryScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.items)
+}
+
+func (s *expiryScheduler) run() {
+	for {
+		s.mutex.Lock()
+
+		if len(s.items) < 1 {
+			s.running = false
+			s.mutex.Unlock()
+			return
+		}
+
+		next := s.items[0]
+		wait := next.at.Sub(s.clock.Now())
+
+		if wait <= 0 {
+			heap.Pop(&s.items)
+			delete(s.byKey, next.key)
+			s.mutex.Unlock()
+
+			// Functions may be slow (such as re-running a query), so
+			// they mustn't hold up anything else that's due
+			go next.fire()
+			continue
+		}
+
+		timer := s.clock.NewTimer(wait)
+		s.mutex.Unlock()
+
+		select {
+		case <-timer.C():
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
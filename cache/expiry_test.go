@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+type fakeTimer struct {
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+	clock   *fakeClock
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Clock that only moves when advanced
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mutex  sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) ClockTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1), clock: c}
+	c.timers = append(c.timers, timer)
+	c.fire()
+
+	return timer
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// The caller must hold the lock
+func (c *fakeClock) fire() {
+	pending := []*fakeTimer{}
+	for _, timer := range c.timers {
+		if timer.stopped {
+			continue
+		}
+
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+
+		timer.stopped = true
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+func expectFired(t *testing.T, fired chan string, expected string) {
+	t.Helper()
+
+	select {
+	case key := <-fired:
+		if key != expected {
+			t.Errorf("expected %s to fire, %s did", expected, key)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%s did not fire", expected)
+	}
+}
+
+func expectNotFired(t *testing.T, fired chan string) {
+	t.Helper()
+
+	select {
+	case key := <-fired:
+		t.Errorf("%s fired early", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestExpirySchedulerFiresWhenDue(t *testing.T) {
+	clock := newFakeClock()
+	scheduler := newExpiryScheduler(clock)
+	fired := make(chan string, 10)
+
+	scheduler.Schedule("later", clock.Now().Add(20*time.Second), func() { fired <- "later" })
+	scheduler.Schedule("sooner", clock.Now().Add(10*time.Second), func() { fired <- "sooner" })
+
+	expectNotFired(t, fired)
+
+	clock.Advance(10 * time.Second)
+	expectFired(t, fired, "sooner")
+	expectNotFired(t, fired)
+
+	clock.Advance(10 * time.Second)
+	expectFired(t, fired, "later")
+
+	if scheduler.Len() != 0 {
+		t.Errorf("fired items should not still be scheduled, %d are", scheduler.Len())
+	}
+}
+
+func TestExpirySchedulerReplacesKey(t *testing.T) {
+	clock := newFakeClock()
+	scheduler := newExpiryScheduler(clock)
+	fired := make(chan string, 10)
+
+	scheduler.Schedule("key", clock.Now().Add(10*time.Second), func() { fired <- "first" })
+	scheduler.Schedule("key", clock.Now().Add(20*time.Second), func() { fired <- "second" })
+
+	if scheduler.Len() != 1 {
+		t.Errorf("rescheduling a key should replace it, %d items are scheduled", scheduler.Len())
+	}
+
+	clock.Advance(10 * time.Second)
+	expectNotFired(t, fired)
+
+	clock.Advance(10 * time.Second)
+	expectFired(t, fired, "second")
+	expectNotFired(t, fired)
+}
+
+func TestExpirySchedulerCancel(t *testing.T) {
+	clock := newFakeClock()
+	scheduler := newExpiryScheduler(clock)
+	fired := make(chan string, 10)
+
+	scheduler.Schedule("cancelled", clock.Now().Add(10*time.Second), func() { fired <- "cancelled" })
+	scheduler.Schedule("kept", clock.Now().Add(10*time.Second), func() { fired <- "kept" })
+	scheduler.Cancel("cancelled")
+
+	clock.Advance(10 * time.Second)
+	expectFired(t, fired, "kept")
+	expectNotFired(t, fired)
+}
+
+func TestCacheOverwriteDoesNotDuplicateExpireCallback(t *testing.T) {
+	clock := newFakeClock()
+	config := getCacheConfig()
+	config.Clock = clock
+	cache, _ := getSpudcache(false, config)
+
+	fired := make(chan string, 10)
+	cache.SetExpireCallback(func(q dns.Question, _ models.DnsResponse, _ int, _ Cache) bool {
+		fired <- q.Name
+		return false
+	})
+
+	for i := 0; i < 3; i++ {
+		cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+	}
+	removed := cacheTestEntry(t, cache, "removed.example.com.", 60*time.Second)
+	activeSpudCache.remove(getDnsQuestionCacheKey(removed))
+
+	if activeSpudCache.expiry.Len() != 1 {
+		t.Errorf("expected 1 scheduled expiry, got %d", activeSpudCache.expiry.Len())
+	}
+
+	clock.Advance(60 * time.Second)
+	expectFired(t, fired, "example.com.")
+	expectNotFired(t, fired)
+}
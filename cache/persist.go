@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Identifies a persisted cache file
+var cacheFileMagic = [8]byte{'s', 'p', 'u', 'd', 'c', 'a', 'c', 'h'}
+
+// Version of the persisted cache format. This changes whenever
+// the payload can no longer be read by older versions.
+const cacheFileVersion = 1
+
+var ErrCacheFileCorrupt = errors.New("cache file is corrupt")
+
+// Written at the start of a persisted cache file, followed by the
+// payload (the entries as JSON)
+type cacheFileHeader struct {
+	Magic   [8]byte
+	Version uint32
+	// CRC-32 (IEEE) of the payload
+	Checksum uint32
+	Length   uint64
+}
+
+// Write entries to a file. The entries are written to a temporary
+// file which then replaces the existing one, so a crash while
+// writing leaves the previous file intact. If sync is true, the
+// file is flushed to disk before it replaces the previous one.
+func writeCacheFile(path string, entries map[string]cacheEntry, sync bool) error {
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	header := cacheFileHeader{
+		Magic:    cacheFileMagic,
+		Version:  cacheFileVersion,
+		Checksum: crc32.ChecksumIEEE(payload),
+		Length:   uint64(len(payload)),
+	}
+
+	// The temporary file is created with 0600 permissions, since
+	// the cache reveals what clients have been looking up
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := binary.Write(tmp, binary.BigEndian, header); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if sync {
+		// Make the rename itself durable
+		if dir, err := os.Open(filepath.Dir(path)); err == nil {
+			dir.Sync()
+			dir.Close()
+		}
+	}
+
+	return nil
+}
+
+// Read the entries from a file written by writeCacheFile, or by
+// versions of spuddns from before the format had a header
+func readCacheFile(path string) (map[string]cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, cacheFileMagic[:]) {
+		return readLegacyCacheFile(data)
+	}
+
+	reader := bytes.NewReader(data)
+
+	var header cacheFileHeader
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheFileCorrupt, err)
+	}
+
+	if header.Version != cacheFileVersion {
+		return nil, fmt.Errorf("unsupported cache file version %d", header.Version)
+	}
+
+	if header.Length != uint64(reader.Len()) {
+		return nil, fmt.Errorf("%w: expected %d bytes of entries, found %d", ErrCacheFileCorrupt, header.Length, reader.Len())
+	}
+
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != header.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCacheFileCorrupt)
+	}
+
+	entries := map[string]cacheEntry{}
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheFileCorrupt, err)
+	}
+
+	return entries, nil
+}
+
+func readLegacyCacheFile(data []byte) (map[string]cacheEntry, error) {
+	entries := map[string]cacheEntry{}
+	if err := json.Unmarshal(data, &entries); err == nil {
+		return entries, nil
+	}
+
+	// Older versions still stored each entry as JSON within the file
+	legacy := map[string][]byte{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheFileCorrupt, err)
+	}
+
+	for key, value := range legacy {
+		var entry cacheEntry
+		if json.Unmarshal(value, &entry) == nil {
+			entries[key] = entry
+		}
+	}
+
+	return entries, nil
+}
+
+// Read the entries in a persisted cache file, including expired ones,
+// without loading them into a cache. Entries that can't be decoded are
+// counted in skipped.
+func ReadCacheFile(path string) (entries []CacheEntryInfo, skipped int, err error) {
+	stored, err := readCacheFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries = []CacheEntryInfo{}
+	for key, entry := range stored {
+		info, ok := newCacheEntryInfo(key, entry)
+		if !ok {
+			skipped++
+			continue
+		}
+		entries = append(entries, info)
+	}
+
+	return entries, skipped, nil
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistedCacheFileIsPrivate(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+	cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache")
+	if err := cache.Persist(path); err != nil {
+		t.Fatalf("persisting the cache errored: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("persisted cache file is missing: %v", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the cache file to only be readable by its owner, mode is %v", info.Mode().Perm())
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files were left behind: %v", files)
+	}
+}
+
+func TestCorruptCacheFileIsNotLoaded(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+	question := cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := cache.Persist(path); err != nil {
+		t.Fatalf("persisting the cache errored: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+
+	truncated := data[:len(data)-10]
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-10] ^= 0xff
+
+	for name, corrupt := range map[string][]byte{"truncated": truncated, "flipped": flipped} {
+		os.WriteFile(path, corrupt, 0600)
+
+		loaded, _ := getSpudcache(false, getCacheConfig())
+		err := loaded.Load(path)
+		if !errors.Is(err, ErrCacheFileCorrupt) {
+			t.Errorf("%s: expected the file to be reported as corrupt, got %v", name, err)
+		}
+
+		if isCachedTest(loaded, question) {
+			t.Errorf("%s: entries were loaded from a corrupt file", name)
+		}
+	}
+}
+
+func TestExpiredEntriesAreNotLoaded(t *testing.T) {
+	config := getCacheConfig()
+	config.MaxStale = time.Minute
+	cache, _ := getSpudcache(false, config)
+
+	stale := cacheTestEntry(t, cache, "stale.example.com.", 0)
+	current := cacheTestEntry(t, cache, "current.example.com.", 60*time.Second)
+
+	entries := activeSpudCache.snapshot()
+	expired := entries[getDnsQuestionCacheKey(current)]
+	expired.Expires = time.Now().Add(-time.Hour)
+	entries["expired.example.com.::1"] = expired
+
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := writeCacheFile(path, entries, false); err != nil {
+		t.Fatalf("writing the cache file errored: %v", err)
+	}
+
+	loaded, _ := getSpudcache(false, config)
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("loading the cache errored: %v", err)
+	}
+
+	if activeSpudCache.len() != 2 {
+		t.Errorf("expected 2 entries to be loaded, got %d", activeSpudCache.len())
+	}
+
+	if !isCachedTest(loaded, current) {
+		t.Errorf("unexpired entry was not loaded")
+	}
+
+	if _, entry, err := activeSpudCache.get(getDnsQuestionCacheKey(stale)); err != nil || entry.Expires.IsZero() {
+		t.Errorf("entry within the stale window was not loaded")
+	}
+}
+
+func TestLegacyCacheFileIsLoaded(t *testing.T) {
+	cache, _ := getSpudcache(false, getCacheConfig())
+	question := cacheTestEntry(t, cache, "example.com.", 60*time.Second)
+
+	legacy := map[string][]byte{}
+	for key, entry := range activeSpudCache.snapshot() {
+		legacy[key], _ = json.Marshal(entry)
+	}
+	data, _ := json.Marshal(legacy)
+
+	path := filepath.Join(t.TempDir(), "cache")
+	os.WriteFile(path, data, 0600)
+
+	loaded, _ := getSpudcache(false, getCacheConfig())
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("loading the cache errored: %v", err)
+	}
+
+	if !isCachedTest(loaded, question) {
+		t.Errorf("entry was not loaded from a legacy cache file")
+	}
+}
+
+func TestCacheFileWithoutMessagesIsSkipped(t *testing.T) {
+	// As written before complete messages were cached
+	data, _ := json.Marshal(map[string]any{
+		"missing.example.com.::28": map[string]any{
+			"Expires": time.Now().Add(time.Minute),
+			"Rcode":   3,
+			"Soa":     "example.com.\t60\tIN\tSOA\tns.example.com. admin.example.com. 1 7200 3600 1209600 60",
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "cache")
+	os.WriteFile(path, data, 0600)
+
+	loaded, _ := getSpudcache(false, getCacheConfig())
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("loading the cache errored: %v", err)
+	}
+
+	if entries := activeSpudCache.len(); entries != 0 {
+		t.Errorf("expected entries without a message to be skipped, loaded %d", entries)
+	}
+}
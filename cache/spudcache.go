@@ -1,24 +1,88 @@
 package cache
 
 import (
-	"encoding/json"
+	"container/list"
 	"errors"
 	"fmt"
-	"os"
+	"hash/maphash"
+	"math/rand/v2"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/thenaterhood/spuddns/models"
 )
 
+// How many entries are sampled when looking for the least
+// frequently used one to evict
+const lfuSampleSize = 8
+
+// How many shards the cache is split into if the config doesn't
+// say otherwise
+const defaultCacheShards = 32
+
 var activeSpudCache *spudcache
 
+// A cached response. Entries are only serialized when the cache
+// is persisted, so reading one doesn't need to decode anything
+// but the message.
+type spudcacheItem struct {
+	key string
+	// The response in wire format. This is replaced rather than
+	// modified, so it can be read after the lock is released.
+	msg      []byte
+	expires  time.Time
+	resolver string
+	received time.Time
+	hits     atomic.Int64
+	// When the entry was last stored or used, in nanoseconds, to
+	// compare entries in different shards
+	lastUsed atomic.Int64
+	// Position in the recently used list. This is set when the
+	// item is created and never changes.
+	element *list.Element
+}
+
+func (i *spudcacheItem) size() int {
+	return len(i.key) + len(i.msg) + len(i.resolver)
+}
+
+func (i *spudcacheItem) entry() cacheEntry {
+	return cacheEntry{
+		Msg:          i.msg,
+		Expires:      i.expires,
+		RequestCount: int(i.hits.Load()),
+		Resolver:     i.resolver,
+		Received:     i.received,
+	}
+}
+
+// A part of the cache with its own lock, so that queries for
+// different names don't wait on each other
+type spudcacheShard struct {
+	items map[string]*spudcacheItem
+	// Items, from the most to the least recently used. This has
+	// its own lock so cache hits can reorder it while only holding
+	// the read lock on the shard.
+	recent      *list.List
+	recentMutex sync.Mutex
+	mutex       sync.RWMutex
+}
+
 type spudcache struct {
-	cache          map[string][]byte
+	shards []*spudcacheShard
+	seed   maphash.Seed
+	// Totals across every shard, which the limits apply to
+	entries        atomic.Int64
+	bytes          atomic.Int64
+	hits           atomic.Int64
+	misses         atomic.Int64
+	evictions      atomic.Int64
 	expireCallback ExpireCallbackFn
+	expiry         *expiryScheduler
 	config         CacheConfig
-	cacheMutex     sync.RWMutex
 }
 
 var ErrEntryNotFound = errors.New("entry not found")
@@ -33,166 +97,439 @@ func getSpudcache(keep bool, config CacheConfig) (Cache, error) {
 		activeSpudCache = nil
 	}
 
+	shardCount := config.Shards
+	if shardCount < 1 {
+		shardCount = defaultCacheShards
+	}
+
 	cache := spudcache{
-		cache:          map[string][]byte{},
+		shards:         make([]*spudcacheShard, shardCount),
+		seed:           maphash.MakeSeed(),
 		expireCallback: nil,
+		expiry:         newExpiryScheduler(config.Clock),
 		config:         config,
-		cacheMutex:     sync.RWMutex{},
+	}
+
+	for i := range cache.shards {
+		cache.shards[i] = &spudcacheShard{
+			items:  map[string]*spudcacheItem{},
+			recent: list.New(),
+		}
 	}
 
 	activeSpudCache = &cache
 	return activeSpudCache, nil
 }
 
-func (c *spudcache) set(key string, value []byte) error {
-	c.cacheMutex.Lock()
-	defer c.cacheMutex.Unlock()
-	c.cache[key] = value
+func (c *spudcache) shard(key string) *spudcacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Number of entries in the cache
+func (c *spudcache) len() int {
+	return int(c.entries.Load())
+}
+
+// Store an entry in a shard. The caller must hold the shard's
+// write lock, and evict entries afterward if the cache is full.
+func (c *spudcache) store(shard *spudcacheShard, key string, entry cacheEntry) {
+	shard.recentMutex.Lock()
+	item, ok := shard.items[key]
+	if ok {
+		c.bytes.Add(int64(-item.size()))
+		shard.recent.MoveToFront(item.element)
+	} else {
+		item = &spudcacheItem{key: key}
+		item.element = shard.recent.PushFront(item)
+		shard.items[key] = item
+		c.entries.Add(1)
+	}
+	shard.recentMutex.Unlock()
+
+	item.msg = entry.Msg
+	item.expires = entry.Expires
+	item.resolver = entry.Resolver
+	item.received = entry.Received
+	item.hits.Store(int64(entry.RequestCount))
+	item.lastUsed.Store(time.Now().UnixNano())
+	c.bytes.Add(int64(item.size()))
+}
+
+func (c *spudcache) setEntry(key string, entry cacheEntry) error {
+	shard := c.shard(key)
+	shard.mutex.Lock()
+	c.store(shard, key, entry)
+	shard.mutex.Unlock()
+
+	c.evict(key)
+	c.updateSizeMetrics()
 
 	return nil
 }
 
-func (c *spudcache) get(key string) ([]byte, error) {
-	c.cacheMutex.RLock()
-	defer c.cacheMutex.RUnlock()
+func (c *spudcache) get(key string) (*spudcacheItem, cacheEntry, error) {
+	shard := c.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 
-	val, ok := c.cache[key]
+	item, ok := shard.items[key]
 	if !ok {
-		return nil, ErrEntryNotFound
+		return nil, cacheEntry{}, ErrEntryNotFound
+	}
+
+	return item, item.entry(), nil
+}
+
+// Record that an entry was used to answer a query
+func (c *spudcache) hit(item *spudcacheItem) {
+	item.hits.Add(1)
+	item.lastUsed.Store(time.Now().UnixNano())
+
+	// If the item was removed in the meantime this does nothing
+	shard := c.shard(item.key)
+	shard.recentMutex.Lock()
+	shard.recent.MoveToFront(item.element)
+	shard.recentMutex.Unlock()
+}
+
+func (c *spudcache) requestCount(key string) int {
+	shard := c.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	item, ok := shard.items[key]
+	if !ok {
+		return 0
+	}
+
+	return int(item.hits.Load())
+}
+
+// Remove an item if it's still in the shard. The caller must hold
+// the shard's write lock.
+func (c *spudcache) removeLocked(shard *spudcacheShard, item *spudcacheItem) bool {
+	if shard.items[item.key] != item {
+		return false
 	}
 
-	return val, nil
+	shard.recentMutex.Lock()
+	shard.recent.Remove(item.element)
+	shard.recentMutex.Unlock()
+
+	c.bytes.Add(int64(-item.size()))
+	c.entries.Add(-1)
+	delete(shard.items, item.key)
+	c.expiry.Cancel(item.key)
+
+	return true
 }
 
 func (c *spudcache) remove(key string) {
-	c.cacheMutex.Lock()
-	defer c.cacheMutex.Unlock()
+	shard := c.shard(key)
+	shard.mutex.Lock()
+	if item, ok := shard.items[key]; ok {
+		c.removeLocked(shard, item)
+	}
+	shard.mutex.Unlock()
 
-	delete(c.cache, key)
+	c.updateSizeMetrics()
 }
 
-func (c *spudcache) Persist(path string) error {
-	c.cacheMutex.RLock()
-	defer c.cacheMutex.RUnlock()
+func (c *spudcache) isFull() bool {
+	return (c.config.MaxEntries > 0 && c.entries.Load() > int64(c.config.MaxEntries)) ||
+		(c.config.MaxBytes > 0 && c.bytes.Load() > int64(c.config.MaxBytes))
+}
 
-	data, err := json.Marshal(c.cache)
-	if err != nil {
-		return err
+// Choose the entry to evict according to the eviction policy,
+// never choosing keep (the entry that was just stored). Shards are
+// locked one at a time, so the choice is approximate when entries
+// are being stored concurrently.
+func (c *spudcache) victim(keep string) (*spudcacheShard, *spudcacheItem) {
+	var victimShard *spudcacheShard
+	var victim *spudcacheItem
+
+	switch c.config.EvictionPolicy {
+	case EvictionLFU:
+		// Sampling avoids scanning the whole cache for every
+		// eviction, at the cost of it being approximate
+		sampled := 0
+		offset := rand.IntN(len(c.shards))
+		for i := range c.shards {
+			shard := c.shards[(offset+i)%len(c.shards)]
+
+			shard.mutex.RLock()
+			for key, item := range shard.items {
+				if key == keep {
+					continue
+				}
+
+				if victim == nil || item.hits.Load() < victim.hits.Load() {
+					victimShard, victim = shard, item
+				}
+
+				sampled++
+				if sampled >= lfuSampleSize {
+					break
+				}
+			}
+			shard.mutex.RUnlock()
+
+			if sampled >= lfuSampleSize {
+				break
+			}
+		}
+	default:
+		// The least recently used entry is at the back of one of
+		// the shards' lists
+		for _, shard := range c.shards {
+			shard.recentMutex.Lock()
+			for e := shard.recent.Back(); e != nil; e = e.Prev() {
+				item := e.Value.(*spudcacheItem)
+				if item.key == keep {
+					continue
+				}
+
+				if victim == nil || item.lastUsed.Load() < victim.lastUsed.Load() {
+					victimShard, victim = shard, item
+				}
+				break
+			}
+			shard.recentMutex.Unlock()
+		}
 	}
 
-	return os.WriteFile(path, data, 0644)
+	return victimShard, victim
 }
 
-func (c *spudcache) Load(path string) error {
-	c.cacheMutex.Lock()
-	defer c.cacheMutex.Unlock()
+// Evict entries until the cache is within its limits. The caller
+// must not hold any shard's lock.
+func (c *spudcache) evict(keep string) {
+	for c.isFull() {
+		shard, item := c.victim(keep)
+		if item == nil {
+			return
+		}
+
+		shard.mutex.Lock()
+		removed := c.removeLocked(shard, item)
+		shard.mutex.Unlock()
+
+		if removed {
+			c.config.Logger.Debug("evicting cache entry", "key", item.key)
+			c.evictions.Add(1)
+			c.config.Metrics.IncCacheEvictions()
+		}
+	}
+}
+
+func (c *spudcache) updateSizeMetrics() {
+	c.config.Metrics.SetCacheEntries(c.len())
+	c.config.Metrics.SetCacheBytes(int(c.bytes.Load()))
+}
+
+func (c *spudcache) Stats() CacheStats {
+	return CacheStats{
+		Entries:    c.len(),
+		Bytes:      int(c.bytes.Load()),
+		MaxEntries: c.config.MaxEntries,
+		MaxBytes:   c.config.MaxBytes,
+		Hits:       int(c.hits.Load()),
+		Misses:     int(c.misses.Load()),
+		Evictions:  int(c.evictions.Load()),
+	}
+}
+
+func (c *spudcache) Sweep() int {
+	now := time.Now()
+	removed := 0
+
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		for _, item := range shard.items {
+			if item.expires.Add(c.config.MaxStale).Before(now) && c.removeLocked(shard, item) {
+				removed++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	c.updateSizeMetrics()
+
+	return removed
+}
+
+func (c *spudcache) Entries() []CacheEntryInfo {
+	entries := []CacheEntryInfo{}
+
+	for key, entry := range c.snapshot() {
+		if info, ok := newCacheEntryInfo(key, entry); ok {
+			entries = append(entries, info)
+		}
+	}
+
+	return entries
+}
+
+// Remove the entries whose question name matches, returning how
+// many were removed
+func (c *spudcache) removeMatching(match func(name string) bool) int {
+	removed := 0
+
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		for key, item := range shard.items {
+			question, ok := parseDnsQuestionCacheKey(key)
+			if ok && match(question.Name) && c.removeLocked(shard, item) {
+				removed++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	c.updateSizeMetrics()
+
+	return removed
+}
+
+func (c *spudcache) Delete(name string) int {
+	name = dns.Fqdn(name)
+	return c.removeMatching(func(entryName string) bool {
+		return strings.EqualFold(dns.Fqdn(entryName), name)
+	})
+}
+
+func (c *spudcache) DeleteSuffix(suffix string) int {
+	suffix = dns.Fqdn(suffix)
+	return c.removeMatching(func(entryName string) bool {
+		return dns.IsSubDomain(suffix, dns.Fqdn(entryName))
+	})
+}
+
+// Copy every entry, locking one shard at a time so that queries
+// aren't held up for the whole copy
+func (c *spudcache) snapshot() map[string]cacheEntry {
+	snapshot := make(map[string]cacheEntry, c.len())
+
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		for key, item := range shard.items {
+			snapshot[key] = item.entry()
+		}
+		shard.mutex.RUnlock()
+	}
+
+	return snapshot
+}
+
+func (c *spudcache) Persist(path string) error {
+	// Entries are serialized from a snapshot so the cache is only
+	// locked while it's copied
+	return writeCacheFile(path, c.snapshot(), c.config.PersistSync)
+}
 
-	data, err := os.ReadFile(path)
+func (c *spudcache) Load(path string) error {
+	entries, err := readCacheFile(path)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, &c.cache)
+	now := time.Now()
+	for key, entry := range entries {
+		// Entries from versions that stored the answers (or the rcode
+		// and SOA of negative answers) rather than the message can't
+		// be answered from, so they're dropped
+		if len(entry.Msg) == 0 || entry.Expires.Add(c.config.MaxStale).Before(now) {
+			continue
+		}
+
+		c.setEntry(key, entry)
+	}
+
+	return nil
 }
 
 func (c *spudcache) CacheDnsResponse(question dns.Question, response models.DnsResponse) error {
 	key := getDnsQuestionCacheKey(question)
 
-	if response.IsEmpty() {
+	if response.IsEmpty() && response.Soa() == nil {
 		return nil
 	}
 
-	answers, err := response.Answers()
+	msg, err := response.Pack()
 	if err != nil {
 		return err
 	}
 
 	cache_entry := cacheEntry{
-		Dns:      answers,
+		Msg:      msg,
 		Expires:  response.Expires,
 		Resolver: response.Resolver,
+		Received: response.Received(),
 	}
 
-	value, err := json.Marshal(cache_entry)
-
-	if err != nil {
-		return err
-	}
-
-	ret := c.set(key, value)
-
-	if c.expireCallback != nil {
-		go func(question dns.Question, response models.DnsResponse) {
-			time.Sleep(response.GetTtl() - 10*time.Second)
+	ret := c.setEntry(key, cache_entry)
 
-			retrieveCount := 0
-			var cached cacheEntry
-			key := getDnsQuestionCacheKey(question)
-
-			raw_value, err := c.get(key)
-			if err == nil {
-				err = json.Unmarshal(raw_value, &cached)
-				if err == nil {
-					retrieveCount = cached.RequestCount
-				}
-			}
+	if c.expireCallback != nil && ret == nil {
+		// Scheduling replaces the callback for the entry this
+		// overwrote, if there was one
+		c.expiry.Schedule(key, response.Expires.Add(-10*time.Second), func() {
+			retrieveCount := c.requestCount(key)
 
 			keep := c.expireCallback(question, response, retrieveCount, c)
-			if !keep {
+			if !keep && c.config.MaxStale <= 0 {
+				// Entries that may be served stale are left to
+				// expire on their own
 				c.remove(key)
 			}
-		}(question, response)
+		})
 	}
 
 	return ret
 }
 
 func (c *spudcache) getDnsResponse(question dns.Question) (*models.DnsResponse, error) {
+	return c.getDnsResponseWithStale(question, false)
+}
+
+func (c *spudcache) getDnsResponseWithStale(question dns.Question, allowStale bool) (*models.DnsResponse, error) {
 	timer := c.config.Metrics.GetCacheReadTimer()
 	defer c.config.Metrics.ObserveTimer(timer)
 
 	key := getDnsQuestionCacheKey(question)
 
-	raw_value, err := c.get(key)
+	item, value, err := c.get(key)
 
 	if err == ErrEntryNotFound {
+		c.misses.Add(1)
 		return nil, nil
 	}
 
 	if err != nil {
-		return nil, err
-	}
-
-	var value cacheEntry
-
-	err = json.Unmarshal(raw_value, &value)
-	if err != nil {
+		c.misses.Add(1)
 		return nil, err
 	}
 
 	if value.Expires.Before(time.Now()) {
-		c.remove(key)
-		return nil, nil
+		if value.Expires.Add(c.config.MaxStale).Before(time.Now()) {
+			c.remove(key)
+			c.misses.Add(1)
+			return nil, nil
+		}
+
+		if !allowStale {
+			c.misses.Add(1)
+			return nil, nil
+		}
 	}
 
-	response, err := models.NewDnsResponseFromDnsAnswers(value.Dns)
+	response, err := value.response()
 	if err != nil {
+		c.misses.Add(1)
 		return nil, err
 	}
 
-	response.FromCache = true
-	response.Expires = value.Expires
-	response.Resolver = value.Resolver
-
-	go func() {
-		value.RequestCount += 1
-		marshalled, err := json.Marshal(value)
-
-		if err != nil {
-			return
-		}
-		c.set(key, marshalled)
-	}()
+	c.hit(item)
+	c.hits.Add(1)
 
 	return response, nil
 }
@@ -206,6 +543,13 @@ func (c *spudcache) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
 	return c.getDnsResponse(*q.FirstQuestion())
 }
 
+func (c *spudcache) QueryStale(q models.DnsQuery) (*models.DnsResponse, error) {
+	if q.FirstQuestion() == nil {
+		return nil, fmt.Errorf("query question was nil")
+	}
+	return c.getDnsResponseWithStale(*q.FirstQuestion(), true)
+}
+
 func (c *spudcache) SetExpireCallback(cb ExpireCallbackFn) {
 	c.expireCallback = cb
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/metrics"
+)
+
+// Inspect a persisted cache file without a running server
+func cacheCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) < 1 {
+		printUsage(stderr)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	conffile := flags.String("config", defaultConfigFile, "config file (cache load only)")
+
+	positional, err := parseArgs(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		printUsage(stderr)
+		return 2
+	}
+	path := positional[0]
+
+	switch args[0] {
+	case "dump":
+		return dumpCacheFile(path, stdout, stderr)
+	case "stats":
+		return cacheFileStats(path, stdout, stderr)
+	case "load":
+		return loadCacheFile(path, *conffile, stdout, stderr)
+	default:
+		printUsage(stderr)
+		return 2
+	}
+}
+
+func readCacheFileEntries(path string, stderr io.Writer) ([]cache.CacheEntryInfo, int, bool) {
+	entries, skipped, err := cache.ReadCacheFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read %s: %v\n", path, err)
+		return nil, 0, false
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Question.Name != entries[j].Question.Name {
+			return entries[i].Question.Name < entries[j].Question.Name
+		}
+		return entries[i].Question.Qtype < entries[j].Question.Qtype
+	})
+
+	return entries, skipped, true
+}
+
+// Describe how long is left until an entry expires
+func describeExpiry(expires time.Time, now time.Time) string {
+	remaining := expires.Sub(now).Round(time.Second)
+	if remaining < 0 {
+		return fmt.Sprintf("expired %s ago", -remaining)
+	}
+	return fmt.Sprintf("expires in %s", remaining)
+}
+
+func dumpCacheFile(path string, stdout io.Writer, stderr io.Writer) int {
+	entries, skipped, ok := readCacheFileEntries(path, stderr)
+	if !ok {
+		return 1
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		fmt.Fprintf(
+			stdout,
+			";; %s %s %s, %s, %d hits, from %s\n",
+			entry.Question.Name,
+			dns.TypeToString[entry.Question.Qtype],
+			dns.RcodeToString[entry.Response.Rcode()],
+			describeExpiry(entry.Expires, now),
+			entry.Hits,
+			entry.Resolver,
+		)
+		for _, rr := range entry.Response.AnswerRRs() {
+			fmt.Fprintln(stdout, rr.String())
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(stderr, "%d entries could not be read\n", skipped)
+	}
+
+	return 0
+}
+
+func cacheFileStats(path string, stdout io.Writer, stderr io.Writer) int {
+	entries, skipped, ok := readCacheFileEntries(path, stderr)
+	if !ok {
+		return 1
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read %s: %v\n", path, err)
+		return 1
+	}
+
+	now := time.Now()
+	expired := 0
+	hits := 0
+	for _, entry := range entries {
+		if entry.Expires.Before(now) {
+			expired++
+		}
+		hits += entry.Hits
+	}
+
+	fmt.Fprintf(stdout, "file: %s\n", path)
+	fmt.Fprintf(stdout, "modified: %s\n", info.ModTime().Format(time.RFC3339))
+	fmt.Fprintf(stdout, "bytes: %d\n", info.Size())
+	fmt.Fprintf(stdout, "entries: %d\n", len(entries))
+	fmt.Fprintf(stdout, "expired: %d\n", expired)
+	fmt.Fprintf(stdout, "unreadable: %d\n", skipped)
+	fmt.Fprintf(stdout, "hits: %d\n", hits)
+
+	return 0
+}
+
+// Load a cache file into a cache set up from the config, as the
+// server does when it starts, and report what was kept
+func loadCacheFile(path string, conffile string, stdout io.Writer, stderr io.Writer) int {
+	entries, skipped, ok := readCacheFileEntries(path, stderr)
+	if !ok {
+		return 1
+	}
+
+	config, err := app.ReadConfig(conffile)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%v\n", conffile, err)
+		return 1
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	cacheConfig := getCacheConfig(config, logger, metrics.DummyMetrics{})
+	cacheConfig.Enable = true
+
+	loaded, err := cache.GetCache(cacheConfig)
+	if err == nil {
+		err = loaded.Load(path)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load %s: %v\n", path, err)
+		return 1
+	}
+
+	stats := loaded.Stats()
+	fmt.Fprintf(stdout, "%d of %d entries would be loaded (%d bytes)\n", stats.Entries, len(entries)+skipped, stats.Bytes)
+	if stats.Evictions > 0 {
+		fmt.Fprintf(stdout, "%d entries would be evicted to fit the cache limits\n", stats.Evictions)
+	}
+
+	return 0
+}
@@ -2,29 +2,57 @@ package daemon
 
 import (
 	"context"
+	"errors"
+	"os"
 	"time"
 
 	"github.com/thenaterhood/spuddns/app"
 )
 
 type PersistentCache struct {
-	config app.AppConfig
+	config *app.LiveConfig
 	state  *app.AppState
 }
 
-func NewPersistentCache(config app.AppConfig, state *app.AppState) *PersistentCache {
+func NewPersistentCache(config *app.LiveConfig, state *app.AppState) *PersistentCache {
 	return &PersistentCache{
 		config: config,
 		state:  state,
 	}
 }
 
+// Write the cache to the file in the running config, if one is set
+func (c *PersistentCache) persist() {
+	file := c.config.Get().PersistentCacheFile
+	if file == "" {
+		return
+	}
+
+	c.state.Log.Debug("persisting cache to disk")
+	err := c.state.Cache.Persist(file)
+	if err != nil {
+		c.state.Log.Warn("failed to persist cache", "error", err)
+	}
+}
+
+// Start loading and periodically persisting the cache. The file is
+// read from the running config each time, so setting or changing it
+// takes effect when the config is reloaded. The returned
+// function persists the cache once more before stopping, and
+// returns once it has been written.
 func (c *PersistentCache) Start() context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
 	go func() {
+		defer close(stopped)
+
 		c.state.Log.Debug("persistent cache started")
-		if err := c.state.Cache.Load(c.config.PersistentCacheFile); err != nil {
-			c.state.Log.Warn("failed to load cache", "error", err)
+		if file := c.config.Get().PersistentCacheFile; file != "" {
+			err := c.state.Cache.Load(file)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				c.state.Log.Warn("failed to load cache", "error", err)
+			}
 		}
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
@@ -32,16 +60,17 @@ func (c *PersistentCache) Start() context.CancelFunc {
 		for {
 			select {
 			case <-ctx.Done():
-				c.state.Log.Debug("cache pipeline stopped")
+				c.persist()
+				c.state.Log.Debug("persistent cache stopped")
 				return
 			case <-ticker.C:
-				c.state.Log.Debug("persisting cache to disk")
-				err := c.state.Cache.Persist(c.config.PersistentCacheFile)
-				if err != nil {
-					c.state.Log.Warn("failed to persist cache", "error", err)
-				}
+				c.persist()
 			}
 		}
 	}()
-	return cancel
+
+	return func() {
+		cancel()
+		<-stopped
+	}
 }
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/cache"
+)
+
+func TestPersistentCachePersistsOnStop(t *testing.T) {
+	state := getAppState(&cache.DummyCache{})
+	state.Cache, _ = cache.GetCache(cache.CacheConfig{
+		Enable:  true,
+		Logger:  state.Log,
+		Metrics: state.Metrics,
+	})
+
+	config := app.GetDefaultConfig()
+	config.PersistentCacheFile = filepath.Join(t.TempDir(), "cache")
+
+	persistentCache := NewPersistentCache(app.NewLiveConfig("", &config), state)
+	stop := persistentCache.Start()
+	stop()
+
+	if _, err := os.Stat(config.PersistentCacheFile); err != nil {
+		t.Errorf("cache was not persisted when stopped: %v", err)
+	}
+}
+
+func TestPersistentCacheUsesReloadedFile(t *testing.T) {
+	state := getAppState(&cache.DummyCache{})
+	state.Cache, _ = cache.GetCache(cache.CacheConfig{
+		Enable:  true,
+		Logger:  state.Log,
+		Metrics: state.Metrics,
+	})
+
+	config := app.GetDefaultConfig()
+	liveConfig := app.NewLiveConfig("", &config)
+
+	persistentCache := NewPersistentCache(liveConfig, state)
+	stop := persistentCache.Start()
+
+	reloaded := app.GetDefaultConfig()
+	reloaded.PersistentCacheFile = filepath.Join(t.TempDir(), "cache")
+	if err := liveConfig.Replace(&reloaded); err != nil {
+		t.Fatalf("unexpected error replacing config: %v", err)
+	}
+	stop()
+
+	if _, err := os.Stat(reloaded.PersistentCacheFile); err != nil {
+		t.Errorf("cache was not persisted to the reloaded file: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package daemon
+
+import (
+	"context"
+
+	"github.com/thenaterhood/spuddns/app"
+)
+
+type CacheSweeper struct {
+	config *app.LiveConfig
+	state  *app.AppState
+}
+
+func NewCacheSweeper(config *app.LiveConfig, state *app.AppState) *CacheSweeper {
+	return &CacheSweeper{
+		config: config,
+		state:  state,
+	}
+}
+
+// Remove expired entries from the cache so they don't take up
+// space until they happen to be queried again
+func (s *CacheSweeper) sweep() {
+	removed := s.state.Cache.Sweep()
+	if removed > 0 {
+		s.state.Log.Debug("swept expired cache entries", "removed", removed)
+	}
+}
+
+func (s *CacheSweeper) Start() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if s.state.Cache == nil {
+		return cancel
+	}
+
+	go func() {
+		s.state.Log.Debug("cache sweeper started")
+		runEvery(ctx, s.config, func(config *app.AppConfig) int { return config.CacheSweepInterval }, s.sweep)
+		s.state.Log.Debug("cache sweeper stopped")
+	}()
+
+	return cancel
+}
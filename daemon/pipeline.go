@@ -2,17 +2,18 @@ package daemon
 
 import (
 	"context"
+	"time"
 
 	"github.com/thenaterhood/spuddns/app"
 	"github.com/thenaterhood/spuddns/models"
 )
 
 type CachePipeline struct {
-	config app.AppConfig
+	config *app.LiveConfig
 	state  *app.AppState
 }
 
-func NewCachePipeline(config app.AppConfig, state *app.AppState) *CachePipeline {
+func NewCachePipeline(config *app.LiveConfig, state *app.AppState) *CachePipeline {
 	return &CachePipeline{
 		config: config,
 		state:  state,
@@ -31,7 +32,13 @@ func (c *CachePipeline) Start() context.CancelFunc {
 		for {
 			select {
 			case exchange := <-*c.state.DnsPipeline:
-				if c.config.IsCacheable(exchange.Question, &exchange.Response) {
+				config := c.config.Get()
+				if config.IsCacheable(exchange.Question, &exchange.Response) {
+					maxNegativeTtl := time.Duration(config.NegativeCacheMaxTtl) * time.Second
+					if exchange.Response.IsNegative() && exchange.Response.GetTtl() > maxNegativeTtl {
+						exchange.Response.SetTtl(maxNegativeTtl)
+					}
+
 					c.state.Log.Debug("caching dns response", "query", exchange.Question.Name, "qtype", exchange.Question.Qtype)
 					err := c.state.Cache.CacheDnsResponse(exchange.Question, exchange.Response)
 					if err != nil {
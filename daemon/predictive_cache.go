@@ -13,10 +13,10 @@ import (
 
 type CacheMinder struct {
 	appState  app.AppState
-	appConfig *app.AppConfig
+	appConfig *app.LiveConfig
 }
 
-func NewCacheMinder(config *app.AppConfig, state app.AppState) *CacheMinder {
+func NewCacheMinder(config *app.LiveConfig, state app.AppState) *CacheMinder {
 	return &CacheMinder{
 		appState:  state,
 		appConfig: config,
@@ -27,7 +27,9 @@ func (minder CacheMinder) RefreshExpiringCacheItem(q dns.Question, expiring mode
 
 	minder.appState.Log.Debug("cache entry expiring", "query", q.Name, "qtype", q.Qtype, "retrievalCount", retrieveCount)
 
-	if retrieveCount < minder.appConfig.PredictiveThreshold {
+	appConfig := minder.appConfig.Get()
+
+	if retrieveCount < appConfig.PredictiveThreshold {
 		return false
 	}
 
@@ -45,12 +47,14 @@ func (minder CacheMinder) RefreshExpiringCacheItem(q dns.Question, expiring mode
 		servers = append(servers, expiring.Resolver)
 	}
 
-	servers = append(servers, minder.appConfig.GetUpstreamResolvers(q.Name, nil, nil)...)
+	servers = append(servers, appConfig.GetUpstreamResolvers(q.Name, nil, nil)...)
 	resolverConfig := resolver.DnsResolverConfig{
 		Servers:          servers,
 		Metrics:          minder.appState.Metrics,
 		Logger:           minder.appState.Log,
 		DefaultForwarder: minder.appState.DefaultForwarder,
+		Strategy:         appConfig.GetUpstreamStrategy(q.Name, nil, nil),
+		Health:           minder.appState.UpstreamHealth,
 	}
 
 	forwarder := resolver.GetDnsResolver(resolverConfig)
@@ -60,7 +64,7 @@ func (minder CacheMinder) RefreshExpiringCacheItem(q dns.Question, expiring mode
 		minder.appState.Log.Warn("failed to re-run common query", "query", q.Name, "error", err)
 	}
 
-	if (response == nil || err != nil) && minder.appConfig.ResilientCache {
+	if (response == nil || err != nil) && appConfig.ResilientCache {
 		minder.appState.Log.Warn("re-caching last value (resilient cache)", "query", q.Name, "qtype", q.Qtype)
 		minder.appState.Metrics.IncQueriesResilientlyRefreshed()
 		response = &expiring
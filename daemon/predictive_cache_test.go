@@ -35,15 +35,16 @@ func getAppState(cache cache.Cache) *app.AppState {
 }
 
 func waitForConsistency(cache cache.Cache, q dns.Question) (*models.DnsResponse, error) {
-	// this is jank
+	// Refreshed responses are written to the cache by the cache
+	// pipeline's goroutine, which reads the live config first, so
+	// wait a fixed time for them rather than a number of iterations
 	dnsQuery, _ := models.NewDnsQueryFromQuestions([]dns.Question{q})
 	resp, err := cache.QueryDns(*dnsQuery)
-	waited := 0
+	deadline := time.Now().Add(200 * time.Millisecond)
 
-	for resp == nil && err == nil && waited < 1000 {
+	for resp == nil && err == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
 		resp, err = cache.QueryDns(*dnsQuery)
-		time.Sleep(10 * time.Nanosecond)
-		waited += 1
 	}
 
 	return resp, err
@@ -84,11 +85,12 @@ func TestRefreshExpiringCacheItem(t *testing.T) {
 	}
 
 	state := getAppState(cache)
-	cachePipeline := NewCachePipeline(appCfg, state)
+	liveConfig := app.NewLiveConfig("", &appCfg)
+	cachePipeline := NewCachePipeline(liveConfig, state)
 	cachePipelineCancel := cachePipeline.Start()
 	defer cachePipelineCancel()
 
-	minder := NewCacheMinder(&appCfg, *state)
+	minder := NewCacheMinder(liveConfig, *state)
 	minder.RefreshExpiringCacheItem(q, *answer, 0, cache)
 
 	resp, err := waitForConsistency(cache, q)
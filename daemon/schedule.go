@@ -0,0 +1,47 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/thenaterhood/spuddns/app"
+)
+
+// Run a task every interval seconds until the context is done. The
+// interval is read from the running config, so a reload that changes
+// it takes effect without a restart, and an interval below 1 pauses
+// the task until a reload sets one.
+func runEvery(ctx context.Context, config *app.LiveConfig, interval func(*app.AppConfig) int, task func()) {
+	reloaded := make(chan struct{}, 1)
+	config.OnReload(func(previous *app.AppConfig, current *app.AppConfig) {
+		if interval(previous) != interval(current) {
+			select {
+			case reloaded <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	for {
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if seconds := interval(config.Get()); seconds > 0 {
+			timer = time.NewTimer(time.Duration(seconds) * time.Second)
+			tick = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-reloaded:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-tick:
+			task()
+		}
+	}
+}
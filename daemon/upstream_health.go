@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"context"
+
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/resolver"
+)
+
+type UpstreamProber struct {
+	config *app.LiveConfig
+	state  *app.AppState
+}
+
+func NewUpstreamProber(config *app.LiveConfig, state *app.AppState) *UpstreamProber {
+	return &UpstreamProber{
+		config: config,
+		state:  state,
+	}
+}
+
+// Probe every upstream that is currently down, which marks
+// it up again if it answers
+func (p *UpstreamProber) probe() {
+	for _, server := range p.state.UpstreamHealth.Down() {
+		err := resolver.ProbeUpstream(server, resolver.DnsResolverConfig{
+			Logger:  p.state.Log,
+			Metrics: p.state.Metrics,
+			Health:  p.state.UpstreamHealth,
+		})
+		if err != nil {
+			p.state.Log.Debug("upstream resolver is still down", "server", server, "error", err)
+		}
+	}
+}
+
+func (p *UpstreamProber) Start() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if p.state.UpstreamHealth == nil {
+		return cancel
+	}
+
+	// Upstreams a reload removed would otherwise be probed forever
+	p.config.OnReload(func(_ *app.AppConfig, current *app.AppConfig) {
+		p.state.UpstreamHealth.Retain(current.GetAllUpstreamResolvers())
+	})
+
+	go func() {
+		p.state.Log.Debug("upstream prober started")
+		runEvery(ctx, p.config, func(config *app.AppConfig) int { return config.UpstreamProbeInterval }, p.probe)
+		p.state.Log.Debug("upstream prober stopped")
+	}()
+
+	return cancel
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/resolver"
+)
+
+func TestUpstreamProberRecoversUpstream(t *testing.T) {
+	started := sync.Mutex{}
+	started.Lock()
+	server := &dns.Server{
+		Addr:              "127.0.0.1:0",
+		Net:               "udp",
+		NotifyStartedFunc: started.Unlock,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ListenAndServe()
+	started.Lock()
+	defer server.Shutdown()
+
+	upstream := server.PacketConn.LocalAddr().String()
+	unreachable := "udp://127.0.0.1:1"
+
+	state := getAppState(&cache.DummyCache{})
+	state.UpstreamHealth = resolver.NewUpstreamHealth(resolver.UpstreamHealthConfig{
+		Logger:           state.Log,
+		Metrics:          state.Metrics,
+		FailureThreshold: 1,
+	})
+
+	for _, server := range []string{upstream, unreachable} {
+		state.UpstreamHealth.RecordFailure(server, fmt.Errorf("test failure"))
+		if !state.UpstreamHealth.IsDown(server) {
+			t.Fatalf("%s should be down after a failure", server)
+		}
+	}
+
+	config := app.GetDefaultConfig()
+	prober := NewUpstreamProber(app.NewLiveConfig("", &config), state)
+	prober.probe()
+
+	if state.UpstreamHealth.IsDown(upstream) {
+		t.Errorf("reachable upstream should have recovered after a probe")
+	}
+
+	if !state.UpstreamHealth.IsDown(unreachable) {
+		t.Errorf("unreachable upstream should still be down after a probe")
+	}
+}
+
+func TestUpstreamProberForgetsRemovedUpstreams(t *testing.T) {
+	state := getAppState(&cache.DummyCache{})
+	state.UpstreamHealth = resolver.NewUpstreamHealth(resolver.UpstreamHealthConfig{
+		Logger:           state.Log,
+		Metrics:          state.Metrics,
+		FailureThreshold: 1,
+	})
+
+	config := app.GetDefaultConfig()
+	config.UpstreamResolvers = []string{"192.0.2.1", "192.0.2.2"}
+	liveConfig := app.NewLiveConfig("", &config)
+	prober := NewUpstreamProber(liveConfig, state)
+	stop := prober.Start()
+	defer stop()
+
+	for _, server := range config.UpstreamResolvers {
+		state.UpstreamHealth.RecordFailure(server, fmt.Errorf("test failure"))
+	}
+
+	reloaded := app.GetDefaultConfig()
+	reloaded.UpstreamResolvers = []string{"192.0.2.1"}
+	if err := liveConfig.Replace(&reloaded); err != nil {
+		t.Fatalf("unexpected error replacing the config: %v", err)
+	}
+
+	if down := state.UpstreamHealth.Down(); !slices.Equal(down, []string{"192.0.2.1"}) {
+		t.Errorf("expected only the remaining upstream to be down, got %v", down)
+	}
+
+	if _, ok := state.UpstreamHealth.Stats()["192.0.2.2"]; ok {
+		t.Errorf("expected the removed upstream's health to be forgotten")
+	}
+}
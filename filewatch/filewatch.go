@@ -0,0 +1,190 @@
+// Package filewatch keeps data read from files up to date as the
+// files change.
+package filewatch
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the files are checked for changes
+const watchInterval = 5 * time.Second
+
+// What a Reloader reads, for a config of type C, and how
+type Source[C any, T any] struct {
+	// What is read, for logs (e.g. "blocklists")
+	Name   string
+	Logger *slog.Logger
+	// The files that are read for a config
+	Files func(config C) []string
+	// Read the data for a config, returning what could be read along
+	// with an error for the files that couldn't be
+	Read func(config C) (*T, error)
+	// Whether two configs read the same files in the same way
+	Equal func(a C, b C) bool
+	// Called, if set, when data replaces the previous data, which is
+	// nil the first time
+	Loaded func(previous *T, current *T)
+}
+
+// Data read from files, which is read again when the files or the
+// config for them change.
+//
+// The data is replaced as a whole, so it can be used without a lock.
+// If any file can't be read, the data already in use is kept rather
+// than dropping what was read from that file before. At start there is
+// nothing to keep, so whatever could be read is used, rather than one
+// bad file leaving every other one unused.
+type Reloader[C any, T any] struct {
+	data   atomic.Pointer[T]
+	source Source[C, T]
+	config C
+	// Modification times of the files when the data was read
+	modified map[string]time.Time
+	// Modification times of the files when they last failed to be
+	// read, so a failure is only logged once for each change
+	failed map[string]time.Time
+	// Serializes reloads
+	mutex sync.Mutex
+}
+
+func NewReloader[C any, T any](config C, source Source[C, T]) *Reloader[C, T] {
+	reloader := &Reloader[C, T]{source: source, config: config}
+	reloader.modified = reloader.stat(config)
+
+	data, err := source.Read(config)
+	if err != nil {
+		source.Logger.Warn("failed to read "+source.Name+" - continuing without the ones that couldn't be read", "err", err)
+	}
+	reloader.data.Store(data)
+	if source.Loaded != nil {
+		source.Loaded(nil, data)
+	}
+
+	return reloader
+}
+
+// Get the data that was read last
+func (r *Reloader[C, T]) Get() *T {
+	return r.data.Load()
+}
+
+func statModified(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Get the modification times of a config's files. They're taken
+// before the files are read, so a change made while they're being
+// read is picked up by the next check.
+func (r *Reloader[C, T]) stat(config C) map[string]time.Time {
+	modified := map[string]time.Time{}
+	for _, path := range r.source.Files(config) {
+		modified[path] = statModified(path)
+	}
+	return modified
+}
+
+func (r *Reloader[C, T]) reload(config C) error {
+	modified := r.stat(config)
+	data, err := r.source.Read(config)
+	if err != nil {
+		return err
+	}
+
+	r.config = config
+	r.modified = modified
+	r.failed = nil
+	previous := r.data.Swap(data)
+	if r.source.Loaded != nil {
+		r.source.Loaded(previous, data)
+	}
+	return nil
+}
+
+// Read the files again. If any can't be read, the data already in use
+// is kept.
+func (r *Reloader[C, T]) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.reload(r.config)
+}
+
+// Replace the config, reading the files again if it changed. If any
+// can't be read, the previous config and data are kept.
+func (r *Reloader[C, T]) Reconfigure(config C) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.source.Equal(config, r.config) {
+		return nil
+	}
+
+	return r.reload(config)
+}
+
+// Whether any file changed since it was read
+func (r *Reloader[C, T]) changed() bool {
+	for path, modified := range r.modified {
+		if !statModified(path).Equal(modified) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read the files again whenever they change
+func (r *Reloader[C, T]) Watch() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		r.source.Logger.Debug("starting " + r.source.Name + " watch")
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				r.source.Logger.Debug("stopping " + r.source.Name + " watch")
+				return
+			case <-ticker.C:
+				r.check()
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// Read the files again if they changed since they were read or last
+// failed to be read
+func (r *Reloader[C, T]) check() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.changed() {
+		return
+	}
+
+	modified := r.stat(r.config)
+	if maps.EqualFunc(modified, r.failed, time.Time.Equal) {
+		return
+	}
+
+	if err := r.reload(r.config); err != nil {
+		r.source.Logger.Warn("failed to reload "+r.source.Name+" - keeping the previous ones", "err", err)
+		r.failed = modified
+	} else {
+		r.source.Logger.Info("reloaded " + r.source.Name)
+	}
+}
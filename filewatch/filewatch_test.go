@@ -0,0 +1,151 @@
+package filewatch
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thenaterhood/spuddns/internal/testfile"
+)
+
+// Read the contents of every file that can be read
+func readFiles(paths []string) (*[]string, error) {
+	contents := []string{}
+	errs := []error{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		contents = append(contents, strings.TrimSpace(string(data)))
+	}
+	return &contents, errors.Join(errs...)
+}
+
+func getTestReloader(paths ...string) *Reloader[[]string, []string] {
+	return NewReloader(paths, Source[[]string, []string]{
+		Name:   "test files",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Files:  func(paths []string) []string { return paths },
+		Read:   readFiles,
+		Equal:  slices.Equal[[]string],
+	})
+}
+
+func TestReloaderUsesWhatCouldBeReadAtStart(t *testing.T) {
+	dir := t.TempDir()
+	reloader := getTestReloader(testfile.WriteIn(t, dir, "first", "one"), dir+"/missing")
+
+	if data := *reloader.Get(); !slices.Equal(data, []string{"one"}) {
+		t.Errorf("expected the file that could be read, got %v", data)
+	}
+}
+
+func TestReloaderSeesChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := testfile.WriteIn(t, dir, "first", "one")
+	reloader := getTestReloader(path)
+
+	if reloader.changed() {
+		t.Errorf("expected no change before the file is written")
+	}
+
+	testfile.WriteIn(t, dir, "first", "two")
+	// Make sure the change is seen on filesystems with coarse mtimes
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+
+	if !reloader.changed() {
+		t.Fatalf("expected the file to be seen as changed")
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if data := *reloader.Get(); !slices.Equal(data, []string{"two"}) {
+		t.Errorf("expected the changed file to be read, got %v", data)
+	}
+	if reloader.changed() {
+		t.Errorf("expected no change once the file was read again")
+	}
+
+	os.Remove(path)
+	if !reloader.changed() {
+		t.Errorf("expected a removed file to be seen as changed")
+	}
+}
+
+func TestReloaderKeepsDataWhenAFileCantBeRead(t *testing.T) {
+	dir := t.TempDir()
+	first := testfile.WriteIn(t, dir, "first", "one")
+	reloader := getTestReloader(first)
+
+	if err := reloader.Reconfigure([]string{first, dir + "/missing"}); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	if data := *reloader.Get(); !slices.Equal(data, []string{"one"}) {
+		t.Errorf("expected the previous data to be kept, got %v", data)
+	}
+
+	// The previous config is kept too, so it's read on reload
+	testfile.WriteIn(t, dir, "first", "two")
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if data := *reloader.Get(); !slices.Equal(data, []string{"two"}) {
+		t.Errorf("expected the previous config to be read, got %v", data)
+	}
+
+	second := testfile.WriteIn(t, dir, "second", "three")
+	if err := reloader.Reconfigure([]string{first, second}); err != nil {
+		t.Fatalf("unexpected error reconfiguring: %v", err)
+	}
+	if data := *reloader.Get(); !slices.Equal(data, []string{"two", "three"}) {
+		t.Errorf("expected the new config to be read, got %v", data)
+	}
+}
+
+func TestReloaderRetriesFailedReadOnceChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := testfile.WriteIn(t, dir, "first", "one")
+	reads := 0
+	reloader := NewReloader([]string{path}, Source[[]string, []string]{
+		Name:   "test files",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Files:  func(paths []string) []string { return paths },
+		Read: func(paths []string) (*[]string, error) {
+			reads++
+			data, err := readFiles(paths)
+			if err == nil && slices.Contains(*data, "invalid") {
+				err = errors.New("invalid file")
+			}
+			return data, err
+		},
+		Equal: slices.Equal[[]string],
+	})
+
+	touch := func(content string, offset time.Duration) {
+		testfile.WriteIn(t, dir, "first", content)
+		// Make sure the change is seen on filesystems with coarse mtimes
+		future := time.Now().Add(offset)
+		os.Chtimes(path, future, future)
+	}
+
+	touch("invalid", time.Minute)
+	reloader.check()
+	reloader.check()
+	if reads != 2 {
+		t.Errorf("expected a failed file to be read once until it changes, it was read %d times", reads-1)
+	}
+
+	touch("two", 2*time.Minute)
+	reloader.check()
+	if data := *reloader.Get(); reads != 3 || !slices.Equal(data, []string{"two"}) {
+		t.Errorf("expected the file to be read again once it changed, got %v", data)
+	}
+}
@@ -0,0 +1,28 @@
+// Package testfile writes the files that tests read
+package testfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write a file in a temporary directory that is removed when the test
+// finishes, returning its path
+func Write(t testing.TB, name string, data string) string {
+	t.Helper()
+
+	return WriteIn(t, t.TempDir(), name, data)
+}
+
+// Write, or overwrite, a file in a directory, returning its path
+func WriteIn(t testing.TB, dir string, name string, data string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+
+	return path
+}
@@ -0,0 +1,178 @@
+package localzone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/filewatch"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+type ZoneConfig struct {
+	// The name the zone is for
+	Origin string
+	File   string
+}
+
+type LocalZonesConfig struct {
+	Zones  []ZoneConfig
+	Logger *slog.Logger
+}
+
+// The zones that were read
+type zoneSet struct {
+	// Zones by origin
+	zones map[string]*zone
+}
+
+// A part of a local zone that is served by other nameservers
+type Delegation struct {
+	// The name that is delegated
+	Zone        string
+	Nameservers []string
+	// Addresses of the nameservers from the zone's glue records
+	Addresses []string
+}
+
+// Answer authoritatively for zones read from files
+type LocalZones struct {
+	zones  *filewatch.Reloader[[]ZoneConfig, zoneSet]
+	config LocalZonesConfig
+}
+
+func NewLocalZones(config LocalZonesConfig) *LocalZones {
+	localZones := &LocalZones{config: config}
+	localZones.zones = filewatch.NewReloader(config.Zones, filewatch.Source[[]ZoneConfig, zoneSet]{
+		Name:   "local zones",
+		Logger: config.Logger,
+		Files:  zoneFiles,
+		Read:   localZones.read,
+		Equal:  slices.Equal[[]ZoneConfig],
+	})
+
+	return localZones
+}
+
+func zoneFiles(zones []ZoneConfig) []string {
+	files := []string{}
+	for _, zoneConfig := range zones {
+		files = append(files, zoneConfig.File)
+	}
+	return files
+}
+
+// Read every zone, returning the ones that could be read along with
+// an error for the ones that couldn't
+func (l *LocalZones) read(zoneConfigs []ZoneConfig) (*zoneSet, error) {
+	zones := &zoneSet{zones: map[string]*zone{}}
+	errs := []error{}
+
+	for _, zoneConfig := range zoneConfigs {
+		parsed, err := readZone(zoneConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("local zone '%s': %w", zoneConfig.Origin, err))
+			continue
+		}
+
+		l.config.Logger.Info("read local zone", "origin", parsed.origin, "serial", parsed.soa.Serial, "names", len(parsed.records))
+		zones.zones[parsed.origin] = parsed
+	}
+
+	return zones, errors.Join(errs...)
+}
+
+func readZone(config ZoneConfig) (*zone, error) {
+	file, err := os.Open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseZone(file, config.Origin, config.File)
+}
+
+// Re-read the zones. If any can't be read, the zones already in use
+// are kept.
+func (l *LocalZones) Reload() error {
+	return l.zones.Reload()
+}
+
+// Replace the zones that are served, re-reading them if they changed
+func (l *LocalZones) Reconfigure(zones []ZoneConfig) error {
+	return l.zones.Reconfigure(zones)
+}
+
+// Reload the zones whenever their files change
+func (l *LocalZones) Watch() context.CancelFunc {
+	return l.zones.Watch()
+}
+
+// Get the zone a name is in, which is the one with the longest origin
+// when zones are nested
+func (l *LocalZones) find(name string) *zone {
+	zones := l.zones.Get()
+	if zones == nil || len(zones.zones) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for suffix := name; ; {
+		if found, ok := zones.zones[suffix]; ok {
+			return found
+		}
+
+		if suffix == "." {
+			return nil
+		}
+
+		labels := dns.Split(suffix)
+		if len(labels) < 2 {
+			suffix = "."
+		} else {
+			suffix = suffix[labels[1]:]
+		}
+	}
+}
+
+// Get the answer to a question from the zone the name is in. Returns
+// a delegation instead when the name is delegated to other
+// nameservers, and nothing when no zone has the name.
+func (l *LocalZones) Lookup(question dns.Question) (*models.DnsResponse, *Delegation) {
+	found := l.find(question.Name)
+	if found == nil {
+		return nil, nil
+	}
+
+	msg := found.lookup(question)
+
+	if !msg.Authoritative {
+		delegation := &Delegation{Zone: msg.Ns[0].Header().Name}
+		for _, rr := range msg.Ns {
+			delegation.Nameservers = append(delegation.Nameservers, rr.(*dns.NS).Ns)
+		}
+		for _, rr := range msg.Extra {
+			switch glue := rr.(type) {
+			case *dns.A:
+				delegation.Addresses = append(delegation.Addresses, glue.A.String())
+			case *dns.AAAA:
+				delegation.Addresses = append(delegation.Addresses, glue.AAAA.String())
+			}
+		}
+		return nil, delegation
+	}
+
+	response, err := models.NewDnsResponseFromMsg(msg)
+	if err != nil {
+		return models.NewServFailDnsResponse(), nil
+	}
+	response.Authoritative = true
+	response.RecursionAvailable = true
+
+	return response, nil
+}
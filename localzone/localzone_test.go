@@ -0,0 +1,231 @@
+package localzone
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+)
+
+const testZone = `$ORIGIN home.example.
+$TTL 300
+@        IN SOA ns.home.example. hostmaster.home.example. 2024010101 3600 600 86400 60
+@        IN NS  ns.home.example.
+@        IN A   192.0.2.1
+ns       IN A   192.0.2.53
+nas      IN A   192.0.2.10
+nas      IN AAAA 2001:db8::10
+nas      IN TXT "storage"
+files    IN CNAME nas
+docs     IN CNAME files
+web      IN CNAME www.example.net.
+*.apps   IN A   192.0.2.20
+a.b.deep IN A   192.0.2.30
+lab      IN NS  ns1.lab
+ns1.lab  IN A   192.0.2.40
+lab      IN DS  12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+cloud    IN NS  ns.example.net.
+`
+
+func getTestLocalZones(zones ...ZoneConfig) *LocalZones {
+	return NewLocalZones(LocalZonesConfig{
+		Zones:  zones,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+}
+
+func question(name string, qtype uint16) dns.Question {
+	return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	tests := map[string]string{
+		"no SOA":       "$TTL 60\nwww A 192.0.2.1\n",
+		"outside":      "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\nwww.example.org. A 192.0.2.1\n",
+		"two SOAs":     "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\n@ SOA ns. root. 2 1 1 1 1\n",
+		"SOA below":    "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\nwww SOA ns. root. 1 1 1 1 1\n",
+		"CNAME and A":  "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\nwww CNAME x\nwww A 192.0.2.1\n",
+		"syntax error": "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\nwww A not-an-address\n",
+	}
+
+	for description, data := range tests {
+		if _, err := parseZone(strings.NewReader(data), "home.example.", "test.zone"); err == nil {
+			t.Errorf("%s: expected an error", description)
+		}
+	}
+}
+
+func TestLookupAnswersAuthoritatively(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example", File: testfile.Write(t, "home.zone", testZone)})
+
+	response, delegation := zones.Lookup(question("NAS.home.example.", dns.TypeA))
+	if delegation != nil || response == nil {
+		t.Fatalf("expected an answer, got %+v", delegation)
+	}
+	if !response.Authoritative || response.Rcode() != dns.RcodeSuccess {
+		t.Errorf("expected an authoritative answer")
+	}
+	if answers := response.AnswerRRs(); len(answers) != 1 || answers[0].Header().Name != "NAS.home.example." {
+		t.Errorf("expected one A record for the name as asked, got %v", answers)
+	}
+
+	response, _ = zones.Lookup(question("nas.home.example.", dns.TypeANY))
+	if answers := response.AnswerRRs(); len(answers) != 3 {
+		t.Errorf("expected every record for ANY, got %v", answers)
+	}
+
+	if response, _ := zones.Lookup(question("www.example.com.", dns.TypeA)); response != nil {
+		t.Errorf("expected no answer for a name outside the zones")
+	}
+}
+
+func TestLookupNegativeAnswers(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)})
+
+	tests := []struct {
+		question dns.Question
+		rcode    int
+	}{
+		{question("missing.home.example.", dns.TypeA), dns.RcodeNameError},
+		{question("nas.home.example.", dns.TypeMX), dns.RcodeSuccess},
+		// Exists because there's a name under it
+		{question("deep.home.example.", dns.TypeA), dns.RcodeSuccess},
+		{question("b.deep.home.example.", dns.TypeA), dns.RcodeSuccess},
+		{question("c.deep.home.example.", dns.TypeA), dns.RcodeNameError},
+	}
+
+	for _, test := range tests {
+		response, _ := zones.Lookup(test.question)
+		if response == nil || !response.IsNegative() || response.Rcode() != test.rcode {
+			t.Errorf("%s: expected a negative answer with rcode %s", test.question.Name, dns.RcodeToString[test.rcode])
+			continue
+		}
+
+		soa := response.Soa()
+		if soa == nil || soa.Hdr.Name != "home.example." {
+			t.Errorf("%s: expected the zone's SOA, got %v", test.question.Name, soa)
+		} else if soa.Hdr.Ttl != 60 {
+			t.Errorf("%s: expected the SOA minimum as its TTL, got %d", test.question.Name, soa.Hdr.Ttl)
+		}
+	}
+}
+
+func TestLookupWildcards(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)})
+
+	for _, name := range []string{"grafana.apps.home.example.", "a.b.apps.home.example."} {
+		response, _ := zones.Lookup(question(name, dns.TypeA))
+		answers := response.AnswerRRs()
+		if len(answers) != 1 || answers[0].Header().Name != name || answers[0].(*dns.A).A.String() != "192.0.2.20" {
+			t.Errorf("%s: expected the wildcard's address, got %v", name, answers)
+		}
+	}
+
+	if response, _ := zones.Lookup(question("apps.home.example.", dns.TypeA)); !response.IsNegative() {
+		t.Errorf("expected the wildcard not to answer for its parent")
+	}
+	if response, _ := zones.Lookup(question("grafana.apps.home.example.", dns.TypeAAAA)); response.Rcode() != dns.RcodeSuccess || !response.IsNegative() {
+		t.Errorf("expected NODATA for a type the wildcard doesn't have")
+	}
+}
+
+func TestLookupFollowsCnames(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)})
+
+	response, _ := zones.Lookup(question("docs.home.example.", dns.TypeA))
+	answers := response.AnswerRRs()
+	if len(answers) != 3 {
+		t.Fatalf("expected the CNAME chain and the address, got %v", answers)
+	}
+	if a, ok := answers[2].(*dns.A); !ok || a.Hdr.Name != "nas.home.example." {
+		t.Errorf("expected the address of the CNAME target, got %v", answers[2])
+	}
+
+	response, _ = zones.Lookup(question("web.home.example.", dns.TypeA))
+	if answers := response.AnswerRRs(); len(answers) != 1 || answers[0].(*dns.CNAME).Target != "www.example.net." {
+		t.Errorf("expected only the CNAME for a target outside the zone, got %v", answers)
+	}
+
+	response, _ = zones.Lookup(question("files.home.example.", dns.TypeCNAME))
+	if answers := response.AnswerRRs(); len(answers) != 1 {
+		t.Errorf("expected only the CNAME when it was asked for, got %v", answers)
+	}
+}
+
+func TestLookupDelegations(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)})
+
+	response, delegation := zones.Lookup(question("printer.lab.home.example.", dns.TypeA))
+	if response != nil || delegation == nil {
+		t.Fatalf("expected a delegation")
+	}
+	if delegation.Zone != "lab.home.example." || len(delegation.Nameservers) != 1 || delegation.Nameservers[0] != "ns1.lab.home.example." {
+		t.Errorf("unexpected delegation %+v", delegation)
+	}
+	if len(delegation.Addresses) != 1 || delegation.Addresses[0] != "192.0.2.40" {
+		t.Errorf("expected the glue address, got %v", delegation.Addresses)
+	}
+
+	// The parent answers for the DS records at the cut
+	response, delegation = zones.Lookup(question("lab.home.example.", dns.TypeDS))
+	if delegation != nil || response == nil || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected the DS record from the parent zone")
+	}
+
+	_, delegation = zones.Lookup(question("cloud.home.example.", dns.TypeA))
+	if delegation == nil || len(delegation.Addresses) != 0 {
+		t.Errorf("expected a delegation without glue, got %+v", delegation)
+	}
+}
+
+func TestNestedZones(t *testing.T) {
+	inner := testfile.Write(t, "home.zone", "$TTL 60\n@ SOA ns. root. 1 1 1 1 1\nprinter A 192.0.2.99\n")
+	zones := getTestLocalZones(
+		ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)},
+		ZoneConfig{Origin: "lab.home.example.", File: inner},
+	)
+
+	response, delegation := zones.Lookup(question("printer.lab.home.example.", dns.TypeA))
+	if delegation != nil || response == nil || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected the more specific zone to answer")
+	}
+}
+
+func TestReconfigureKeepsZonesWhenInvalid(t *testing.T) {
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: testfile.Write(t, "home.zone", testZone)})
+
+	invalid := testfile.Write(t, "home.zone", "www A 192.0.2.1\n")
+	if err := zones.Reconfigure([]ZoneConfig{{Origin: "home.example.", File: invalid}}); err == nil {
+		t.Errorf("expected an error for a zone without an SOA")
+	}
+	if response, _ := zones.Lookup(question("nas.home.example.", dns.TypeA)); response == nil {
+		t.Errorf("expected the previous zone to be kept")
+	}
+
+	if err := zones.Reconfigure([]ZoneConfig{}); err != nil {
+		t.Errorf("unexpected error removing the zones: %v", err)
+	}
+	if response, _ := zones.Lookup(question("nas.home.example.", dns.TypeA)); response != nil {
+		t.Errorf("expected no answers once the zones are removed")
+	}
+}
+
+func TestReloadPicksUpChanges(t *testing.T) {
+	path := testfile.Write(t, "home.zone", testZone)
+	zones := getTestLocalZones(ZoneConfig{Origin: "home.example.", File: path})
+
+	if err := os.WriteFile(path, []byte(testZone+"new A 192.0.2.77\n"), 0600); err != nil {
+		t.Fatalf("failed to write zone: %v", err)
+	}
+	if err := zones.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+
+	if response, _ := zones.Lookup(question("new.home.example.", dns.TypeA)); response == nil || len(response.AnswerRRs()) != 1 {
+		t.Errorf("expected the new record after reloading")
+	}
+}
@@ -0,0 +1,239 @@
+package localzone
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Longest chain of CNAMEs followed within a zone
+const maxCnameChain = 8
+
+// A zone read from a file
+type zone struct {
+	origin string
+	soa    *dns.SOA
+	// Records by owner name and type
+	records map[string]map[uint16][]dns.RR
+	// Every name in the zone, including names that only exist
+	// because there are names under them (empty non-terminals)
+	names map[string]bool
+	// Names below the apex with NS records, which are delegated
+	// to other nameservers
+	cuts map[string]bool
+}
+
+func (z *zone) add(rr dns.RR) {
+	header := rr.Header()
+	header.Name = strings.ToLower(header.Name)
+	owner := header.Name
+
+	if _, ok := z.records[owner]; !ok {
+		z.records[owner] = map[uint16][]dns.RR{}
+	}
+	z.records[owner][header.Rrtype] = append(z.records[owner][header.Rrtype], rr)
+
+	for name := owner; !z.names[name]; {
+		z.names[name] = true
+		if name == z.origin {
+			break
+		}
+		labels := dns.Split(name)
+		name = name[labels[1]:]
+	}
+
+	if header.Rrtype == dns.TypeNS && owner != z.origin {
+		z.cuts[owner] = true
+	}
+}
+
+// Read a zone in RFC 1035 format
+func parseZone(reader io.Reader, origin string, path string) (*zone, error) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	parser := dns.NewZoneParser(reader, origin, path)
+	parser.SetIncludeAllowed(false)
+
+	parsed := &zone{
+		origin:  origin,
+		records: map[string]map[uint16][]dns.RR{},
+		names:   map[string]bool{},
+		cuts:    map[string]bool{},
+	}
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, owner) {
+			return nil, fmt.Errorf("%s: '%s' is outside the zone %s", path, rr.Header().Name, origin)
+		}
+
+		if soa, ok := rr.(*dns.SOA); ok {
+			if owner != origin {
+				return nil, fmt.Errorf("%s: the SOA must be at the origin %s, not %s", path, origin, soa.Hdr.Name)
+			}
+			if parsed.soa != nil {
+				return nil, fmt.Errorf("%s: the zone has more than one SOA", path)
+			}
+			parsed.soa = soa
+		}
+
+		parsed.add(rr)
+	}
+
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if parsed.soa == nil {
+		return nil, fmt.Errorf("%s: the zone has no SOA", path)
+	}
+
+	for owner, rrsets := range parsed.records {
+		if _, ok := rrsets[dns.TypeCNAME]; ok && len(rrsets) > 1 {
+			return nil, fmt.Errorf("%s: '%s' has a CNAME and other records", path, owner)
+		}
+	}
+
+	return parsed, nil
+}
+
+// Get the SOA for a negative answer, whose TTL is the lower of the
+// SOA's own and its minimum (RFC 2308)
+func (z *zone) negativeSoa() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// Get the delegation at or above a name, if any
+func (z *zone) findCut(name string) string {
+	if len(z.cuts) == 0 {
+		return ""
+	}
+
+	// The cut closest to the apex is the one that applies, since
+	// anything under it is delegated
+	cut := ""
+	for suffix := name; suffix != z.origin; {
+		if z.cuts[suffix] {
+			cut = suffix
+		}
+
+		labels := dns.Split(suffix)
+		if len(labels) < 2 {
+			break
+		}
+		suffix = suffix[labels[1]:]
+	}
+
+	return cut
+}
+
+// Get the wildcard that answers for a name that doesn't exist, which
+// is the one at the closest name that does (RFC 4592)
+func (z *zone) findWildcard(name string) string {
+	for suffix := name; suffix != z.origin; {
+		labels := dns.Split(suffix)
+		if len(labels) < 2 {
+			break
+		}
+		suffix = suffix[labels[1]:]
+
+		if z.names[suffix] {
+			if _, ok := z.records["*."+suffix]; ok {
+				return "*." + suffix
+			}
+			return ""
+		}
+	}
+
+	return ""
+}
+
+// Copy records to answer for a name, which differs from their owner
+// for records from a wildcard
+func answerRecords(records []dns.RR, name string) []dns.RR {
+	answers := []dns.RR{}
+	for _, rr := range records {
+		answer := dns.Copy(rr)
+		answer.Header().Name = name
+		answers = append(answers, answer)
+	}
+	return answers
+}
+
+// Get the glue for the nameservers of a delegation
+func (z *zone) glue(nameservers []dns.RR) []dns.RR {
+	glue := []dns.RR{}
+	for _, rr := range nameservers {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			glue = append(glue, answerRecords(z.records[target][qtype], target)...)
+		}
+	}
+	return glue
+}
+
+// Answer a question for a name in the zone
+func (z *zone) lookup(question dns.Question) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Authoritative = true
+	name := strings.ToLower(question.Name)
+	// Answers are given for the name as it was asked
+	owner := question.Name
+
+	// The parent side of a delegation answers for the DS records
+	// at the cut, and everything else is referred to the child
+	if cut := z.findCut(name); cut != "" && !(cut == name && question.Qtype == dns.TypeDS) {
+		msg.Authoritative = false
+		msg.Ns = answerRecords(z.records[cut][dns.TypeNS], cut)
+		msg.Extra = z.glue(msg.Ns)
+		return msg
+	}
+
+	for range maxCnameChain {
+		rrsets, exists := z.records[name]
+		if !exists && !z.names[name] {
+			wildcard := z.findWildcard(name)
+			if wildcard == "" {
+				msg.Rcode = dns.RcodeNameError
+				msg.Ns = []dns.RR{z.negativeSoa()}
+				return msg
+			}
+			rrsets = z.records[wildcard]
+		}
+
+		records := rrsets[question.Qtype]
+		if question.Qtype == dns.TypeANY {
+			records = []dns.RR{}
+			for _, rrset := range rrsets {
+				records = append(records, rrset...)
+			}
+		}
+		if len(records) > 0 {
+			msg.Answer = append(msg.Answer, answerRecords(records, owner)...)
+			return msg
+		}
+
+		cnames, ok := rrsets[dns.TypeCNAME]
+		if !ok || question.Qtype == dns.TypeCNAME {
+			msg.Ns = []dns.RR{z.negativeSoa()}
+			return msg
+		}
+
+		cname := answerRecords(cnames[:1], owner)[0].(*dns.CNAME)
+		msg.Answer = append(msg.Answer, cname)
+
+		// Targets outside the zone, or delegated from it, are left
+		// for the resolver to follow
+		target := strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, target) || z.findCut(target) != "" {
+			return msg
+		}
+		name = target
+		owner = cname.Target
+	}
+
+	return msg
+}
@@ -1,114 +1,168 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log/slog"
+	"io"
 	"os"
-	"syscall"
+	"runtime"
+	"runtime/debug"
+	"strings"
 
 	"github.com/thenaterhood/spuddns/app"
-	"github.com/thenaterhood/spuddns/cache"
-	"github.com/thenaterhood/spuddns/daemon"
-	"github.com/thenaterhood/spuddns/metrics"
-	"github.com/thenaterhood/spuddns/server"
-	"github.com/thenaterhood/spuddns/system"
 )
 
-func dropPrivileges(uid, gid int) error {
-	if err := syscall.Setgid(gid); err != nil {
-		return err
-	}
-	if err := syscall.Setuid(uid); err != nil {
-		return err
-	}
-	return nil
+// Used by commands that read the config when none is given
+const defaultConfigFile = "./spuddns.json"
+
+// Set at build time with -ldflags "-X main.version=...". If it isn't,
+// the version is taken from the build info.
+var version = ""
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, `usage: spuddns [command] [arguments]
+
+commands:
+  serve [config]                 run the server (the default)
+  check-config [config]          check a config file and exit
+  query <name> [type] [--server upstream] [--client-id id] [--config config]
+                                 resolve a name as the server would and print the answer
+  cache dump <file>              print the entries in a persisted cache file
+  cache stats <file>             summarize a persisted cache file
+  cache load <file> [--config config]
+                                 check which entries the server would load from a persisted cache file
+  version                        print the version
+
+The config defaults to ./spuddns.json.
+`)
 }
 
-func main() {
-	conffile := "./spuddns.json"
-	args := os.Args
+// Parse flags that may come before, after or between the
+// positional arguments, returning the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
 
-	if len(args) > 1 {
-		conffile = args[1]
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
+}
 
-	config, err := app.GetConfig(conffile)
-	if err != nil {
-		fmt.Printf("config %s not loaded - starting with defaults: %v", conffile, err)
+func getVersion() string {
+	if version != "" {
+		return version
 	}
 
-	stdoutLogger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: slog.Level(config.LogLevel),
-	}))
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
 
-	if len(config.UpstreamResolvers) < 1 {
-		stdoutLogger.Warn("no upstream resolvers are configured!")
+	// Builds from a module or a git checkout have a version, while
+	// other builds may only have the revision they were built from
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
 	}
 
-	metrics := metrics.GetMetrics(metrics.MetricsConfig{
-		Enable: !config.DisableMetrics,
-		Logger: stdoutLogger,
-	})
-
-	cache, cacheErr := cache.GetCache(cache.CacheConfig{
-		Logger:  stdoutLogger,
-		Metrics: metrics,
-		Enable:  !config.DisableCache,
-	})
-	if cacheErr != nil {
-		stdoutLogger.Warn("failed to initialize cache - disabling caching", "err", cacheErr)
+	current := "devel"
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			current = fmt.Sprintf("%s-%.12s", current, setting.Value)
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
 	}
 
-	state := app.AppState{
-		Cache:   cache,
-		Log:     stdoutLogger,
-		Metrics: metrics,
+	if modified {
+		current += "-modified"
 	}
 
-	if !config.DisableCache {
-		if config.PredictiveCache || config.ResilientCache {
-			cacheMinder := daemon.NewCacheMinder(config, state)
-			state.Cache.SetExpireCallback(cacheMinder.RefreshExpiringCacheItem)
-		}
-		cachePipeline := daemon.NewCachePipeline(*config, &state)
-		cachePipelineCancel := cachePipeline.Start()
-		defer cachePipelineCancel()
+	return current
+}
+
+// Check a config file, printing any problems with it, and return
+// the exit status
+func checkConfig(conffile string, stdout io.Writer, stderr io.Writer) int {
+	if _, err := os.Stat(conffile); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
 	}
 
-	if config.RespectResolveConf {
-		resolvconf, err := system.NewResolvConfFromPath(config.ResolvConfPath, state.Log)
-		if err != nil {
-			state.Log.Warn("failed to read resolvconf on start - will retry", "error", err)
-		}
+	config, err := app.ReadConfig(conffile)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%v\n", conffile, err)
+		return 1
+	}
 
-		if resolvconf != nil {
-			config.ResolvConf = resolvconf
-			resolvConfCancel := resolvconf.Watch()
-			defer resolvConfCancel()
-		}
+	for _, deprecation := range config.Deprecations() {
+		fmt.Fprintf(stderr, "warning: %s\n", deprecation)
 	}
 
-	config.EtcHosts = system.NewEtcHosts(state.Log)
+	fmt.Fprintf(stdout, "%s is valid\n", conffile)
+	return 0
+}
 
-	if config.PersistentCacheFile != "" {
-		persistentCache := daemon.NewPersistentCache(*config, &state)
-		persistentCacheCancel := persistentCache.Start()
-		defer persistentCacheCancel()
+// Get the optional config file argument of a command
+func configArg(args []string) (string, bool) {
+	switch len(args) {
+	case 0:
+		return defaultConfigFile, true
+	case 1:
+		return args[0], true
+	default:
+		return "", false
 	}
+}
 
-	metricsErr := state.Metrics.Start()
-	if metricsErr != nil {
-		state.Log.Warn("failed to start metrics", "err", metricsErr)
+// Run a command, returning the exit status
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		return serve(defaultConfigFile)
 	}
 
-	dnsServer := server.NewDnsServer(*config, state)
-	dnsServer.Start()
+	switch args[0] {
+	case "serve", "check-config":
+		conffile, ok := configArg(args[1:])
+		if !ok {
+			printUsage(stderr)
+			return 2
+		}
+		if args[0] == "serve" {
+			return serve(conffile)
+		}
+		return checkConfig(conffile, stdout, stderr)
+	case "query":
+		return query(args[1:], stdout, stderr)
+	case "cache":
+		return cacheCommand(args[1:], stdout, stderr)
+	case "version":
+		fmt.Fprintf(stdout, "spuddns %s %s\n", getVersion(), runtime.Version())
+		return 0
+	case "help", "-h", "-help", "--help":
+		printUsage(stdout)
+		return 0
+	default:
+		if len(args) > 1 || args[0] == "" || strings.HasPrefix(args[0], "-") {
+			printUsage(stderr)
+			return 2
+		}
 
-	if err := dropPrivileges(65534, 65534); err != nil {
-		state.Log.Warn("failed to drop privileges after initialization", "err", err)
-	} else {
-		state.Log.Debug("successfully dropped privileges after initialization")
+		// Older versions took the config file as the only argument
+		return serve(args[0])
 	}
+}
 
-	select {}
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+func TestParseArgsAllowsInterspersedFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	server := flags.String("server", "", "")
+	clientId := flags.String("client-id", "", "")
+
+	positional, err := parseArgs(flags, []string{"example.com", "--server", "127.0.0.1", "AAAA", "--client-id=abc"})
+	if err != nil {
+		t.Fatalf("unexpected error parsing args: %v", err)
+	}
+
+	if !slices.Equal(positional, []string{"example.com", "AAAA"}) {
+		t.Errorf("unexpected positional args %v", positional)
+	}
+	if *server != "127.0.0.1" || *clientId != "abc" {
+		t.Errorf("flags were not parsed, got server '%s' and client id '%s'", *server, *clientId)
+	}
+}
+
+func TestRunRejectsUnknownArguments(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	if status := run([]string{"--verbose"}, &stdout, &stderr); status != 2 {
+		t.Errorf("expected an unknown flag to be rejected, got %d", status)
+	}
+	if status := run([]string{"cache", "inspect", "file"}, &stdout, &stderr); status != 2 {
+		t.Errorf("expected an unknown cache command to be rejected, got %d", status)
+	}
+	if !strings.Contains(stderr.String(), "usage: spuddns") {
+		t.Errorf("expected usage to be printed, got %s", stderr.String())
+	}
+}
+
+func TestRunPrintsVersion(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	if status := run([]string{"version"}, &stdout, &stderr); status != 0 {
+		t.Errorf("version failed with %d", status)
+	}
+	if !strings.HasPrefix(stdout.String(), "spuddns ") {
+		t.Errorf("unexpected version output %s", stdout.String())
+	}
+}
+
+func TestQueryResolvesThroughServer(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	upstream := &dns.Server{
+		PacketConn: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.7")
+			reply.Answer = append(reply.Answer, rr)
+			w.WriteMsg(reply)
+		}),
+	}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	conffile := filepath.Join(t.TempDir(), "spuddns.json")
+	if err := os.WriteFile(conffile, []byte(`{"mdns_enable": false, "respect_resolvconf": false}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	status := query([]string{"www.example.com", "--server", listener.LocalAddr().String(), "--config", conffile}, &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("query failed with %d: %s", status, stderr.String())
+	}
+
+	if !strings.Contains(stdout.String(), "192.0.2.7") {
+		t.Errorf("expected the answer to be printed, got %s", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), ";; RESOLVER: "+listener.LocalAddr().String()) {
+		t.Errorf("expected the resolver to be printed, got %s", stdout.String())
+	}
+}
+
+func writeTestCacheFile(t *testing.T) string {
+	t.Helper()
+
+	spudcache, err := cache.GetCache(cache.CacheConfig{
+		Enable:  true,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: metrics.DummyMetrics{},
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	for name, ttl := range map[string]time.Duration{"fresh.example.com.": 300 * time.Second, "stale.example.com.": 2 * time.Second} {
+		response, err := models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{
+			{Name: name, Type: dns.TypeA, TTL: ttl, Data: "192.0.2.1"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+		}
+		if ttl < 5*time.Second {
+			response.Expires = time.Now().Add(-time.Hour)
+		}
+		if err := spudcache.CacheDnsResponse(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, *response); err != nil {
+			t.Fatalf("cache set errored: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := spudcache.Persist(path); err != nil {
+		t.Fatalf("persisting the cache errored: %v", err)
+	}
+
+	return path
+}
+
+func TestCacheCommandDumpsAndSummarizesFile(t *testing.T) {
+	path := writeTestCacheFile(t)
+	var stdout, stderr bytes.Buffer
+
+	if status := run([]string{"cache", "dump", path}, &stdout, &stderr); status != 0 {
+		t.Fatalf("cache dump failed with %d: %s", status, stderr.String())
+	}
+	dump := stdout.String()
+	if !strings.Contains(dump, ";; fresh.example.com. A NOERROR, expires in") ||
+		!strings.Contains(dump, ";; stale.example.com. A NOERROR, expired") ||
+		!strings.Contains(dump, "192.0.2.1") {
+		t.Errorf("unexpected dump %s", dump)
+	}
+
+	stdout.Reset()
+	if status := run([]string{"cache", "stats", path}, &stdout, &stderr); status != 0 {
+		t.Fatalf("cache stats failed with %d: %s", status, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "entries: 2\n") || !strings.Contains(stdout.String(), "expired: 1\n") {
+		t.Errorf("unexpected stats %s", stdout.String())
+	}
+
+	conffile := filepath.Join(t.TempDir(), "spuddns.json")
+	if err := os.WriteFile(conffile, []byte(`{"serve_stale": false}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	stdout.Reset()
+	if status := run([]string{"cache", "load", path, "--config", conffile}, &stdout, &stderr); status != 0 {
+		t.Fatalf("cache load failed with %d: %s", status, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "1 of 2 entries would be loaded") {
+		t.Errorf("expected the expired entry to be skipped, got %s", stdout.String())
+	}
+}
+
+func TestCacheCommandRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	if err := os.WriteFile(path, []byte("spudcach garbage"), 0600); err != nil {
+		t.Fatalf("failed to write cache file: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"cache", "stats", path}, &stdout, &stderr); status != 1 {
+		t.Errorf("expected a corrupt file to fail, got %d", status)
+	}
+	if !strings.Contains(stderr.String(), "corrupt") {
+		t.Errorf("expected the file to be reported as corrupt, got %s", stderr.String())
+	}
+}
@@ -9,6 +9,20 @@ func (ds DummyMetrics) IncQueriesAnsweredFromCache()         {}
 func (ds DummyMetrics) IncQueriesFailed()                    {}
 func (ds DummyMetrics) IncQueriesPredictivelyRefreshed()     {}
 func (ds DummyMetrics) IncQueriesResilientlyRefreshed()      {}
+func (ds DummyMetrics) IncQueriesAnsweredStale()             {}
+func (ds DummyMetrics) IncQueriesAnsweredNegativeFromCache() {}
+func (ds DummyMetrics) IncQueriesCoalesced()                 {}
+func (ds DummyMetrics) IncUpstreamResult(string, bool)       {}
+func (ds DummyMetrics) SetUpstreamUp(string, bool)           {}
+func (ds DummyMetrics) IncCacheEvictions()                   {}
+func (ds DummyMetrics) SetCacheEntries(int)                  {}
+func (ds DummyMetrics) SetCacheBytes(int)                    {}
+func (ds DummyMetrics) IncQueriesBlocked(string)             {}
+func (ds DummyMetrics) SetBlocklistEntries(string, int)      {}
+func (ds DummyMetrics) DeleteBlocklistEntries(string)        {}
+func (ds DummyMetrics) IncRpzHits(string, string, string)    {}
+func (ds DummyMetrics) SetRpzRules(string, int)              {}
+func (ds DummyMetrics) DeleteRpzRules(string)                {}
 func (ds DummyMetrics) GetCacheReadTimer() *prometheus.Timer { return nil }
 func (ds DummyMetrics) GetForwardTimer() *prometheus.Timer   { return nil }
 func (ds DummyMetrics) GetResponseTimer() *prometheus.Timer  { return nil }
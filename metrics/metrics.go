@@ -17,6 +17,20 @@ type MetricsInterface interface {
 	IncQueriesFailed()
 	IncQueriesPredictivelyRefreshed()
 	IncQueriesResilientlyRefreshed()
+	IncQueriesAnsweredStale()
+	IncQueriesAnsweredNegativeFromCache()
+	IncQueriesCoalesced()
+	IncUpstreamResult(server string, success bool)
+	SetUpstreamUp(server string, up bool)
+	IncCacheEvictions()
+	SetCacheEntries(count int)
+	SetCacheBytes(bytes int)
+	IncQueriesBlocked(list string)
+	SetBlocklistEntries(list string, count int)
+	DeleteBlocklistEntries(list string)
+	IncRpzHits(zone string, trigger string, action string)
+	SetRpzRules(zone string, count int)
+	DeleteRpzRules(zone string)
 	GetCacheReadTimer() *prometheus.Timer
 	GetForwardTimer() *prometheus.Timer
 	GetResponseTimer() *prometheus.Timer
@@ -14,7 +14,19 @@ type PrometheusMetrics struct {
 	queriesFailed               prometheus.Counter
 	queriesPredictiveRefreshed  prometheus.Counter
 	queriesResilientlyRefreshed prometheus.Counter
+	queriesAnsweredStale        prometheus.Counter
+	queriesAnsweredNegative     prometheus.Counter
+	queriesCoalesced            prometheus.Counter
 	queryResponseTime           prometheus.HistogramVec
+	upstreamResults             *prometheus.CounterVec
+	upstreamUp                  *prometheus.GaugeVec
+	cacheEvictions              prometheus.Counter
+	cacheEntries                prometheus.Gauge
+	cacheBytes                  prometheus.Gauge
+	queriesBlocked              *prometheus.CounterVec
+	blocklistEntries            *prometheus.GaugeVec
+	rpzHits                     *prometheus.CounterVec
+	rpzRules                    *prometheus.GaugeVec
 
 	config MetricsConfig
 }
@@ -39,6 +51,70 @@ func (ms PrometheusMetrics) IncQueriesResilientlyRefreshed() {
 	ms.queriesResilientlyRefreshed.Inc()
 }
 
+func (ms PrometheusMetrics) IncQueriesAnsweredStale() {
+	ms.queriesAnsweredStale.Inc()
+}
+
+func (ms PrometheusMetrics) IncQueriesAnsweredNegativeFromCache() {
+	ms.queriesAnsweredNegative.Inc()
+}
+
+func (ms PrometheusMetrics) IncQueriesCoalesced() {
+	ms.queriesCoalesced.Inc()
+}
+
+func (ms PrometheusMetrics) IncUpstreamResult(server string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	ms.upstreamResults.WithLabelValues(server, result).Inc()
+}
+
+func (ms PrometheusMetrics) SetUpstreamUp(server string, up bool) {
+	value := 0.0
+	if up {
+		value = 1
+	}
+	ms.upstreamUp.WithLabelValues(server).Set(value)
+}
+
+func (ms PrometheusMetrics) IncCacheEvictions() {
+	ms.cacheEvictions.Inc()
+}
+
+func (ms PrometheusMetrics) SetCacheEntries(count int) {
+	ms.cacheEntries.Set(float64(count))
+}
+
+func (ms PrometheusMetrics) SetCacheBytes(bytes int) {
+	ms.cacheBytes.Set(float64(bytes))
+}
+
+func (ms PrometheusMetrics) IncQueriesBlocked(list string) {
+	ms.queriesBlocked.WithLabelValues(list).Inc()
+}
+
+func (ms PrometheusMetrics) SetBlocklistEntries(list string, count int) {
+	ms.blocklistEntries.WithLabelValues(list).Set(float64(count))
+}
+
+func (ms PrometheusMetrics) DeleteBlocklistEntries(list string) {
+	ms.blocklistEntries.DeleteLabelValues(list)
+}
+
+func (ms PrometheusMetrics) IncRpzHits(zone string, trigger string, action string) {
+	ms.rpzHits.WithLabelValues(zone, trigger, action).Inc()
+}
+
+func (ms PrometheusMetrics) SetRpzRules(zone string, count int) {
+	ms.rpzRules.WithLabelValues(zone).Set(float64(count))
+}
+
+func (ms PrometheusMetrics) DeleteRpzRules(zone string) {
+	ms.rpzRules.DeleteLabelValues(zone)
+}
+
 func (ms PrometheusMetrics) GetCacheReadTimer() *prometheus.Timer {
 	return prometheus.NewTimer(ms.queryResponseTime.WithLabelValues("cache_read"))
 }
@@ -97,6 +173,54 @@ func newPrometheus(config MetricsConfig) PrometheusMetrics {
 			Name: "spuddns_queries_resilient_refresh",
 			Help: "The number of queries held in cache due to a resolution failure",
 		}),
+		queriesAnsweredStale: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "spuddns_queries_answered_stale",
+			Help: "The number of queries answered with an expired cache entry because upstream resolution failed",
+		}),
+		queriesAnsweredNegative: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "spuddns_queries_answered_negative_from_cache",
+			Help: "The number of queries answered with a cached NXDOMAIN or NODATA",
+		}),
+		queriesCoalesced: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "spuddns_queries_coalesced",
+			Help: "The number of queries answered by sharing an identical query already in flight",
+		}),
+		upstreamResults: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "spuddns_upstream_queries",
+			Help: "The number of queries sent to each upstream resolver, by result",
+		}, []string{"server", "result"}),
+		upstreamUp: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spuddns_upstream_up",
+			Help: "Whether each upstream resolver is considered up (1) or down (0)",
+		}, []string{"server"}),
+		cacheEvictions: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "spuddns_cache_evictions",
+			Help: "The number of cache entries evicted because the cache was full",
+		}),
+		cacheEntries: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "spuddns_cache_entries",
+			Help: "The number of entries in the cache",
+		}),
+		cacheBytes: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "spuddns_cache_bytes",
+			Help: "The approximate size, in bytes, of the entries in the cache",
+		}),
+		queriesBlocked: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "spuddns_queries_blocked",
+			Help: "The number of queries answered with a blocked response, by the list that blocked them",
+		}, []string{"list"}),
+		blocklistEntries: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spuddns_blocklist_entries",
+			Help: "The number of names read from each blocklist",
+		}, []string{"list"}),
+		rpzHits: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "spuddns_rpz_hits",
+			Help: "The number of queries that matched a response policy, by zone, trigger and action",
+		}, []string{"zone", "trigger", "action"}),
+		rpzRules: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spuddns_rpz_rules",
+			Help: "The number of triggers read from each response policy zone",
+		}, []string{"zone"}),
 		config: config,
 	}
 }
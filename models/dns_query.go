@@ -222,60 +222,77 @@ func (d DnsQuery) ResolveWithAsync(resolvCtx context.Context, client DnsQueryCli
 	return respChan, errChan
 }
 
-func (d DnsQuery) ResolveWith(client DnsQueryClient, resolvCtx context.Context) (*DnsResponse, error) {
+// Resolve each question in the query with the client and combine
+// the answers. Returns nil if any question could not be answered,
+// unless there's only one question and it had a negative answer.
+func (d DnsQuery) resolve(client DnsQueryClient) (*DnsResponse, error) {
+	combined := new(dns.Msg)
+	combined.Rcode = dns.RcodeSuccess
+	fromCache := false
+	server := ""
+
+	switch d.msg.Opcode {
+	case dns.OpcodeQuery:
+		questions := d.Decompose()
+		for _, questionQuery := range questions {
+			answer, err := client.QueryDns(questionQuery)
+
+			if err != nil {
+				return nil, err
+			}
 
-	respChan := make(chan *DnsResponse, 1)
-	errChan := make(chan error, 1)
+			if answer == nil {
+				return nil, nil
+			}
 
-	go func() {
-		answers := []DNSAnswer{}
-		fromCache := false
-		server := ""
-
-		switch d.msg.Opcode {
-		case dns.OpcodeQuery:
-			for _, questionQuery := range d.Decompose() {
-				answer, err := client.QueryDns(questionQuery)
-
-				if err != nil {
-					errChan <- err
-					break
-				}
+			if len(questions) == 1 && (answer.IsSuccess() || answer.IsNegative()) {
+				// Passed on as-is so the complete message is kept
+				return answer, nil
+			}
 
-				if answer == nil {
-					respChan <- nil
-					break
-				}
+			if !answer.IsSuccess() || answer.msg == nil {
+				return nil, nil
+			}
 
-				if !answer.IsSuccess() {
-					respChan <- nil
-					break
+			combined.Answer = append(combined.Answer, answer.msg.Answer...)
+			combined.Ns = append(combined.Ns, answer.msg.Ns...)
+			for _, rr := range answer.msg.Extra {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					combined.Extra = append(combined.Extra, rr)
 				}
+			}
 
-				decomposedAnswers, err := answer.Answers()
-				if err != nil {
-					errChan <- err
-					break
-				}
+			fromCache = cmp.Or(fromCache, answer.FromCache)
+			server = cmp.Or(server, answer.Resolver)
+		}
+	default:
+		return nil, InvalidQuery{fmt.Sprintf("unsupported opcode '%d'", d.msg.Opcode)}
+	}
+
+	response, err := NewDnsResponseFromMsg(combined)
+	if err != nil {
+		return nil, err
+	}
 
-				answers = append(answers, decomposedAnswers...)
+	response.FromCache = fromCache
+	response.Resolver = server
 
-				fromCache = cmp.Or(fromCache, answer.FromCache)
-				server = cmp.Or(server, answer.Resolver)
-			}
-		default:
-			errChan <- InvalidQuery{fmt.Sprintf("unsupported opcode '%d'", d.msg.Opcode)}
-		}
+	return response, nil
+}
+
+func (d DnsQuery) ResolveWith(client DnsQueryClient, resolvCtx context.Context) (*DnsResponse, error) {
 
-		response, err := NewDnsResponseFromDnsAnswers(answers)
+	respChan := make(chan *DnsResponse, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		response, err := d.resolve(client)
 		if err != nil {
 			errChan <- err
-		} else {
-			response.FromCache = fromCache
-			response.Resolver = server
-
-			respChan <- response
+			return
 		}
+
+		respChan <- response
 	}()
 
 	select {
@@ -36,6 +36,20 @@ type DnsResponse struct {
 	FromCache          bool
 	Resolver           string
 	RecursionAvailable bool
+	// The response is an expired cache entry served because
+	// upstream resolution failed (RFC 8767)
+	Stale bool
+	// The response was made up because the name is on a blocklist
+	// or matched a response policy
+	Blocked bool
+	// No answer should be sent to the client at all
+	Dropped bool
+	// The response comes from a zone this server is authoritative
+	// for
+	Authoritative bool
+	// When the record TTLs in msg were given, so they can count
+	// down from then
+	received time.Time
 }
 
 func NewDnsResponseFromMsg(msg *dns.Msg) (*DnsResponse, error) {
@@ -43,7 +57,8 @@ func NewDnsResponseFromMsg(msg *dns.Msg) (*DnsResponse, error) {
 		msg = new(dns.Msg)
 	}
 	response := DnsResponse{
-		msg: msg.Copy(),
+		msg:      msg.Copy(),
+		received: time.Now(),
 	}
 
 	if _, err := response.msg.Pack(); err != nil {
@@ -63,7 +78,15 @@ func NewDnsResponseFromBytes(msg []byte) (*DnsResponse, error) {
 		return nil, err
 	}
 
-	return NewDnsResponseFromMsg(dnsReq)
+	// The message was just unpacked, so it's already valid
+	// and doesn't need to be copied
+	response := DnsResponse{
+		msg:      dnsReq,
+		received: time.Now(),
+	}
+	response.Expires = time.Now().Add(response.GetTtl())
+
+	return &response, nil
 }
 
 func NewDnsResponseFromDnsAnswers(answers []DNSAnswer) (*DnsResponse, error) {
@@ -81,6 +104,18 @@ func NewDnsResponseFromDnsAnswers(answers []DNSAnswer) (*DnsResponse, error) {
 	return NewDnsResponseFromMsg(msg)
 }
 
+// Construct a negative (NXDOMAIN or NODATA) response carrying the
+// zone's SOA in the authority section, as cached per RFC 2308
+func NewNegativeDnsResponse(rcode int, soa dns.RR) (*DnsResponse, error) {
+	msg := new(dns.Msg)
+	msg.Rcode = rcode
+	if soa != nil {
+		msg.Ns = []dns.RR{soa}
+	}
+
+	return NewDnsResponseFromMsg(msg)
+}
+
 func NewServFailDnsResponse() *DnsResponse {
 	msg := new(dns.Msg)
 	msg.Rcode = dns.RcodeServerFailure
@@ -150,12 +185,7 @@ func (d *DnsResponse) ChangeNameFrom(original string, to string, ttl time.Durati
 	}
 
 	for _, rr := range d.msg.Answer {
-		answer, err := NewDnsAnswerFromRR(rr)
-		if err != nil {
-			continue
-		}
-
-		if answer.Type == cname.Type && answer.Data == cname.Data {
+		if existing, ok := rr.(*dns.CNAME); ok && existing.Target == cname.Data {
 			// Already exists, don't add it again
 			return
 		}
@@ -172,13 +202,10 @@ func (d *DnsResponse) ChangeName(name string) {
 	 */
 	if d.msg != nil {
 		if len(d.msg.Answer) > 0 {
-			firstAnswer, err := NewDnsAnswerFromRR(d.msg.Answer[0])
-			if err != nil {
-				return
-			}
+			firstAnswer := d.msg.Answer[0].Header()
 
-			if firstAnswer.Name != name && firstAnswer.Type != dns.TypeCNAME {
-				d.ChangeNameFrom(name, firstAnswer.Name, firstAnswer.TTL)
+			if firstAnswer.Name != name && firstAnswer.Rrtype != dns.TypeCNAME {
+				d.ChangeNameFrom(name, firstAnswer.Name, time.Duration(firstAnswer.Ttl)*time.Second)
 			}
 		}
 	}
@@ -217,6 +244,37 @@ func (d DnsResponse) IsSuccess() bool {
 	return d.msg.Rcode == dns.RcodeSuccess
 }
 
+// Whether the response is a negative answer: the name doesn't exist
+// (NXDOMAIN) or has no records of the requested type (NODATA)
+func (d DnsResponse) IsNegative() bool {
+	if d.msg == nil {
+		return false
+	}
+	return d.msg.Rcode == dns.RcodeNameError || (d.msg.Rcode == dns.RcodeSuccess && len(d.msg.Answer) == 0)
+}
+
+func (d DnsResponse) Rcode() int {
+	if d.msg == nil {
+		return dns.RcodeServerFailure
+	}
+	return d.msg.Rcode
+}
+
+// Get the SOA from the authority section, if there is one
+func (d DnsResponse) Soa() *dns.SOA {
+	if d.msg == nil {
+		return nil
+	}
+
+	for _, rr := range d.msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+
+	return nil
+}
+
 func (d DnsResponse) GetTtl() time.Duration {
 	// This isn't strictly correct because each answer
 	// has its own TTL, but DNS typically only has one answer
@@ -227,6 +285,11 @@ func (d DnsResponse) GetTtl() time.Duration {
 	}
 
 	if d.IsEmpty() {
+		// Negative answers are cached for the lesser of the SOA's
+		// TTL and its minimum field (RFC 2308 section 5)
+		if soa := d.Soa(); soa != nil {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
 		return 0
 	}
 
@@ -238,36 +301,99 @@ func (d DnsResponse) GetTtl() time.Duration {
 	return time.Duration(slices.Min(ttls)) * time.Second
 }
 
+// Set the TTL of the response. Records with a longer TTL keep it
+// when the TTL is raised, and ones with a shorter TTL keep theirs
+// when it's lowered, so a CNAME doesn't expire with its target.
 func (d *DnsResponse) SetTtl(ttl time.Duration) {
-	d.Expires = time.Now().Add(ttl)
-	d.bumpAnswerTTLs()
-}
+	raise := ttl >= d.GetTtl()
+	now := time.Now()
+	d.Expires = now.Add(ttl)
 
-func (d *DnsResponse) bumpAnswerTTLs() {
-	ttl := d.GetTtl()
-	answers := []dns.RR{}
-
-	if d.msg != nil {
-		for _, a := range d.msg.Answer {
+	if d.msg == nil {
+		return
+	}
 
-			dnsAnswer, err := NewDnsAnswerFromRR(a)
-			if err != nil {
+	d.age(now)
+	bound := uint32(max(ttl, 0) / time.Second)
+	for _, section := range [][]dns.RR{d.msg.Answer, d.msg.Ns, d.msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
 				continue
 			}
+			if raise {
+				rr.Header().Ttl = max(rr.Header().Ttl, bound)
+			} else {
+				rr.Header().Ttl = min(rr.Header().Ttl, bound)
+			}
+		}
+	}
+}
 
-			dnsAnswer.TTL = ttl
+// When the record TTLs were given
+func (d DnsResponse) Received() time.Time {
+	return d.received
+}
 
-			rr, err := dnsAnswer.ToRR()
-			if err != nil {
-				continue
-			}
+// Count the record TTLs down by the time since they were received,
+// for a response read back from storage
+func (d *DnsResponse) CountDownFrom(received time.Time) {
+	d.received = received
+	d.age(time.Now())
+}
 
-			answers = append(answers, rr)
+// Count the TTL of every record down to now, so cached answers
+// count down as they age
+func (d *DnsResponse) age(now time.Time) {
+	if d.msg == nil || d.received.IsZero() {
+		return
+	}
+
+	elapsed := uint32(max(now.Sub(d.received), 0) / time.Second)
+
+	aged := func(records []dns.RR) []dns.RR {
+		copied := make([]dns.RR, 0, len(records))
+		for _, rr := range records {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr = dns.Copy(rr)
+				rr.Header().Ttl -= min(rr.Header().Ttl, elapsed)
+			}
+			copied = append(copied, rr)
 		}
+		return copied
 	}
-	d.msg.Answer = answers
+
+	d.msg.Answer = aged(d.msg.Answer)
+	d.msg.Ns = aged(d.msg.Ns)
+	d.msg.Extra = aged(d.msg.Extra)
+	// Only whole seconds are counted, so the rest isn't lost
+	d.received = d.received.Add(time.Duration(elapsed) * time.Second)
 }
 
+// Get the complete response in wire format
+func (d DnsResponse) Pack() ([]byte, error) {
+	if d.msg == nil {
+		return nil, fmt.Errorf("response has no message")
+	}
+	return d.msg.Pack()
+}
+
+// Get a copy of the records in the answer section
+func (d DnsResponse) AnswerRRs() []dns.RR {
+	answers := []dns.RR{}
+	if d.msg == nil {
+		return answers
+	}
+
+	for _, rr := range d.msg.Answer {
+		answers = append(answers, dns.Copy(rr))
+	}
+
+	return answers
+}
+
+// Get the answers as DNSAnswers. This is a lossy projection which
+// only supports common record types, so the message itself should
+// be preferred where possible.
 func (d DnsResponse) Answers() ([]DNSAnswer, error) {
 	answers := []DNSAnswer{}
 	if d.msg == nil {
@@ -293,7 +419,18 @@ func (d *DnsResponse) AsReplyToMsg(msg *dns.Msg) *dns.Msg {
 	}
 
 	reply := d.Copy()
-	reply.bumpAnswerTTLs()
+	reply.age(time.Now())
+
+	if reply.IsNegative() {
+		// The SOA's TTL is how long the answer may be cached
+		// (RFC 2308 section 3)
+		remaining := uint32(max(reply.GetTtl(), 0) / time.Second)
+		for _, rr := range reply.msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa.Hdr.Ttl = min(soa.Hdr.Ttl, remaining)
+			}
+		}
+	}
 
 	query, err := NewDnsQueryFromMsg(msg)
 	if err == nil {
@@ -313,9 +450,29 @@ func (d *DnsResponse) AsReplyToMsg(msg *dns.Msg) *dns.Msg {
 	resp.RecursionAvailable = cmp.Or(reply.RecursionAvailable, reply.Resolver != "")
 	resp.SetReply(msg)
 	resp.Rcode = reply.msg.Rcode
+	resp.Authoritative = reply.Authoritative
 
 	if msg != nil {
 		resp.Answer = reply.msg.Answer
+		resp.Ns = reply.msg.Ns
+
+		// The OPT record is per hop, so the upstream's isn't passed on
+		for _, rr := range reply.msg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+
+		if opt := msg.IsEdns0(); opt != nil && (reply.Stale || reply.Blocked) {
+			infoCode := dns.ExtendedErrorCodeStaleAnswer
+			if reply.Blocked {
+				infoCode = dns.ExtendedErrorCodeBlocked
+			}
+			resp.SetEdns0(dns.DefaultMsgSize, opt.Do())
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_EDE{
+				InfoCode: infoCode,
+			})
+		}
 	}
 
 	return resp
@@ -325,7 +482,12 @@ func (d *DnsResponse) Copy() DnsResponse {
 	resp, _ := NewDnsResponseFromMsg(d.msg)
 	resp.FromCache = d.FromCache
 	resp.Expires = d.Expires
+	resp.received = d.received
 	resp.Resolver = d.Resolver
+	resp.Stale = d.Stale
+	resp.Blocked = d.Blocked
+	resp.Dropped = d.Dropped
+	resp.Authoritative = d.Authoritative
 
 	return *resp
 }
@@ -366,3 +366,113 @@ func TestSetTtlWithAnswers(t *testing.T) {
 		t.Errorf("Reply dns.Msg has the wrong TTL after manipulation, expected = 30, actual = %d", msgTtl)
 	}
 }
+
+func TestSetTtlKeepsTtlOfEachRecord(t *testing.T) {
+	msg := new(dns.Msg)
+	for _, record := range []string{
+		"www.example.com. 3600 IN CNAME web.example.com.",
+		"web.example.com. 60 IN A 192.0.2.1",
+	} {
+		rr, _ := dns.NewRR(record)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	response, err := NewDnsResponseFromMsg(msg)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ttls := func() []uint32 {
+		reply := response.AsReplyToMsg(new(dns.Msg))
+		return []uint32{reply.Answer[0].Header().Ttl, reply.Answer[1].Header().Ttl}
+	}
+
+	response.SetTtl(300 * time.Second)
+	if got := ttls(); !slices.Equal(got, []uint32{3600, 300}) {
+		t.Errorf("raising the TTL should keep longer ones, got %v", got)
+	}
+
+	response.SetTtl(30 * time.Second)
+	if got := ttls(); !slices.Equal(got, []uint32{30, 30}) {
+		t.Errorf("lowering the TTL should lower every longer one, got %v", got)
+	}
+}
+
+func TestGetTtlFromNegativeMsg(t *testing.T) {
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60")
+
+	response, err := NewNegativeDnsResponse(dns.RcodeNameError, soa)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !response.IsNegative() {
+		t.Errorf("NXDOMAIN response should be negative")
+	}
+
+	if !ttlAreAboutEqual(uint32(response.GetTtl().Seconds()), 60) {
+		t.Errorf("TTL did not match SOA minimum expected = 60, actual = %f", response.GetTtl().Seconds())
+	}
+
+	reply := response.AsReplyToMsg(new(dns.Msg).SetQuestion("missing.example.com.", dns.TypeA))
+	if reply.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN reply, got rcode %d", reply.Rcode)
+	}
+
+	if len(reply.Ns) != 1 {
+		t.Fatalf("expected the SOA in the authority section, got %v", reply.Ns)
+	}
+
+	if !ttlAreAboutEqual(reply.Ns[0].Header().Ttl, 60) {
+		t.Errorf("SOA TTL should be the negative TTL expected = 60, actual = %d", reply.Ns[0].Header().Ttl)
+	}
+}
+
+func TestReplyKeepsAllSectionsExceptOpt(t *testing.T) {
+	upstream := new(dns.Msg)
+	answer, _ := dns.NewRR("example.com. 60 IN MX 10 mail.example.com.")
+	ns, _ := dns.NewRR("example.com. 60 IN NS ns.example.com.")
+	glue, _ := dns.NewRR("mail.example.com. 60 IN A 192.0.2.25")
+	upstream.Answer = []dns.RR{answer}
+	upstream.Ns = []dns.RR{ns}
+	upstream.Extra = []dns.RR{glue}
+	upstream.SetEdns0(1232, false)
+
+	response, err := NewDnsResponseFromMsg(upstream)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reply := response.AsReplyToMsg(new(dns.Msg).SetQuestion("example.com.", dns.TypeMX))
+
+	if len(reply.Answer) != 1 || len(reply.Ns) != 1 {
+		t.Errorf("expected the answer and authority sections to be kept, got %v and %v", reply.Answer, reply.Ns)
+	}
+
+	if len(reply.Extra) != 1 || reply.Extra[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected only the glue record in the additional section, got %v", reply.Extra)
+	}
+}
+
+func TestReplyIsAuthoritativeOnlyForLocalZones(t *testing.T) {
+	upstream := new(dns.Msg)
+	answer, _ := dns.NewRR("nas.home.example. 60 IN A 192.0.2.10")
+	upstream.Answer = []dns.RR{answer}
+	upstream.Authoritative = true
+
+	response, err := NewDnsResponseFromMsg(upstream)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	query := new(dns.Msg).SetQuestion("nas.home.example.", dns.TypeA)
+	if reply := response.AsReplyToMsg(query); reply.Authoritative {
+		t.Errorf("expected an upstream's AA flag not to be passed on")
+	}
+
+	response.Authoritative = true
+	copied := response.Copy()
+	if reply := copied.AsReplyToMsg(query); !reply.Authoritative {
+		t.Errorf("expected the AA flag for an answer from a local zone")
+	}
+}
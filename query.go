@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/blocklist"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/localzone"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+	"github.com/thenaterhood/spuddns/resolver"
+	"github.com/thenaterhood/spuddns/rpz"
+	"github.com/thenaterhood/spuddns/system"
+)
+
+// Resolve a name through the same pipeline the server uses, without
+// the cache, and print the answer and the resolver that gave it
+func query(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	conffile := flags.String("config", defaultConfigFile, "config file")
+	server := flags.String("server", "", "upstream resolver to use instead of the configured ones")
+	clientId := flags.String("client-id", "", "client id (CPE ID) to select an ACL with")
+
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		printUsage(stderr)
+		return 2
+	}
+
+	qtype := dns.TypeA
+	if len(positional) > 1 {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(positional[1])]
+		if !ok {
+			fmt.Fprintf(stderr, "unknown record type '%s'\n", positional[1])
+			return 2
+		}
+	}
+
+	config, err := app.ReadConfig(*conffile)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%v\n", *conffile, err)
+		return 1
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{
+		Level: max(slog.Level(config.LogLevel), slog.LevelWarn),
+	}))
+
+	if *server != "" {
+		if err := resolver.ValidateUpstream(*server); err != nil {
+			fmt.Fprintf(stderr, "invalid server '%s': %v\n", *server, err)
+			return 2
+		}
+
+		config.UpstreamResolvers = []string{*server}
+		config.ConditionalForwards = map[string][]string{}
+		config.RespectResolveConf = false
+		config.ResolvConf = nil
+	} else {
+		if config.RespectResolveConf {
+			resolvconf, err := system.NewResolvConfFromPath(config.ResolvConfPath, logger)
+			if err != nil {
+				logger.Warn("failed to read resolvconf", "error", err)
+			}
+			if resolvconf != nil {
+				config.ResolvConf = resolvconf
+			}
+		}
+		config.EtcHosts = system.NewEtcHosts(logger)
+	}
+
+	state := app.AppState{
+		Cache:   &cache.DummyCache{},
+		Log:     logger,
+		Metrics: metrics.DummyMetrics{},
+		UpstreamHealth: resolver.NewUpstreamHealth(resolver.UpstreamHealthConfig{
+			Logger:           logger,
+			Metrics:          metrics.DummyMetrics{},
+			FailureThreshold: config.UpstreamFailureThreshold,
+		}),
+	}
+
+	// Like /etc/hosts, local zones, blocklists and response policies
+	// don't apply when asking a server
+	if *server == "" {
+		state.LocalZones = localzone.NewLocalZones(localzone.LocalZonesConfig{
+			Zones:  config.GetLocalZones(),
+			Logger: logger,
+		})
+		state.Blocklist = blocklist.NewBlocklist(blocklist.BlocklistConfig{
+			Lists:      config.Blocklists,
+			Allowlists: config.Allowlists,
+			Logger:     logger,
+			Metrics:    state.Metrics,
+		})
+		state.Rpz = rpz.NewRpz(rpz.RpzConfig{
+			Zones:   config.GetRpzZones(),
+			Logger:  logger,
+			Metrics: state.Metrics,
+		})
+	}
+
+	dnsQuery, err := models.NewDnsQueryFromQuestions([]dns.Question{
+		{Name: dns.Fqdn(positional[0]), Qtype: qtype, Qclass: dns.ClassINET},
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid query: %v\n", err)
+		return 2
+	}
+	if *clientId != "" {
+		dnsQuery.ClientId = clientId
+	}
+
+	start := time.Now()
+	response, err := state.ResolveQueryComplete(*dnsQuery, config)
+	elapsed := time.Since(start)
+
+	if response != nil && response.Dropped {
+		fmt.Fprintln(stdout, ";; no answer: dropped by a response policy")
+	} else if response != nil {
+		fmt.Fprintln(stdout, response.AsReplyToMsg(dnsQuery.PreparedMsg()).String())
+		resolvedBy := response.Resolver
+		if resolvedBy == "" {
+			resolvedBy = "(none)"
+		}
+		fmt.Fprintf(stdout, ";; RESOLVER: %s\n;; QUERY TIME: %s\n", resolvedBy, elapsed.Round(time.Millisecond))
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "query failed: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
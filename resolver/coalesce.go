@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// A query that is being resolved, which identical queries wait on
+// rather than resolving it themselves
+type inflightQuery struct {
+	done     chan struct{}
+	response *models.DnsResponse
+	err      error
+}
+
+type queryCoalescer struct {
+	inflight map[string]*inflightQuery
+	mutex    sync.Mutex
+}
+
+// This is shared between resolvers since a new resolver is
+// created for each query.
+var sharedQueryCoalescer = &queryCoalescer{
+	inflight: map[string]*inflightQuery{},
+}
+
+// Run resolve for the key, unless it's already running, in which case
+// its result is waited on and shared. Returns whether the result was
+// shared from another caller.
+func (c *queryCoalescer) do(key string, resolve func() (*models.DnsResponse, error)) (*models.DnsResponse, error, bool) {
+	c.mutex.Lock()
+	if query, ok := c.inflight[key]; ok {
+		c.mutex.Unlock()
+		<-query.done
+		return copyResponse(query.response), query.err, true
+	}
+
+	query := &inflightQuery{
+		done: make(chan struct{}),
+	}
+	c.inflight[key] = query
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		c.mutex.Unlock()
+		close(query.done)
+	}()
+
+	query.response, query.err = resolve()
+
+	return copyResponse(query.response), query.err, false
+}
+
+// Each caller gets its own copy since responses are modified
+// as they're answered
+func copyResponse(response *models.DnsResponse) *models.DnsResponse {
+	if response == nil {
+		return nil
+	}
+
+	copied := response.Copy()
+	return &copied
+}
+
+// Merges identical concurrent queries into a single query to the
+// wrapped client (the forwarders), so a popular name expiring from
+// the cache doesn't send a burst of queries upstream
+type coalescingClient struct {
+	client models.DnsQueryClient
+	config DnsResolverConfig
+}
+
+func (c *coalescingClient) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	question := q.FirstQuestion()
+	if question == nil {
+		return c.client.QueryDns(q)
+	}
+
+	// Queries are only merged when they'd get the same answer, so
+	// the upstreams they're sent to and the CPE ID sent with them
+	// are part of the key
+	key := fmt.Sprintf(
+		"%s::%d::%d::%s::%s::%s",
+		question.Name, question.Qtype, question.Qclass, c.config.CachePartition, strings.Join(c.config.Servers, ","), q.CpeId(),
+	)
+
+	response, err, shared := sharedQueryCoalescer.do(key, func() (*models.DnsResponse, error) {
+		return c.client.QueryDns(q)
+	})
+
+	if shared {
+		c.config.Logger.Debug("coalesced query with one already in flight", "query", question.Name, "qtype", question.Qtype)
+		c.config.Metrics.IncQueriesCoalesced()
+	}
+
+	return response, err
+}
@@ -0,0 +1,171 @@
+package resolver
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+type coalescedMetrics struct {
+	metrics.DummyMetrics
+	coalesced *atomic.Int32
+}
+
+func (m coalescedMetrics) IncQueriesCoalesced() {
+	m.coalesced.Add(1)
+}
+
+// Upstream that holds every query until it's released
+type blockingUpstream struct {
+	release chan struct{}
+	queries *atomic.Int32
+}
+
+func (b blockingUpstream) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	b.queries.Add(1)
+	<-b.release
+	return models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{
+		{
+			Name: q.FirstQuestion().Name,
+			Type: dns.TypeA,
+			TTL:  30 * time.Second,
+			Data: "203.0.113.1",
+		},
+	})
+}
+
+func getCoalescingClient(upstream models.DnsQueryClient, partition string, coalesced *atomic.Int32, servers ...string) *coalescingClient {
+	return &coalescingClient{
+		client: upstream,
+		config: DnsResolverConfig{
+			Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+				Level: slog.Level(slog.LevelDebug),
+			})),
+			Metrics:        coalescedMetrics{coalesced: coalesced},
+			CachePartition: partition,
+			Servers:        servers,
+		},
+	}
+}
+
+func TestIdenticalQueriesAreCoalesced(t *testing.T) {
+	queries := &atomic.Int32{}
+	coalesced := &atomic.Int32{}
+	upstream := blockingUpstream{release: make(chan struct{}), queries: queries}
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "coalesce.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+
+	const clients = 10
+	wg := sync.WaitGroup{}
+	responses := make(chan *models.DnsResponse, clients)
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := getCoalescingClient(upstream, "", coalesced).QueryDns(*query)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			responses <- response
+		}()
+	}
+
+	// Give every client time to join the query before it's answered
+	for waited := 0; queries.Load() < 1 && waited < 100; waited++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+	close(responses)
+
+	if queries.Load() != 1 {
+		t.Errorf("expected a single upstream query, got %d", queries.Load())
+	}
+
+	if coalesced.Load() != clients-1 {
+		t.Errorf("expected %d coalesced queries, got %d", clients-1, coalesced.Load())
+	}
+
+	for response := range responses {
+		if getAnswerData(t, response) != "203.0.113.1" {
+			t.Errorf("coalesced query got the wrong answer")
+		}
+	}
+}
+
+func TestQueriesInDifferentPartitionsAreNotCoalesced(t *testing.T) {
+	queries := &atomic.Int32{}
+	coalesced := &atomic.Int32{}
+	upstream := blockingUpstream{release: make(chan struct{}), queries: queries}
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "partition.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+
+	wg := sync.WaitGroup{}
+	for _, partition := range []string{"", "acl:one", "acl:two"} {
+		wg.Add(1)
+		go func(partition string) {
+			defer wg.Done()
+			getCoalescingClient(upstream, partition, coalesced).QueryDns(*query)
+		}(partition)
+	}
+
+	for waited := 0; queries.Load() < 3 && waited < 1000; waited++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+
+	if queries.Load() != 3 {
+		t.Errorf("expected a query per partition, got %d", queries.Load())
+	}
+
+	if coalesced.Load() != 0 {
+		t.Errorf("queries in different partitions should not be coalesced, %d were", coalesced.Load())
+	}
+}
+
+func TestQueriesForDifferentUpstreamsOrCpeIdsAreNotCoalesced(t *testing.T) {
+	queries := &atomic.Int32{}
+	coalesced := &atomic.Int32{}
+	upstream := blockingUpstream{release: make(chan struct{}), queries: queries}
+
+	question := dns.Question{Name: "upstreams.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+	withCpeId, _ := models.NewDnsQueryFromQuestions([]dns.Question{question})
+	withCpeId.SetCpeId("abc123")
+
+	wg := sync.WaitGroup{}
+	resolve := func(query models.DnsQuery, servers ...string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getCoalescingClient(upstream, "", coalesced, servers...).QueryDns(query)
+		}()
+	}
+	resolve(*query, "192.0.2.1")
+	resolve(*query, "192.0.2.2")
+	resolve(*withCpeId, "192.0.2.1")
+
+	for waited := 0; queries.Load() < 3 && waited < 1000; waited++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+
+	if queries.Load() != 3 {
+		t.Errorf("expected a query per upstream and CPE ID, got %d", queries.Load())
+	}
+
+	if coalesced.Load() != 0 {
+		t.Errorf("queries for different upstreams or CPE IDs should not be coalesced, %d were", coalesced.Load())
+	}
+}
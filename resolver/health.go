@@ -0,0 +1,231 @@
+package resolver
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// Weight given to the newest sample in the rolling latency
+const latencySmoothing = 0.3
+
+type UpstreamHealthConfig struct {
+	Logger  *slog.Logger
+	Metrics metrics.MetricsInterface
+	// Number of consecutive failures after which an upstream is
+	// considered down and skipped. Zero or less never marks an
+	// upstream down.
+	FailureThreshold int
+}
+
+// Health of a single upstream resolver
+type UpstreamStats struct {
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures int
+	// Rolling latency of successful queries
+	Latency   time.Duration
+	Down      bool
+	DownSince time.Time
+}
+
+// Success rate of the upstream (0-1). Upstreams that haven't been
+// queried yet are assumed healthy.
+func (s UpstreamStats) SuccessRate() float64 {
+	total := s.Successes + s.Failures
+	if total == 0 {
+		return 1
+	}
+	return float64(s.Successes) / float64(total)
+}
+
+// Tracks the health of upstream resolvers. This is shared between
+// resolvers since a new resolver is created for each query.
+type UpstreamHealth struct {
+	config    UpstreamHealthConfig
+	upstreams map[string]*UpstreamStats
+	mutex     sync.RWMutex
+}
+
+// Used when a resolver isn't given a registry so strategies
+// still have latency to work with
+var defaultUpstreamHealth = NewUpstreamHealth(UpstreamHealthConfig{})
+
+func NewUpstreamHealth(config UpstreamHealthConfig) *UpstreamHealth {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	if config.Metrics == nil {
+		config.Metrics = metrics.DummyMetrics{}
+	}
+
+	return &UpstreamHealth{
+		config:    config,
+		upstreams: map[string]*UpstreamStats{},
+	}
+}
+
+func (h *UpstreamHealth) stats(server string) *UpstreamStats {
+	stats, ok := h.upstreams[server]
+	if !ok {
+		stats = &UpstreamStats{}
+		h.upstreams[server] = stats
+	}
+	return stats
+}
+
+func (h *UpstreamHealth) RecordSuccess(server string, latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stats := h.stats(server)
+	stats.Successes++
+	stats.ConsecutiveFailures = 0
+
+	if stats.Latency == 0 {
+		stats.Latency = latency
+	} else {
+		stats.Latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(stats.Latency))
+	}
+
+	if stats.Down {
+		h.config.Logger.Info("upstream resolver recovered", "server", server, "down_for", time.Since(stats.DownSince).Round(time.Second))
+		stats.Down = false
+		stats.DownSince = time.Time{}
+	}
+
+	h.config.Metrics.IncUpstreamResult(upstreamLabel(server), true)
+	h.config.Metrics.SetUpstreamUp(upstreamLabel(server), true)
+}
+
+func (h *UpstreamHealth) RecordFailure(server string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stats := h.stats(server)
+	stats.Failures++
+	stats.ConsecutiveFailures++
+
+	if !stats.Down && h.config.FailureThreshold > 0 && stats.ConsecutiveFailures >= h.config.FailureThreshold {
+		h.config.Logger.Warn(
+			"upstream resolver is down - skipping it until it recovers",
+			"server", server,
+			"consecutive_failures", stats.ConsecutiveFailures,
+			"success_rate", fmt.Sprintf("%.2f", stats.SuccessRate()),
+			"error", err,
+		)
+		stats.Down = true
+		stats.DownSince = time.Now()
+	}
+
+	h.config.Metrics.IncUpstreamResult(upstreamLabel(server), false)
+	h.config.Metrics.SetUpstreamUp(upstreamLabel(server), !stats.Down)
+}
+
+func (h *UpstreamHealth) IsDown(server string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	stats, ok := h.upstreams[server]
+	return ok && stats.Down
+}
+
+// Get the rolling latency of an upstream. Upstreams that haven't been
+// measured yet are reported as zero so they're tried (and measured).
+func (h *UpstreamHealth) Latency(server string) time.Duration {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	stats, ok := h.upstreams[server]
+	if !ok {
+		return 0
+	}
+	return stats.Latency
+}
+
+// Get the upstreams currently considered down
+func (h *UpstreamHealth) Down() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	down := []string{}
+	for server, stats := range h.upstreams {
+		if stats.Down {
+			down = append(down, server)
+		}
+	}
+	return down
+}
+
+// Forget the health of every upstream that isn't one of servers, such
+// as upstreams a reload removed, so they aren't probed or reported
+func (h *UpstreamHealth) Retain(servers []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for server := range h.upstreams {
+		if !slices.Contains(servers, server) {
+			delete(h.upstreams, server)
+		}
+	}
+}
+
+// Get a copy of the health of every upstream seen so far
+func (h *UpstreamHealth) Stats() map[string]UpstreamStats {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	ret := map[string]UpstreamStats{}
+	for server, stats := range h.upstreams {
+		ret[server] = *stats
+	}
+	return ret
+}
+
+// Send a probe query to an upstream and record the result with
+// the resolver config's upstream health registry.
+func ProbeUpstream(server string, clientConfig DnsResolverConfig) error {
+	if clientConfig.Timeout == 0 {
+		clientConfig.Timeout = 2
+	}
+
+	if clientConfig.Mdns == nil {
+		clientConfig.Mdns = NewDefaultMdnsConfig()
+	}
+
+	health := clientConfig.Health
+	if health == nil {
+		health = defaultUpstreamHealth
+	}
+
+	client := newUpstreamClient(server, clientConfig)
+	if client == nil {
+		return fmt.Errorf("'%s' is not a valid upstream", server)
+	}
+
+	query, err := models.NewDnsQueryFromQuestions([]dns.Question{{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	response, err := client.QueryDns(*query)
+	if err == nil && response == nil {
+		err = fmt.Errorf("no response")
+	}
+
+	if err != nil {
+		health.RecordFailure(server, err)
+		return err
+	}
+
+	health.RecordSuccess(server, time.Since(start))
+	return nil
+}
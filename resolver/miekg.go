@@ -32,7 +32,21 @@ func (mdc miekgDnsClient) QueryDns(q models.DnsQuery) (*models.DnsResponse, erro
 	servers := mdc.clientConfig.Servers
 
 	for _, server := range servers {
-		r, _, err = c.Exchange(m, server+":53")
+		upstream, parseErr := parseDnsUpstream(server)
+		if parseErr != nil {
+			mdc.clientConfig.Logger.Warn("unable to parse dns upstream", "server", server, "error", parseErr)
+			err = parseErr
+			continue
+		}
+
+		c.Net = upstream.Net
+		r, _, err = c.Exchange(m, upstream.Addr)
+
+		if err == nil && r != nil && r.Truncated && c.Net == "udp" {
+			mdc.clientConfig.Logger.Debug("dns response was truncated - retrying over tcp", "server", server)
+			c.Net = "tcp"
+			r, _, err = c.Exchange(m, upstream.Addr)
+		}
 
 		if err != nil {
 			mdc.clientConfig.Logger.Warn("dns lookup failed - will try next resolver", "server", server, "error", err)
@@ -1,11 +1,13 @@
 package resolver
 
 import (
+	"fmt"
 	"log/slog"
-	"net"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/thenaterhood/spuddns/metrics"
 	"github.com/thenaterhood/spuddns/models"
 )
@@ -16,10 +18,21 @@ type DnsResolverConfig struct {
 	Timeout          int
 	Metrics          metrics.MetricsInterface
 	Static           map[string]string
+	StaticRecords    *StaticRecords
 	ForceMimimumTtl  int
 	Cache            models.DnsQueryClient
 	DefaultForwarder models.DnsQueryClient
 	Mdns             *MdnsConfig
+	// How queries are distributed between Servers. See the
+	// Strategy* constants. Defaults to sequential.
+	Strategy string
+	// Shared record of upstream health, used to skip upstreams
+	// that are down
+	Health *UpstreamHealth
+	// Identifies the cache the resolver uses, so that identical
+	// queries are only coalesced when they'd share an answer.
+	// Empty for the shared cache.
+	CachePartition string
 }
 
 type MdnsConfig struct {
@@ -41,27 +54,88 @@ type multiClient struct {
 }
 
 func (mc *multiClient) QueryDns(query models.DnsQuery) (*models.DnsResponse, error) {
+	var upstreamErr error
+	// First negative answer that carried an SOA, which is returned
+	// if nothing has a positive answer
+	var negative *models.DnsResponse
 
 	for _, c := range mc.clients {
 		response, err := c.QueryDns(query)
 
 		if err != nil {
+			// Local sources (such as static records) report a miss as
+			// an error, so only upstream failures are passed on.
+			switch c.(type) {
+			case *upstreamGroup, *coalescingClient:
+				upstreamErr = err
+			}
 			continue
 		}
 
 		if response != nil {
+			// An upstream that couldn't answer is a failure, so that
+			// a stale answer can be served instead (RFC 8767)
+			if rcode := response.Rcode(); rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused {
+				switch c.(type) {
+				case *upstreamGroup, *coalescingClient:
+					upstreamErr = fmt.Errorf("upstream answered %s", dns.RcodeToString[rcode])
+					continue
+				}
+			}
+
 			if response.IsSuccess() {
-				if !response.FromCache && response.GetTtl() < time.Duration(mc.config.ForceMimimumTtl)*time.Second {
+				if !response.FromCache && !response.IsNegative() && response.GetTtl() < time.Duration(mc.config.ForceMimimumTtl)*time.Second {
 					response.SetTtl(time.Duration(mc.config.ForceMimimumTtl) * time.Second)
 				}
 				return response, nil
 			}
+
+			if response.IsNegative() && response.Soa() != nil {
+				if response.FromCache {
+					return response, nil
+				}
+
+				if negative == nil {
+					negative = response
+				}
+			}
 		}
 	}
 
+	if negative != nil {
+		return negative, nil
+	}
+
+	if upstreamErr != nil {
+		return models.NewServFailDnsResponse(), upstreamErr
+	}
+
 	return models.NewNXDomainDnsResponse(), nil
 }
 
+// Create the client for a single upstream resolver, based on its
+// syntax. Returns nil if the upstream isn't recognized.
+func newUpstreamClient(resolver string, clientConfig DnsResolverConfig) models.DnsQueryClient {
+	config := clientConfig
+	config.Servers = []string{resolver}
+
+	if strings.HasPrefix(resolver, tlsUpstreamScheme) {
+		return tlsClient{
+			config,
+		}
+	} else if _, err := parseDnsUpstream(resolver); err == nil {
+		return miekgDnsClient{
+			config,
+		}
+	} else if _, err := url.Parse(resolver); err == nil {
+		return httpsClient{
+			config,
+		}
+	}
+
+	return nil
+}
+
 func GetDnsResolver(clientConfig DnsResolverConfig) models.DnsQueryClient {
 	if clientConfig.Timeout == 0 {
 		clientConfig.Timeout = 2
@@ -81,26 +155,38 @@ func GetDnsResolver(clientConfig DnsResolverConfig) models.DnsQueryClient {
 		clients = append(clients, clientConfig.Cache)
 	}
 
+	// Everything past the cache is forwarded, and concurrent
+	// identical queries are coalesced into one
+	forwarders := []models.DnsQueryClient{}
+
 	if clientConfig.Mdns.Enable {
-		clients = append(clients, mdnsClient{clientConfig})
+		forwarders = append(forwarders, mdnsClient{clientConfig})
+	}
+
+	upstreams := upstreamGroup{
+		config: clientConfig,
 	}
 
 	for _, resolver := range clientConfig.Servers {
-		config := clientConfig
-
-		if ip := net.ParseIP(resolver); ip != nil {
-			config.Servers = []string{resolver}
-			clients = append(clients, miekgDnsClient{
-				config,
-			})
-		} else if _, err := url.Parse(resolver); err == nil {
-			config.Servers = []string{resolver}
-			clients = append(clients, httpsClient{
-				config,
-			})
+		if client := newUpstreamClient(resolver, clientConfig); client != nil {
+			upstreams.upstreams = append(upstreams.upstreams, upstreamClient{resolver, client})
 		}
 	}
 
+	if len(upstreams.upstreams) > 0 {
+		forwarders = append(forwarders, &upstreams)
+	}
+
+	if len(forwarders) > 0 {
+		clients = append(clients, &coalescingClient{
+			client: &multiClient{forwarders, clientConfig},
+			config: clientConfig,
+		})
+	}
+
+	// The default forwarder is a resolver in its own right which
+	// coalesces its own queries. Coalescing it here as well would
+	// have it wait on the query that's waiting for it.
 	if clientConfig.DefaultForwarder != nil {
 		clients = append(clients, clientConfig.DefaultForwarder)
 	}
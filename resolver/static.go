@@ -1,24 +1,298 @@
 package resolver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/thenaterhood/spuddns/models"
 )
 
+// TTL of static records that don't set their own
 const StaticTTL uint32 = 10
 
+// Longest chain of CNAMEs followed within the static records
+const maxStaticCnameChain = 8
+
+// Record types that can be given as static records
+var staticRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"SRV":   dns.TypeSRV,
+	"PTR":   dns.TypePTR,
+	"CAA":   dns.TypeCAA,
+}
+
+func IsValidStaticRecordType(rtype string) bool {
+	_, ok := staticRecordTypes[strings.ToUpper(rtype)]
+	return ok
+}
+
+// Whether a name can be given to a static record. A wildcard
+// (*.example.com) is only allowed as the first label.
+func IsValidStaticRecordName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return false
+	}
+	return !strings.Contains(name, "*")
+}
+
+// Make a static record from its data as written in a zone file, e.g.
+// "10 mail.example.com" for MX. TXT data doesn't need to be quoted.
+func NewStaticRecord(name string, rtype string, value string, ttl uint32) (dns.RR, error) {
+	rtype = strings.ToUpper(rtype)
+	if _, ok := staticRecordTypes[rtype]; !ok {
+		return nil, fmt.Errorf("'%s' is not a supported record type", rtype)
+	}
+	if ttl == 0 {
+		ttl = StaticTTL
+	}
+
+	value = strings.TrimSpace(value)
+	if rtype == "TXT" && !strings.HasPrefix(value, `"`) {
+		value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, rtype, value))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, errors.New("no record data")
+	}
+
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr, nil
+}
+
+// Make the SOA given with a negative answer for a static name, so it's
+// cached for StaticTTL (RFC 2308). Static records aren't in a zone, so
+// the SOA is for the name itself.
+func staticSoa(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: StaticTTL},
+		Ns:      "localhost.",
+		Mbox:    "nobody.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  StaticTTL,
+	}
+}
+
+// Records answered from the config rather than resolved
+type StaticRecords struct {
+	// Records by owner name and type
+	records map[string]map[uint16][]dns.RR
+	// PTRs for the address records, which are only answered when
+	// there isn't a PTR record for the address
+	ptrs map[string][]dns.RR
+}
+
+func NewStaticRecords() *StaticRecords {
+	return &StaticRecords{
+		records: map[string]map[uint16][]dns.RR{},
+		ptrs:    map[string][]dns.RR{},
+	}
+}
+
+// Add a record. Address records also get a PTR record for their
+// address, unless they're for a wildcard.
+func (s *StaticRecords) Add(rr dns.RR) {
+	header := rr.Header()
+	owner := strings.ToLower(header.Name)
+
+	if _, ok := s.records[owner]; !ok {
+		s.records[owner] = map[uint16][]dns.RR{}
+	}
+	if slices.ContainsFunc(s.records[owner][header.Rrtype], func(existing dns.RR) bool { return dns.IsDuplicate(existing, rr) }) {
+		return
+	}
+	s.records[owner][header.Rrtype] = append(s.records[owner][header.Rrtype], rr)
+
+	if strings.HasPrefix(owner, "*.") {
+		return
+	}
+
+	var address net.IP
+	switch record := rr.(type) {
+	case *dns.A:
+		address = record.A
+	case *dns.AAAA:
+		address = record.AAAA
+	default:
+		return
+	}
+
+	reverse, err := dns.ReverseAddr(address.String())
+	if err != nil {
+		return
+	}
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: header.Ttl},
+		Ptr: owner,
+	}
+	if !slices.ContainsFunc(s.ptrs[reverse], func(existing dns.RR) bool { return dns.IsDuplicate(existing, ptr) }) {
+		s.ptrs[reverse] = append(s.ptrs[reverse], ptr)
+	}
+}
+
+// The number of names with records
+func (s *StaticRecords) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.records)
+}
+
+// Get the records for a name, from the name itself or else the most
+// specific wildcard it's under
+func (s *StaticRecords) find(name string) map[uint16][]dns.RR {
+	rrsets, exists := s.records[name]
+
+	// Generated PTRs are only used for addresses without records
+	// of their own
+	if ptrs, ok := s.ptrs[name]; ok && len(rrsets[dns.TypePTR]) == 0 && len(rrsets[dns.TypeCNAME]) == 0 {
+		withPtrs := map[uint16][]dns.RR{dns.TypePTR: ptrs}
+		maps.Copy(withPtrs, rrsets)
+		return withPtrs
+	}
+	if exists {
+		return rrsets
+	}
+
+	labels := dns.Split(name)
+	for _, start := range labels[min(1, len(labels)):] {
+		if rrsets, ok := s.records["*."+name[start:]]; ok {
+			return rrsets
+		}
+	}
+
+	return nil
+}
+
+// Get the answer to a question from the records, or nil if there are
+// none for the name. CNAMEs are followed as long as their targets have
+// records too. A name with records, but none of the type asked for,
+// is answered with NODATA rather than being resolved elsewhere.
+func (s *StaticRecords) Lookup(question dns.Question) *dns.Msg {
+	if s == nil {
+		return nil
+	}
+
+	name := strings.ToLower(question.Name)
+	// Answers are given for the name as it was asked
+	owner := question.Name
+
+	rrsets := s.find(name)
+	if rrsets == nil {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	for range maxStaticCnameChain {
+		records := rrsets[question.Qtype]
+		if question.Qtype == dns.TypeANY {
+			records = []dns.RR{}
+			for _, rrset := range rrsets {
+				records = append(records, rrset...)
+			}
+		}
+		for _, rr := range records {
+			answer := dns.Copy(rr)
+			answer.Header().Name = owner
+			msg.Answer = append(msg.Answer, answer)
+		}
+		if len(records) > 0 {
+			return msg
+		}
+
+		cnames, ok := rrsets[dns.TypeCNAME]
+		if !ok || question.Qtype == dns.TypeCNAME {
+			msg.Ns = []dns.RR{staticSoa(owner)}
+			return msg
+		}
+
+		cname := dns.Copy(cnames[0]).(*dns.CNAME)
+		cname.Hdr.Name = owner
+		msg.Answer = append(msg.Answer, cname)
+
+		owner = cname.Target
+		rrsets = s.find(strings.ToLower(cname.Target))
+		if rrsets == nil {
+			return msg
+		}
+	}
+
+	return msg
+}
+
 type staticClient struct {
 	clientConfig DnsResolverConfig
 }
 
+// Answer a query from the static records, resolving the target of a
+// CNAME that leaves them
+func (c staticClient) queryRecords(q models.DnsQuery) (*models.DnsResponse, error) {
+	query := q.FirstQuestion()
+	msg := c.clientConfig.StaticRecords.Lookup(*query)
+	if msg == nil {
+		return nil, nil
+	}
+
+	c.clientConfig.Logger.Debug("resolved from static records", "qname", query.Name)
+
+	if len(msg.Answer) > 0 && query.Qtype != dns.TypeCNAME {
+		if cname, ok := msg.Answer[len(msg.Answer)-1].(*dns.CNAME); ok {
+			target := *query
+			target.Name = cname.Target
+			// A target that's also a static record is a loop, since
+			// the chain was followed as far as it could be
+			if c.clientConfig.StaticRecords.Lookup(target) != nil {
+				return models.NewDnsResponseFromMsg(msg)
+			}
+
+			targetQuery, err := q.WithDifferentQuestion(target)
+			if err != nil {
+				return nil, err
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.clientConfig.Timeout)*time.Second)
+			defer cancel()
+
+			resolved, err := targetQuery.ResolveWith(GetDnsResolver(c.clientConfig), ctx)
+			if err == nil && resolved != nil {
+				msg.Rcode = resolved.Rcode()
+				msg.Answer = append(msg.Answer, resolved.AnswerRRs()...)
+			}
+		}
+	}
+
+	return models.NewDnsResponseFromMsg(msg)
+}
+
 func (c staticClient) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
 	query := q.FirstQuestion()
 	c.clientConfig.Logger.Debug("attempting to resolve query with static record from config")
 
+	if c.clientConfig.StaticRecords != nil {
+		response, err := c.queryRecords(q)
+		if response != nil || err != nil {
+			return response, err
+		}
+	}
+
 	if c.clientConfig.Static == nil {
 		c.clientConfig.Logger.Debug("static entries are not configured")
 		return models.NewNXDomainDnsResponse(), nil
@@ -39,12 +313,16 @@ func (c staticClient) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
 
 			c.clientConfig.Logger.Debug("resolved from static", "qname", query.Name)
 
+			if query.Qtype != dnsType && query.Qtype != dns.TypeANY {
+				return models.NewNegativeDnsResponse(dns.RcodeSuccess, staticSoa(query.Name))
+			}
+
 			return models.NewDnsResponseFromDnsAnswers(
 				[]models.DNSAnswer{
 					{
 						Name: query.Name,
 						Type: dnsType,
-						TTL:  30 * time.Second,
+						TTL:  time.Duration(StaticTTL) * time.Second,
 						Data: ip,
 					},
 				},
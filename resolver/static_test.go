@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// Answers every A query with 203.0.113.1
+type fixedUpstream struct{}
+
+func (fixedUpstream) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	return models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{
+		{
+			Name: q.FirstQuestion().Name,
+			Type: dns.TypeA,
+			TTL:  30 * time.Second,
+			Data: "203.0.113.1",
+		},
+	})
+}
+
+func getTestStaticRecords(t *testing.T) *StaticRecords {
+	t.Helper()
+
+	records := NewStaticRecords()
+	add := func(name string, rtype string, ttl uint32, values ...string) {
+		for _, value := range values {
+			rr, err := NewStaticRecord(name, rtype, value, ttl)
+			if err != nil {
+				t.Fatalf("unexpected error for %s %s '%s': %v", name, rtype, value, err)
+			}
+			records.Add(rr)
+		}
+	}
+
+	add("nas.home.example", "A", 300, "192.0.2.10", "192.0.2.11")
+	add("nas.home.example", "AAAA", 0, "2001:db8::10")
+	add("files.home.example", "CNAME", 60, "nas.home.example")
+	add("docs.home.example", "CNAME", 60, "www.example.net")
+	add("home.example", "MX", 0, "10 mail.home.example")
+	add("home.example", "TXT", 0, "v=spf1 mx -all")
+	add("_sip._udp.home.example", "SRV", 0, "10 5 5060 sip.home.example")
+	add("home.example", "CAA", 0, `0 issue "letsencrypt.org"`)
+	add("*.apps.home.example", "A", 0, "192.0.2.20")
+	add("printer.home.example", "A", 0, "192.0.2.30")
+	add("30.2.0.192.in-addr.arpa", "PTR", 0, "laserjet.home.example")
+
+	return records
+}
+
+func TestNewStaticRecordErrors(t *testing.T) {
+	tests := [][2]string{
+		{"A", "not-an-address"},
+		{"A", "2001:db8::1"},
+		{"MX", "mail.example.com"},
+		{"SRV", "10 5 sip.example.com"},
+		{"NS", "ns.example.com"},
+		{"A", ""},
+	}
+
+	for _, test := range tests {
+		if _, err := NewStaticRecord("www.example.com", test[0], test[1], 0); err == nil {
+			t.Errorf("%s '%s': expected an error", test[0], test[1])
+		}
+	}
+
+	if !IsValidStaticRecordName("*.example.com") || IsValidStaticRecordName("www.*.example.com") || IsValidStaticRecordName("") {
+		t.Errorf("expected wildcards to only be allowed as the first label")
+	}
+}
+
+func TestStaticRecordsLookup(t *testing.T) {
+	records := getTestStaticRecords(t)
+
+	msg := records.Lookup(dns.Question{Name: "NAS.home.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if msg == nil || len(msg.Answer) != 2 || msg.Answer[0].Header().Name != "NAS.home.example." || msg.Answer[0].Header().Ttl != 300 {
+		t.Errorf("expected both addresses with their TTL, got %v", msg)
+	}
+
+	msg = records.Lookup(dns.Question{Name: "nas.home.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != StaticTTL {
+		t.Errorf("expected the AAAA record with the default TTL, got %v", msg)
+	}
+
+	msg = records.Lookup(dns.Question{Name: "nas.home.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET})
+	if msg == nil || len(msg.Answer) != 0 || msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected no records for a type the name doesn't have, got %v", msg)
+	}
+	if msg != nil && (len(msg.Ns) != 1 || msg.Ns[0].Header().Rrtype != dns.TypeSOA || msg.Ns[0].Header().Ttl != StaticTTL) {
+		t.Errorf("expected NODATA with an SOA so it can be cached, got %v", msg.Ns)
+	}
+
+	msg = records.Lookup(dns.Question{Name: "home.example.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.TXT).Txt[0] != "v=spf1 mx -all" {
+		t.Errorf("expected the TXT record as one string, got %v", msg)
+	}
+
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeCAA} {
+		if msg := records.Lookup(dns.Question{Name: "home.example.", Qtype: qtype, Qclass: dns.ClassINET}); msg == nil || len(msg.Answer) != 1 {
+			t.Errorf("expected a %s record, got %v", dns.TypeToString[qtype], msg)
+		}
+	}
+
+	if msg := records.Lookup(dns.Question{Name: "_sip._udp.home.example.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}); msg == nil || msg.Answer[0].(*dns.SRV).Port != 5060 {
+		t.Errorf("expected the SRV record, got %v", msg)
+	}
+
+	if msg := records.Lookup(dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); msg != nil {
+		t.Errorf("expected nothing for a name without records, got %v", msg)
+	}
+}
+
+func TestStaticRecordsWildcards(t *testing.T) {
+	records := getTestStaticRecords(t)
+
+	for _, name := range []string{"grafana.apps.home.example.", "a.b.apps.home.example."} {
+		msg := records.Lookup(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Name != name {
+			t.Errorf("%s: expected the wildcard's address, got %v", name, msg)
+		}
+	}
+
+	if msg := records.Lookup(dns.Question{Name: "apps.home.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); msg != nil {
+		t.Errorf("expected the wildcard not to answer for its parent, got %v", msg)
+	}
+}
+
+func TestStaticRecordsGeneratePtrs(t *testing.T) {
+	records := getTestStaticRecords(t)
+
+	tests := map[string]string{
+		"10.2.0.192.in-addr.arpa.": "nas.home.example.",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "nas.home.example.",
+		// The PTR record for the address is answered instead
+		"30.2.0.192.in-addr.arpa.": "laserjet.home.example.",
+	}
+
+	for name, expected := range tests {
+		msg := records.Lookup(dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.PTR).Ptr != expected {
+			t.Errorf("%s: expected a PTR to %s, got %v", name, expected, msg)
+		}
+	}
+
+	if msg := records.Lookup(dns.Question{Name: "20.2.0.192.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}); msg != nil {
+		t.Errorf("expected no PTR for a wildcard's address, got %v", msg)
+	}
+}
+
+func TestStaticClientFollowsCnames(t *testing.T) {
+	resolver := GetDnsResolver(DnsResolverConfig{
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:          metrics.DummyMetrics{},
+		StaticRecords:    getTestStaticRecords(t),
+		DefaultForwarder: fixedUpstream{},
+		Mdns:             &MdnsConfig{Enable: false},
+	})
+
+	resolve := func(name string) []dns.RR {
+		query, err := models.NewDnsQueryFromQuestions([]dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+		if err != nil {
+			t.Fatalf("invalid dns question: %v", err)
+		}
+		response, err := resolver.QueryDns(*query)
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %v", name, err)
+		}
+		return response.AnswerRRs()
+	}
+
+	if answers := resolve("files.home.example."); len(answers) != 3 {
+		t.Errorf("expected the CNAME to be followed within the records, got %v", answers)
+	}
+
+	answers := resolve("docs.home.example.")
+	if len(answers) != 2 {
+		t.Fatalf("expected the CNAME to be followed through the resolver, got %v", answers)
+	}
+	if a, ok := answers[1].(*dns.A); !ok || a.Hdr.Name != "www.example.net." || a.A.String() != "203.0.113.1" {
+		t.Errorf("expected the resolved address of the target, got %v", answers[1])
+	}
+}
+
+func TestStaticNameWithoutTheTypeIsNoData(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	resolver := GetDnsResolver(DnsResolverConfig{
+		Logger:           log,
+		Metrics:          metrics.DummyMetrics{},
+		StaticRecords:    getTestStaticRecords(t),
+		DefaultForwarder: fixedUpstream{},
+		Mdns:             &MdnsConfig{Enable: false},
+	})
+	legacy := staticClient{DnsResolverConfig{Logger: log, Static: map[string]string{"printer.home.example": "192.0.2.30"}}}
+
+	for _, client := range []models.DnsQueryClient{resolver, legacy} {
+		query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "printer.home.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}})
+		response, err := client.QueryDns(*query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !response.IsNegative() || response.Rcode() != dns.RcodeSuccess || response.Soa() == nil {
+			t.Errorf("expected NODATA with an SOA rather than an upstream's answer, got %v", response.AnswerRRs())
+		}
+		if soa := response.Soa(); soa != nil && (soa.Hdr.Ttl != StaticTTL || soa.Minttl != StaticTTL) {
+			t.Errorf("expected NODATA to be cached for %d seconds, got %v", StaticTTL, soa)
+		}
+
+		query, _ = models.NewDnsQueryFromQuestions([]dns.Question{{Name: "printer.home.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+		response, err = client.QueryDns(*query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if answers := response.AnswerRRs(); len(answers) != 1 || answers[0].Header().Ttl != StaticTTL {
+			t.Errorf("expected the address with the default TTL, got %v", answers)
+		}
+	}
+}
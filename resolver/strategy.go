@@ -0,0 +1,234 @@
+package resolver
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// Strategies for choosing which upstream(s) a query is sent to
+const (
+	// Try each upstream in order until one answers (the default)
+	StrategySequential = "sequential"
+	// Query every upstream at once and use the first good answer
+	StrategyParallel = "parallel"
+	// Query the upstream with the lowest recent latency first,
+	// occasionally probing the others to keep their latency current
+	StrategyFastest = "fastest"
+	// Rotate which upstream is tried first for each query
+	StrategyRoundRobin = "round_robin"
+)
+
+// How often (0-1) the fastest strategy probes a slower upstream
+const fastestProbeRate = 0.1
+
+func IsValidStrategy(strategy string) bool {
+	return slices.Contains([]string{"", StrategySequential, StrategyParallel, StrategyFastest, StrategyRoundRobin}, strategy)
+}
+
+// Position of the next round robin rotation for each set of upstreams
+type roundRobinCounter struct {
+	next  map[string]int
+	mutex sync.Mutex
+}
+
+var upstreamRoundRobin = &roundRobinCounter{
+	next: map[string]int{},
+}
+
+func (r *roundRobinCounter) take(key string, count int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	idx := r.next[key] % count
+	r.next[key] = idx + 1
+
+	return idx
+}
+
+type upstreamClient struct {
+	server string
+	client models.DnsQueryClient
+}
+
+// Resolves queries with a set of upstream resolvers according
+// to the configured strategy
+type upstreamGroup struct {
+	upstreams []upstreamClient
+	config    DnsResolverConfig
+}
+
+func (g *upstreamGroup) health() *UpstreamHealth {
+	if g.config.Health != nil {
+		return g.config.Health
+	}
+	return defaultUpstreamHealth
+}
+
+func (g *upstreamGroup) queryUpstream(upstream upstreamClient, query models.DnsQuery) (*models.DnsResponse, error) {
+	start := time.Now()
+	response, err := upstream.client.QueryDns(query)
+
+	if err != nil {
+		g.health().RecordFailure(upstream.server, err)
+	} else if response != nil {
+		g.health().RecordSuccess(upstream.server, time.Since(start))
+	}
+
+	return response, err
+}
+
+// Get the upstreams that aren't known to be down. If every upstream
+// is down they're all returned, since trying them is better than
+// failing outright.
+func (g *upstreamGroup) available() []upstreamClient {
+	available := []upstreamClient{}
+	for _, upstream := range g.upstreams {
+		if !g.health().IsDown(upstream.server) {
+			available = append(available, upstream)
+		}
+	}
+
+	if len(available) < 1 {
+		g.config.Logger.Debug("all upstream resolvers are down - trying them anyway")
+		return g.upstreams
+	}
+
+	return available
+}
+
+// Try each upstream in turn, returning the first successful response.
+// If no upstream succeeds, the first response received (if any) is
+// returned so an authoritative negative answer isn't lost.
+func (g *upstreamGroup) querySequential(upstreams []upstreamClient, query models.DnsQuery) (*models.DnsResponse, error) {
+	var fallback *models.DnsResponse
+	var lastErr error
+
+	for _, upstream := range upstreams {
+		response, err := g.queryUpstream(upstream, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response == nil {
+			continue
+		}
+
+		if response.IsSuccess() {
+			return response, nil
+		}
+
+		if fallback == nil {
+			fallback = response
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, lastErr
+}
+
+func (g *upstreamGroup) queryParallel(upstreams []upstreamClient, query models.DnsQuery) (*models.DnsResponse, error) {
+	type result struct {
+		response *models.DnsResponse
+		err      error
+	}
+
+	results := make(chan result, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream upstreamClient) {
+			response, err := g.queryUpstream(upstream, query)
+			results <- result{response, err}
+		}(upstream)
+	}
+
+	var fallback *models.DnsResponse
+	var lastErr error
+
+	for range upstreams {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+
+		if r.response == nil {
+			continue
+		}
+
+		// Any answer other than a failure is as good as another
+		// upstream's, so slower upstreams aren't waited on for it
+		if rcode := r.response.Rcode(); rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError {
+			return r.response, nil
+		}
+
+		if fallback == nil {
+			fallback = r.response
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, lastErr
+}
+
+func (g *upstreamGroup) queryFastest(upstreams []upstreamClient, query models.DnsQuery) (*models.DnsResponse, error) {
+	upstreams = slices.Clone(upstreams)
+	slices.SortStableFunc(upstreams, func(a, b upstreamClient) int {
+		return cmp.Compare(g.health().Latency(a.server), g.health().Latency(b.server))
+	})
+
+	if len(upstreams) > 1 && rand.Float64() < fastestProbeRate {
+		probe := upstreams[1+rand.IntN(len(upstreams)-1)]
+		g.config.Logger.Debug("probing upstream latency", "server", probe.server)
+		go g.queryUpstream(probe, query)
+	}
+
+	return g.querySequential(upstreams, query)
+}
+
+func (g *upstreamGroup) queryRoundRobin(upstreams []upstreamClient, query models.DnsQuery) (*models.DnsResponse, error) {
+	servers := []string{}
+	for _, upstream := range upstreams {
+		servers = append(servers, upstream.server)
+	}
+
+	start := upstreamRoundRobin.take(strings.Join(servers, ","), len(upstreams))
+	upstreams = append(slices.Clone(upstreams[start:]), upstreams[:start]...)
+
+	return g.querySequential(upstreams, query)
+}
+
+func (g *upstreamGroup) QueryDns(query models.DnsQuery) (*models.DnsResponse, error) {
+	if len(g.upstreams) < 1 {
+		return nil, nil
+	}
+
+	upstreams := g.available()
+
+	switch g.config.Strategy {
+	case StrategyParallel:
+		return g.queryParallel(upstreams, query)
+	case StrategyFastest:
+		return g.queryFastest(upstreams, query)
+	case StrategyRoundRobin:
+		return g.queryRoundRobin(upstreams, query)
+	case StrategySequential, "":
+	default:
+		g.config.Logger.Warn("unknown upstream strategy - using sequential", "strategy", g.config.Strategy)
+	}
+
+	return g.querySequential(upstreams, query)
+}
@@ -0,0 +1,260 @@
+package resolver
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+type fakeUpstream struct {
+	delay   time.Duration
+	fail    bool
+	address string
+	queries *int
+	// Answer with this rcode and no records, if it isn't NOERROR
+	rcode int
+}
+
+func (f fakeUpstream) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	if f.queries != nil {
+		*f.queries += 1
+	}
+	time.Sleep(f.delay)
+	if f.fail {
+		return nil, fmt.Errorf("upstream failed")
+	}
+	if f.rcode != dns.RcodeSuccess {
+		msg := new(dns.Msg)
+		msg.Rcode = f.rcode
+		return models.NewDnsResponseFromMsg(msg)
+	}
+	return models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{
+		{
+			Name: q.FirstQuestion().Name,
+			Type: dns.TypeA,
+			TTL:  30 * time.Second,
+			Data: f.address,
+		},
+	})
+}
+
+func getUpstreamGroup(strategy string, upstreams ...fakeUpstream) *upstreamGroup {
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.Level(slog.LevelDebug),
+	}))
+	group := upstreamGroup{
+		config: DnsResolverConfig{
+			Strategy: strategy,
+			Timeout:  2,
+			Logger:   log,
+			Health: NewUpstreamHealth(UpstreamHealthConfig{
+				Logger:           log,
+				FailureThreshold: 2,
+			}),
+		},
+	}
+
+	for _, upstream := range upstreams {
+		group.upstreams = append(group.upstreams, upstreamClient{upstream.address, upstream})
+	}
+
+	return &group
+}
+
+func getAnswerData(t *testing.T, response *models.DnsResponse) string {
+	if response == nil {
+		t.Fatal("expected a response but got nil")
+	}
+
+	answers, err := response.Answers()
+	if err != nil || len(answers) < 1 {
+		t.Fatalf("expected answers but got %v (err = %v)", answers, err)
+	}
+
+	return answers[0].Data
+}
+
+func TestSequentialStrategySkipsFailedUpstream(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategySequential,
+		fakeUpstream{address: "203.0.113.1", fail: true},
+		fakeUpstream{address: "203.0.113.2"},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	response, err := group.QueryDns(*query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if data := getAnswerData(t, response); data != "203.0.113.2" {
+		t.Errorf("expected answer from second upstream, got %s", data)
+	}
+}
+
+func TestParallelStrategyUsesFirstAnswer(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategyParallel,
+		fakeUpstream{address: "203.0.113.1", delay: time.Second},
+		fakeUpstream{address: "203.0.113.2", fail: true},
+		fakeUpstream{address: "203.0.113.3"},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	start := time.Now()
+	response, err := group.QueryDns(*query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if data := getAnswerData(t, response); data != "203.0.113.3" {
+		t.Errorf("expected answer from fastest upstream, got %s", data)
+	}
+
+	if time.Since(start) >= time.Second {
+		t.Errorf("parallel query waited for the slow upstream")
+	}
+}
+
+func TestParallelStrategyDoesNotWaitForNegativeAnswer(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategyParallel,
+		fakeUpstream{address: "203.0.113.1", delay: time.Second},
+		fakeUpstream{address: "203.0.113.2", rcode: dns.RcodeServerFailure},
+		fakeUpstream{address: "203.0.113.3", delay: 10 * time.Millisecond, rcode: dns.RcodeNameError},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	start := time.Now()
+	response, err := group.QueryDns(*query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if response == nil || response.Rcode() != dns.RcodeNameError {
+		t.Errorf("expected the NXDOMAIN rather than the SERVFAIL, got %v", response)
+	}
+
+	if time.Since(start) >= time.Second {
+		t.Errorf("parallel query waited for the slow upstream after a negative answer")
+	}
+}
+
+func TestParallelStrategyAllFail(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategyParallel,
+		fakeUpstream{address: "203.0.113.1", fail: true},
+		fakeUpstream{address: "203.0.113.2", fail: true},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	response, err := group.QueryDns(*query)
+	if err == nil {
+		t.Errorf("expected an error when every upstream fails, got %v", response)
+	}
+}
+
+func TestAllUpstreamsFailedIsServFail(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategySequential,
+		fakeUpstream{address: "203.0.113.1", fail: true},
+		fakeUpstream{address: "203.0.113.2", fail: true},
+	)
+	client := multiClient{[]models.DnsQueryClient{staticClient{group.config}, group}, group.config}
+
+	// This used to be answered with NXDOMAIN, which clients would
+	// cache as the name not existing
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	response, err := client.QueryDns(*query)
+	if err == nil {
+		t.Errorf("expected the upstream error to be passed on")
+	}
+	if response == nil || response.Rcode() != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL when every upstream fails, got %v", response)
+	}
+}
+
+func TestRoundRobinStrategyRotates(t *testing.T) {
+	first := 0
+	second := 0
+	group := getUpstreamGroup(
+		StrategyRoundRobin,
+		fakeUpstream{address: "203.0.113.11", queries: &first},
+		fakeUpstream{address: "203.0.113.12", queries: &second},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	for i := 0; i < 4; i++ {
+		if _, err := group.QueryDns(*query); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if first != 2 || second != 2 {
+		t.Errorf("queries were not distributed evenly: first = %d, second = %d", first, second)
+	}
+}
+
+func TestFastestStrategyPrefersLowLatency(t *testing.T) {
+	group := getUpstreamGroup(
+		StrategyFastest,
+		fakeUpstream{address: "203.0.113.21"},
+		fakeUpstream{address: "203.0.113.22"},
+	)
+	group.config.Health.RecordSuccess("203.0.113.21", 500*time.Millisecond)
+	group.config.Health.RecordSuccess("203.0.113.22", 5*time.Millisecond)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	response, err := group.QueryDns(*query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if data := getAnswerData(t, response); data != "203.0.113.22" {
+		t.Errorf("expected answer from lowest latency upstream, got %s", data)
+	}
+}
+
+func TestDownUpstreamIsSkipped(t *testing.T) {
+	failing := 0
+	working := 0
+	group := getUpstreamGroup(
+		StrategySequential,
+		fakeUpstream{address: "203.0.113.31", fail: true, queries: &failing},
+		fakeUpstream{address: "203.0.113.32", queries: &working},
+	)
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA}})
+	for i := 0; i < 5; i++ {
+		response, err := group.QueryDns(*query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data := getAnswerData(t, response); data != "203.0.113.32" {
+			t.Errorf("expected answer from working upstream, got %s", data)
+		}
+	}
+
+	if failing != 2 {
+		t.Errorf("failing upstream should be skipped once down: queried %d times, expected 2", failing)
+	}
+
+	if !group.config.Health.IsDown("203.0.113.31") {
+		t.Errorf("failing upstream should be marked down")
+	}
+
+	stats := group.config.Health.Stats()["203.0.113.32"]
+	if stats.Successes != 5 || stats.SuccessRate() != 1 {
+		t.Errorf("wrong stats for working upstream: %+v", stats)
+	}
+
+	group.config.Health.RecordSuccess("203.0.113.31", time.Millisecond)
+	if group.config.Health.IsDown("203.0.113.31") {
+		t.Errorf("upstream should recover after a success")
+	}
+}
@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+const tlsUpstreamScheme = "tls://"
+const defaultDnsOverTlsPort = "853"
+
+// Maximum number of idle connections kept open per DNS over TLS upstream
+const maxIdleTlsConns = 4
+
+// Certificate authorities used to verify DNS over TLS upstreams. If nil,
+// the system roots are used.
+var tlsRootCAs *x509.CertPool
+
+type tlsUpstream struct {
+	// Name the upstream's certificate is verified against (and sent as SNI)
+	ServerName string
+	// Address (host:port) to connect to
+	Addr string
+}
+
+// Parse a DNS over TLS upstream of the form tls://host[:port] or
+// tls://servername@host[:port]. When no server name is given, the
+// host itself is used to verify the certificate.
+func parseTlsUpstream(upstream string) (*tlsUpstream, error) {
+	if !strings.HasPrefix(upstream, tlsUpstreamScheme) {
+		return nil, fmt.Errorf("'%s' is not a dns over tls upstream", upstream)
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("dns over tls upstream '%s' has no host", upstream)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultDnsOverTlsPort
+	}
+
+	serverName := host
+	if u.User != nil && u.User.Username() != "" {
+		serverName = u.User.Username()
+	}
+
+	return &tlsUpstream{
+		ServerName: serverName,
+		Addr:       net.JoinHostPort(host, port),
+	}, nil
+}
+
+// Pool of idle DNS over TLS connections, keyed by upstream. This is
+// shared between clients since a new client is created for each query.
+type tlsConnPool struct {
+	idle  map[string][]*dns.Conn
+	mutex sync.Mutex
+}
+
+var sharedTlsConnPool = &tlsConnPool{
+	idle: map[string][]*dns.Conn{},
+}
+
+func (p *tlsConnPool) get(key string) *dns.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conns := p.idle[key]
+	if len(conns) < 1 {
+		return nil
+	}
+
+	conn := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+
+	return conn
+}
+
+func (p *tlsConnPool) put(key string, conn *dns.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle[key]) >= maxIdleTlsConns {
+		conn.Close()
+		return
+	}
+
+	p.idle[key] = append(p.idle[key], conn)
+}
+
+type tlsClient struct {
+	clientConfig DnsResolverConfig
+}
+
+func (c tlsClient) exchange(m *dns.Msg, upstream *tlsUpstream, key string) (*dns.Msg, error) {
+	timeout := time.Duration(c.clientConfig.Timeout) * time.Second
+
+	client := &dns.Client{
+		Net:          "tcp-tls",
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		TLSConfig: &tls.Config{
+			ServerName: upstream.ServerName,
+			RootCAs:    tlsRootCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	// An idle connection may have been closed by the upstream in the
+	// meantime, so a failure on a reused connection is retried once
+	// on a fresh connection.
+	if conn := sharedTlsConnPool.get(key); conn != nil {
+		r, _, err := client.ExchangeWithConn(m, conn)
+		if err == nil {
+			sharedTlsConnPool.put(key, conn)
+			return r, nil
+		}
+		conn.Close()
+		c.clientConfig.Logger.Debug("reused dns over tls connection failed - reconnecting", "server", key, "error", err)
+	}
+
+	conn, err := client.Dial(upstream.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r, _, err := client.ExchangeWithConn(m, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sharedTlsConnPool.put(key, conn)
+	return r, nil
+}
+
+func (c tlsClient) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	if q.IsMdns() && !c.clientConfig.Mdns.Forward {
+		return nil, nil
+	}
+
+	timer := c.clientConfig.Metrics.GetForwardTimer()
+	defer c.clientConfig.Metrics.ObserveTimer(timer)
+	c.clientConfig.Logger.Debug("attempting to resolve query with dns over tls")
+
+	m := q.PreparedMsg()
+
+	var err error
+
+	for _, server := range c.clientConfig.Servers {
+		upstream, parseErr := parseTlsUpstream(server)
+		if parseErr != nil {
+			c.clientConfig.Logger.Warn("unable to parse dns over tls upstream", "server", server, "error", parseErr)
+			err = parseErr
+			continue
+		}
+
+		host, _, _ := net.SplitHostPort(upstream.Addr)
+		if ip := net.ParseIP(host); ip == nil {
+			if q.FirstQuestion().Name == dns.Fqdn(host) {
+				c.clientConfig.Logger.Warn("not using tls resolver to resolve itself", "host", host)
+				continue
+			}
+		}
+
+		var r *dns.Msg
+		r, err = c.exchange(m, upstream, server)
+		if err != nil {
+			c.clientConfig.Logger.Warn("dns over tls lookup failed - will try next resolver", "server", server, "error", err)
+			continue
+		}
+
+		c.clientConfig.Logger.Debug("dns over tls lookup succeeded", "server", server, "result", fmt.Sprintf("%v", r.Answer))
+		response, err := models.NewDnsResponseFromMsg(r)
+		if response != nil {
+			response.Resolver = server
+		}
+
+		return response, err
+	}
+
+	if err == nil {
+		err = fmt.Errorf("tls lookup failed")
+	}
+
+	return nil, err
+}
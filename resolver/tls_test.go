@@ -0,0 +1,161 @@
+package resolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+func TestParseTlsUpstream(t *testing.T) {
+	testCases := map[string]*tlsUpstream{
+		"tls://1.1.1.1":                   {ServerName: "1.1.1.1", Addr: "1.1.1.1:853"},
+		"tls://1.1.1.1:8853":              {ServerName: "1.1.1.1", Addr: "1.1.1.1:8853"},
+		"tls://dns.example@9.9.9.9:853":   {ServerName: "dns.example", Addr: "9.9.9.9:853"},
+		"tls://dns.example@[2620:fe::fe]": {ServerName: "dns.example", Addr: "[2620:fe::fe]:853"},
+		"tls://dns.example":               {ServerName: "dns.example", Addr: "dns.example:853"},
+		"tls://":                          nil,
+		"1.1.1.1":                         nil,
+		"https://dns.example/dns-query":   nil,
+	}
+
+	for input, expected := range testCases {
+		t.Run(input, func(t *testing.T) {
+			output, err := parseTlsUpstream(input)
+			if expected == nil {
+				if err == nil {
+					t.Errorf("expected error parsing '%s', got %v", input, output)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error parsing '%s': %v", input, err)
+			}
+
+			if *output != *expected {
+				t.Errorf("parseTlsUpstream(%s) actual = %v, expected = %v", input, output, expected)
+			}
+		})
+	}
+}
+
+func getTestCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTlsClientVerifiesAndReusesConnections(t *testing.T) {
+	cert, pool := getTestCertificate(t, "dns.example")
+	tlsRootCAs = pool
+	defer func() { tlsRootCAs = nil }()
+
+	remotes := map[string]bool{}
+	remotesMutex := sync.Mutex{}
+
+	started := sync.Mutex{}
+	started.Lock()
+	server := &dns.Server{
+		Addr:              "127.0.0.1:0",
+		Net:               "tcp-tls",
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+		NotifyStartedFunc: started.Unlock,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			remotesMutex.Lock()
+			remotes[w.RemoteAddr().String()] = true
+			remotesMutex.Unlock()
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+				A:   net.ParseIP("203.0.113.1"),
+			})
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ListenAndServe()
+	started.Lock()
+	defer server.Shutdown()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.Level(slog.LevelDebug),
+	}))
+
+	getClient := func(upstream string) tlsClient {
+		return tlsClient{DnsResolverConfig{
+			Servers: []string{upstream},
+			Logger:  log,
+			Timeout: 2,
+			Metrics: metrics.DummyMetrics{},
+			Mdns:    NewDefaultMdnsConfig(),
+		}}
+	}
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+
+	upstream := fmt.Sprintf("tls://dns.example@127.0.0.1:%s", port)
+	for i := 0; i < 3; i++ {
+		response, err := getClient(upstream).QueryDns(*query)
+		if err != nil {
+			t.Fatalf("unexpected error resolving over tls: %v", err)
+		}
+		if response == nil || response.IsEmpty() {
+			t.Fatalf("expected an answer resolving over tls")
+		}
+		if response.Resolver != upstream {
+			t.Errorf("wrong resolver recorded, actual = %s, expected = %s", response.Resolver, upstream)
+		}
+	}
+
+	if len(remotes) != 1 {
+		t.Errorf("expected a single reused connection, got %d", len(remotes))
+	}
+
+	response, err := getClient(fmt.Sprintf("tls://wrong.example@127.0.0.1:%s", port)).QueryDns(*query)
+	if err == nil {
+		t.Errorf("expected certificate verification to fail for the wrong server name, got %v", response)
+	}
+}
@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+const defaultDnsPort = "53"
+
+// A plain (unencrypted) DNS upstream
+type dnsUpstream struct {
+	// Transport to use, either udp or tcp
+	Net string
+	// Address (host:port) to send queries to
+	Addr string
+}
+
+// Whether a string is an IP address, including IPv6 addresses
+// with a zone such as fe80::1%eth0
+func isIpAddress(addr string) bool {
+	_, err := netip.ParseAddr(addr)
+	return err == nil
+}
+
+// Parse a plain DNS upstream. Upstreams may be a bare IP address
+// (1.1.1.1, 2606:4700::1111), an address with a port (127.0.0.1:5353,
+// [::1]:5300) or either of those prefixed with a transport (udp:// or
+// tcp://). Hostnames are only accepted with an explicit transport so
+// they aren't confused with DNS over HTTPS endpoints. The port defaults
+// to 53 and the transport to udp.
+func parseDnsUpstream(upstream string) (*dnsUpstream, error) {
+	network := "udp"
+	hostport := upstream
+	explicitNet := false
+
+	for _, scheme := range []string{"udp", "tcp"} {
+		if strings.HasPrefix(upstream, scheme+"://") {
+			u, err := url.Parse(upstream)
+			if err != nil {
+				return nil, err
+			}
+			if u.Path != "" || u.User != nil || u.RawQuery != "" {
+				return nil, fmt.Errorf("dns upstream '%s' must only contain a host and port", upstream)
+			}
+			network = scheme
+			hostport = u.Host
+			explicitNet = true
+			break
+		}
+	}
+
+	host := hostport
+	port := defaultDnsPort
+
+	if !isIpAddress(hostport) {
+		// Not a bare address, so this is either [v6], [v6]:port,
+		// v4:port or host:port.
+		if strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]") {
+			host = hostport[1 : len(hostport)-1]
+		} else {
+			h, p, err := net.SplitHostPort(hostport)
+			if err != nil {
+				if !explicitNet {
+					return nil, fmt.Errorf("'%s' is not a dns upstream: %v", upstream, err)
+				}
+				h = hostport
+				p = defaultDnsPort
+			}
+			host = h
+			port = cmp.Or(p, defaultDnsPort)
+		}
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("dns upstream '%s' has no host", upstream)
+	}
+
+	if !isIpAddress(host) && !explicitNet {
+		return nil, fmt.Errorf("dns upstream '%s' is not an IP address", upstream)
+	}
+
+	if _, err := net.LookupPort(network, port); err != nil {
+		return nil, fmt.Errorf("dns upstream '%s' has an invalid port: %v", upstream, err)
+	}
+
+	return &dnsUpstream{
+		Net:  network,
+		Addr: net.JoinHostPort(host, port),
+	}, nil
+}
+
+// Check that an upstream resolver is a plain DNS upstream, a DNS
+// over TLS upstream or a DNS over HTTPS URL
+func ValidateUpstream(upstream string) error {
+	if strings.HasPrefix(upstream, tlsUpstreamScheme) {
+		_, err := parseTlsUpstream(upstream)
+		return err
+	}
+
+	if _, err := parseDnsUpstream(upstream); err == nil {
+		return nil
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("'%s' is not a dns upstream or dns over https url", upstream)
+	}
+
+	return nil
+}
+
+// Get the name of an upstream used in metrics. DNS over HTTPS URLs
+// are reduced to their scheme, host and port, since their path, query
+// or user info can hold an access token.
+func upstreamLabel(upstream string) string {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return upstream
+	}
+
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,150 @@
+package rpz
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// What is done with a query that matches a trigger
+const (
+	// Answer that the name doesn't exist (CNAME .)
+	ActionNxdomain = "nxdomain"
+	// Answer that the name has no records of the type (CNAME *.)
+	ActionNodata = "nodata"
+	// Answer normally, ignoring any later policy (CNAME rpz-passthru.)
+	ActionPassthru = "passthru"
+	// Don't answer at all (CNAME rpz-drop.)
+	ActionDrop = "drop"
+	// Answer with the records in the zone
+	ActionLocalData = "local-data"
+)
+
+// Kinds of trigger
+const (
+	// The name in the query
+	TriggerQname = "qname"
+	// An address in the answer
+	TriggerIp = "ip"
+	// The name of a nameserver for the name in the query
+	TriggerNsdname = "nsdname"
+)
+
+// Special CNAME targets that select an action rather than local data
+var cnameActions = map[string]string{
+	".":             ActionNxdomain,
+	"*.":            ActionNodata,
+	"rpz-passthru.": ActionPassthru,
+	"rpz-drop.":     ActionDrop,
+}
+
+// The action for a trigger
+type policy struct {
+	// The name or network that triggers the policy
+	trigger string
+	action  string
+	// The records to answer with for local data
+	data []dns.RR
+}
+
+// Get the policy given by a trigger's records
+func newPolicy(records []dns.RR) (*policy, bool) {
+	if len(records) == 1 {
+		if cname, ok := records[0].(*dns.CNAME); ok {
+			target := strings.ToLower(cname.Target)
+			if action, ok := cnameActions[target]; ok {
+				return &policy{action: action}, true
+			}
+			// Only sent over TCP, which needs the transport
+			if strings.HasPrefix(target, "rpz-") {
+				return nil, false
+			}
+		}
+	}
+
+	return &policy{action: ActionLocalData, data: records}, true
+}
+
+// A query that matched a trigger in a zone
+type Hit struct {
+	// The name of the zone in the config
+	Zone    string
+	Trigger string
+	// The name or network that matched
+	Match  string
+	Action string
+
+	policy *policy
+	soa    dns.RR
+}
+
+// Get the local data answering a question
+func (h Hit) localData(question dns.Question) *models.DnsResponse {
+	msg := new(dns.Msg)
+	var cname *dns.CNAME
+
+	for _, rr := range h.policy.data {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeCNAME && cname == nil {
+			cname = dns.Copy(rr).(*dns.CNAME)
+		}
+		if header.Rrtype != question.Qtype && question.Qtype != dns.TypeANY {
+			continue
+		}
+
+		answer := dns.Copy(rr)
+		answer.Header().Name = question.Name
+		msg.Answer = append(msg.Answer, answer)
+	}
+
+	if len(msg.Answer) == 0 && cname != nil {
+		cname.Hdr.Name = question.Name
+		// *.example.com as a target means the query name under
+		// example.com
+		if suffix, ok := strings.CutPrefix(cname.Target, "*."); ok {
+			cname.Target = question.Name + suffix
+		}
+		msg.Answer = []dns.RR{cname}
+	}
+
+	if len(msg.Answer) == 0 && h.soa != nil {
+		msg.Ns = []dns.RR{dns.Copy(h.soa)}
+	}
+
+	response, err := models.NewDnsResponseFromMsg(msg)
+	if err != nil {
+		return models.NewServFailDnsResponse()
+	}
+	return response
+}
+
+// Get the answer to a question that matched the trigger, or nil if
+// the query should be answered normally
+func (h Hit) Response(question dns.Question) *models.DnsResponse {
+	var response *models.DnsResponse
+
+	switch h.Action {
+	case ActionNxdomain, ActionNodata:
+		rcode := dns.RcodeSuccess
+		if h.Action == ActionNxdomain {
+			rcode = dns.RcodeNameError
+		}
+
+		var err error
+		response, err = models.NewNegativeDnsResponse(rcode, dns.Copy(h.soa))
+		if err != nil {
+			return models.NewServFailDnsResponse()
+		}
+	case ActionDrop:
+		response = models.NewNoErrorDnsResponse()
+		response.Dropped = true
+	case ActionLocalData:
+		response = h.localData(question)
+	default:
+		return nil
+	}
+
+	response.Blocked = true
+	return response
+}
@@ -0,0 +1,215 @@
+package rpz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/filewatch"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+type ZoneConfig struct {
+	// A name for the zone used in logs and metrics
+	Name string
+	File string
+	// The zone's origin. Empty takes it from the zone's SOA.
+	Origin string
+}
+
+type RpzConfig struct {
+	// Zones in the order their policies are applied
+	Zones   []ZoneConfig
+	Logger  *slog.Logger
+	Metrics metrics.MetricsInterface
+}
+
+// The zones that were read
+type zoneSet struct {
+	zones []*zone
+}
+
+// Apply response policy zones to queries
+type Rpz struct {
+	zones  *filewatch.Reloader[[]ZoneConfig, zoneSet]
+	config RpzConfig
+}
+
+func NewRpz(config RpzConfig) *Rpz {
+	rpz := &Rpz{config: config}
+	rpz.zones = filewatch.NewReloader(config.Zones, filewatch.Source[[]ZoneConfig, zoneSet]{
+		Name:   "response policy zones",
+		Logger: config.Logger,
+		Files:  zoneFiles,
+		Read:   rpz.read,
+		Equal:  slices.Equal[[]ZoneConfig],
+		Loaded: rpz.exportRules,
+	})
+
+	return rpz
+}
+
+func zoneFiles(zones []ZoneConfig) []string {
+	files := []string{}
+	for _, zoneConfig := range zones {
+		files = append(files, zoneConfig.File)
+	}
+	return files
+}
+
+// Read every zone, returning the ones that could be read along with
+// an error for the ones that couldn't
+func (r *Rpz) read(zoneConfigs []ZoneConfig) (*zoneSet, error) {
+	zones := &zoneSet{}
+	errs := []error{}
+
+	for _, zoneConfig := range zoneConfigs {
+		parsed, skipped, err := readZone(zoneConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("response policy zone '%s': %w", zoneConfig.Name, err))
+			continue
+		}
+
+		r.config.Logger.Info("read response policy zone", "zone", parsed.name, "origin", parsed.origin, "rules", parsed.rules(), "skipped", skipped)
+		zones.zones = append(zones.zones, parsed)
+	}
+
+	return zones, errors.Join(errs...)
+}
+
+// Export the number of rules in each zone once the zones are in use,
+// removing zones that are no longer used
+func (r *Rpz) exportRules(previous *zoneSet, current *zoneSet) {
+	names := map[string]bool{}
+	for _, parsed := range current.zones {
+		names[parsed.name] = true
+		r.config.Metrics.SetRpzRules(parsed.name, parsed.rules())
+	}
+
+	if previous != nil {
+		for _, parsed := range previous.zones {
+			if !names[parsed.name] {
+				r.config.Metrics.DeleteRpzRules(parsed.name)
+			}
+		}
+	}
+}
+
+func readZone(config ZoneConfig) (*zone, int, error) {
+	file, err := os.Open(config.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	return parseZone(config.Name, file, config.Origin, config.File)
+}
+
+// Re-read the zones. If any can't be read, the zones already in use
+// are kept.
+func (r *Rpz) Reload() error {
+	return r.zones.Reload()
+}
+
+// Replace the zones that are used, re-reading them if they changed
+func (r *Rpz) Reconfigure(zones []ZoneConfig) error {
+	return r.zones.Reconfigure(zones)
+}
+
+// Reload the zones whenever their files change
+func (r *Rpz) Watch() context.CancelFunc {
+	return r.zones.Watch()
+}
+
+func (r *Rpz) loaded() []*zone {
+	zones := r.zones.Get()
+	if zones == nil {
+		return nil
+	}
+	return zones.zones
+}
+
+func newHit(parsed *zone, trigger string, rule *policy) *Hit {
+	return &Hit{
+		Zone:    parsed.name,
+		Trigger: trigger,
+		Match:   rule.trigger,
+		Action:  rule.action,
+		policy:  rule,
+		soa:     parsed.soa,
+	}
+}
+
+// Get the first policy for the name in a query
+func (r *Rpz) MatchQname(name string) *Hit {
+	for _, parsed := range r.loaded() {
+		if rule := parsed.qname.match(name); rule != nil {
+			return newHit(parsed, TriggerQname, rule)
+		}
+	}
+
+	return nil
+}
+
+// Get the first policy for an address in an answer
+func (r *Rpz) MatchResponse(response *models.DnsResponse) *Hit {
+	zones := r.loaded()
+	if len(zones) == 0 || response == nil {
+		return nil
+	}
+
+	addrs := []netip.Addr{}
+	for _, rr := range response.AnswerRRs() {
+		var addr netip.Addr
+		var ok bool
+		switch record := rr.(type) {
+		case *dns.A:
+			addr, ok = netip.AddrFromSlice(record.A)
+		case *dns.AAAA:
+			addr, ok = netip.AddrFromSlice(record.AAAA)
+		}
+		if ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+
+	for _, parsed := range zones {
+		for _, addr := range addrs {
+			if rule := parsed.matchIp(addr); rule != nil {
+				return newHit(parsed, TriggerIp, rule)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Whether any zone has NSDNAME triggers, which need the nameservers
+// of a name to be looked up
+func (r *Rpz) HasNsdnameTriggers() bool {
+	for _, parsed := range r.loaded() {
+		if parsed.nsdname.len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the first policy for the nameservers of the name in a query
+func (r *Rpz) MatchNsdname(nameservers []string) *Hit {
+	for _, parsed := range r.loaded() {
+		for _, nameserver := range nameservers {
+			if rule := parsed.nsdname.match(nameserver); rule != nil {
+				return newHit(parsed, TriggerNsdname, rule)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package rpz
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/internal/testfile"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+const testZone = `$TTL 300
+@ IN SOA localhost. hostmaster.localhost. 1 3600 600 86400 60
+@ IN NS localhost.
+
+bad.example.com          CNAME .
+*.bad.example.com        CNAME .
+empty.example.com        CNAME *.
+good.bad.example.com     CNAME rpz-passthru.
+silent.example.com       CNAME rpz-drop.
+tcp.example.com          CNAME rpz-tcp-only.
+garden.example.com       CNAME walled.example.net.
+*.moved.example.com      CNAME *.walled.example.net.
+local.example.com        A 192.0.2.10
+local.example.com        A 192.0.2.11
+local.example.com        TXT "blocked by policy"
+
+32.1.2.0.192.rpz-ip      CNAME .
+24.0.113.0.203.rpz-ip    CNAME rpz-drop.
+16.0.0.51.198.rpz-ip     A 192.0.2.99
+128.1.zz.db8.2001.rpz-ip CNAME *.
+ns1.evil.example.rpz-nsdname   CNAME .
+*.evil.example.rpz-nsdname     CNAME .
+32.1.2.0.192.rpz-nsip          CNAME .
+`
+
+func getTestRpz(zones ...ZoneConfig) *Rpz {
+	return NewRpz(RpzConfig{
+		Zones:   zones,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: metrics.DummyMetrics{},
+	})
+}
+
+func TestParseIpTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.2.0.192":           "192.0.2.1/32",
+		"24.0.2.0.192":           "192.0.2.0/24",
+		"128.1.zz.db8.2001":      "2001:db8::1/128",
+		"48.zz.db8.2001":         "2001:db8::/48",
+		"128.1.zz":               "::1/128",
+		"33.1.2.0.192":           "",
+		"32.1.2.0":               "",
+		"abc.1.2.0.192":          "",
+		"64.1.2.3.4.5.6.7.8.9.0": "",
+	}
+
+	for trigger, expected := range tests {
+		prefix, ok := parseIpTrigger(trigger)
+		if ok != (expected != "") || (ok && prefix.String() != expected) {
+			t.Errorf("%s: expected '%s', got '%s' (%v)", trigger, expected, prefix, ok)
+		}
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	file, err := os.Open(testfile.Write(t, "policy.rpz", testZone))
+	if err != nil {
+		t.Fatalf("failed to open zone: %v", err)
+	}
+	defer file.Close()
+
+	parsed, skipped, err := parseZone("test", file, "rpz.example.", "test.rpz")
+	if err != nil {
+		t.Fatalf("unexpected error parsing zone: %v", err)
+	}
+
+	// rpz-tcp-only and rpz-nsip aren't supported
+	if skipped != 2 {
+		t.Errorf("expected 2 triggers to be skipped, got %d", skipped)
+	}
+	if parsed.rules() != 14 {
+		t.Errorf("expected 14 rules, got %d", parsed.rules())
+	}
+
+	if _, _, err := parseZone("test", file, "", "test.rpz"); err == nil {
+		t.Errorf("expected an error for a zone without an SOA")
+	}
+}
+
+func TestMatchQname(t *testing.T) {
+	policies := getTestRpz(ZoneConfig{Name: "test", File: testfile.Write(t, "policy.rpz", testZone), Origin: "rpz.example."})
+
+	tests := map[string]string{
+		"bad.example.com.":        ActionNxdomain,
+		"BAD.example.com":         ActionNxdomain,
+		"www.bad.example.com.":    ActionNxdomain,
+		"good.bad.example.com.":   ActionPassthru,
+		"empty.example.com.":      ActionNodata,
+		"silent.example.com.":     ActionDrop,
+		"garden.example.com.":     ActionLocalData,
+		"tcp.example.com.":        "",
+		"example.com.":            "",
+		"moved.example.com.":      "",
+		"www.moved.example.com.":  ActionLocalData,
+		"www.example.com.":        "",
+		"rpz-ip.rpz.example.com.": "",
+	}
+
+	for name, expected := range tests {
+		hit := policies.MatchQname(name)
+		if (hit == nil) != (expected == "") || (hit != nil && hit.Action != expected) {
+			t.Errorf("%s: expected action '%s', got %+v", name, expected, hit)
+		}
+	}
+
+	if hit := policies.MatchQname("www.bad.example.com."); hit.Match != "*.bad.example.com." || hit.Trigger != TriggerQname || hit.Zone != "test" {
+		t.Errorf("unexpected hit %+v", hit)
+	}
+}
+
+func TestLocalDataResponse(t *testing.T) {
+	policies := getTestRpz(ZoneConfig{Name: "test", File: testfile.Write(t, "policy.rpz", testZone), Origin: "rpz.example."})
+
+	question := dns.Question{Name: "local.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	response := policies.MatchQname(question.Name).Response(question)
+	if answers := response.AnswerRRs(); len(answers) != 2 || answers[0].Header().Name != question.Name {
+		t.Errorf("expected both A records, got %v", answers)
+	}
+	if !response.Blocked {
+		t.Errorf("expected the response to be marked as blocked")
+	}
+
+	question.Qtype = dns.TypeMX
+	response = policies.MatchQname(question.Name).Response(question)
+	if !response.IsNegative() || response.Soa() == nil {
+		t.Errorf("expected NODATA with an SOA for a type without local data")
+	}
+
+	question = dns.Question{Name: "www.moved.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	response = policies.MatchQname(question.Name).Response(question)
+	answers := response.AnswerRRs()
+	if len(answers) != 1 || answers[0].(*dns.CNAME).Target != "www.moved.example.com.walled.example.net." {
+		t.Errorf("expected the wildcard CNAME target to be expanded, got %v", answers)
+	}
+
+	question = dns.Question{Name: "bad.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	response = policies.MatchQname(question.Name).Response(question)
+	if response.Rcode() != dns.RcodeNameError || response.Soa() == nil {
+		t.Errorf("expected NXDOMAIN with an SOA")
+	}
+
+	question = dns.Question{Name: "silent.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if response := policies.MatchQname(question.Name).Response(question); !response.Dropped {
+		t.Errorf("expected the response to be dropped")
+	}
+
+	question = dns.Question{Name: "good.bad.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if response := policies.MatchQname(question.Name).Response(question); response != nil {
+		t.Errorf("expected no response for passthru")
+	}
+}
+
+func TestMatchResponse(t *testing.T) {
+	policies := getTestRpz(ZoneConfig{Name: "test", File: testfile.Write(t, "policy.rpz", testZone), Origin: "rpz.example."})
+
+	tests := map[string]string{
+		"192.0.2.1":     ActionNxdomain,
+		"192.0.2.2":     "",
+		"203.0.113.200": ActionDrop,
+		"198.51.7.7":    ActionLocalData,
+		"2001:db8::1":   ActionNodata,
+		"2001:db8::2":   "",
+	}
+
+	for address, expected := range tests {
+		addr := netip.MustParseAddr(address)
+		answer := models.DNSAnswer{Name: "www.example.com.", Type: dns.TypeA, TTL: time.Minute, Data: address}
+		if addr.Is6() {
+			answer.Type = dns.TypeAAAA
+		}
+
+		response, err := models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{answer})
+		if err != nil {
+			t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+		}
+
+		hit := policies.MatchResponse(response)
+		if (hit == nil) != (expected == "") || (hit != nil && (hit.Action != expected || hit.Trigger != TriggerIp)) {
+			t.Errorf("%s: expected action '%s', got %+v", address, expected, hit)
+		}
+	}
+}
+
+func TestMatchNsdname(t *testing.T) {
+	policies := getTestRpz(ZoneConfig{Name: "test", File: testfile.Write(t, "policy.rpz", testZone), Origin: "rpz.example."})
+
+	if !policies.HasNsdnameTriggers() {
+		t.Fatalf("expected nsdname triggers")
+	}
+	if hit := policies.MatchNsdname([]string{"ns.example.net.", "ns1.evil.example."}); hit == nil || hit.Match != "ns1.evil.example." {
+		t.Errorf("expected the nameserver to match, got %+v", hit)
+	}
+	if hit := policies.MatchNsdname([]string{"a.ns.evil.example"}); hit == nil || hit.Match != "*.evil.example." {
+		t.Errorf("expected the wildcard to match, got %+v", hit)
+	}
+	if hit := policies.MatchNsdname([]string{"evil.example."}); hit != nil {
+		t.Errorf("expected no match, got %+v", hit)
+	}
+}
+
+func TestZonesAreAppliedInOrder(t *testing.T) {
+	first := testfile.Write(t, "policy.rpz", "$ORIGIN first.\n@ 60 SOA localhost. root.localhost. 1 1 1 1 1\nwww.example.com CNAME rpz-passthru.\n")
+	second := testfile.Write(t, "policy.rpz", testZone)
+
+	policies := getTestRpz(
+		ZoneConfig{Name: "first", File: first},
+		ZoneConfig{Name: "second", File: second, Origin: "second."},
+	)
+
+	if hit := policies.MatchQname("www.example.com."); hit == nil || hit.Zone != "first" {
+		t.Errorf("expected the first zone to match, got %+v", hit)
+	}
+	if hit := policies.MatchQname("bad.example.com."); hit == nil || hit.Zone != "second" {
+		t.Errorf("expected the second zone to match, got %+v", hit)
+	}
+}
+
+func TestReconfigureKeepsZonesWhenInvalid(t *testing.T) {
+	path := testfile.Write(t, "policy.rpz", testZone)
+	policies := getTestRpz(ZoneConfig{Name: "test", File: path, Origin: "rpz.example."})
+
+	invalid := testfile.Write(t, "policy.rpz", "bad.example.com CNAME .\n")
+	if err := policies.Reconfigure([]ZoneConfig{{Name: "test", File: invalid}}); err == nil {
+		t.Errorf("expected an error for a zone without an SOA")
+	}
+	if hit := policies.MatchQname("bad.example.com."); hit == nil {
+		t.Errorf("expected the previous zone to be kept")
+	}
+
+	if err := policies.Reconfigure([]ZoneConfig{}); err != nil {
+		t.Errorf("unexpected error removing the zones: %v", err)
+	}
+	if hit := policies.MatchQname("bad.example.com."); hit != nil {
+		t.Errorf("expected no policies once the zones are removed")
+	}
+}
@@ -0,0 +1,257 @@
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Labels that end the owner names of triggers other than QNAME
+const (
+	ipLabel       = "rpz-ip"
+	nsdnameLabel  = "rpz-nsdname"
+	nsipLabel     = "rpz-nsip"
+	clientIpLabel = "rpz-client-ip"
+)
+
+// Triggers matched by names. Exact names only match themselves,
+// while wildcards (*.example.com) only match the names under them.
+type nameTriggers struct {
+	exact    map[string]*policy
+	wildcard map[string]*policy
+}
+
+func newNameTriggers() nameTriggers {
+	return nameTriggers{exact: map[string]*policy{}, wildcard: map[string]*policy{}}
+}
+
+func (n nameTriggers) add(name string, rule *policy) {
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		n.wildcard[parent] = rule
+	} else {
+		n.exact[name] = rule
+	}
+}
+
+// Get the policy for a name, preferring an exact match and then the
+// most specific wildcard
+func (n nameTriggers) match(name string) *policy {
+	if len(n.exact) == 0 && len(n.wildcard) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	if rule, ok := n.exact[name]; ok {
+		return rule
+	}
+
+	for suffix := name; ; {
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 || dot == len(suffix)-1 {
+			return nil
+		}
+		suffix = suffix[dot+1:]
+
+		if rule, ok := n.wildcard[suffix]; ok {
+			return rule
+		}
+	}
+}
+
+func (n nameTriggers) len() int {
+	return len(n.exact) + len(n.wildcard)
+}
+
+// A response policy zone
+type zone struct {
+	name   string
+	origin string
+	soa    dns.RR
+
+	qname   nameTriggers
+	nsdname nameTriggers
+	// IP triggers by prefix length, longest first
+	ipBits []int
+	ip     map[int]map[netip.Prefix]*policy
+}
+
+func (z *zone) rules() int {
+	rules := z.qname.len() + z.nsdname.len()
+	for _, prefixes := range z.ip {
+		rules += len(prefixes)
+	}
+	return rules
+}
+
+// Get the policy for an address, preferring the longest prefix
+func (z *zone) matchIp(addr netip.Addr) *policy {
+	addr = addr.Unmap()
+	for _, bits := range z.ipBits {
+		if bits > addr.BitLen() {
+			continue
+		}
+
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if rule, ok := z.ip[bits][prefix]; ok {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Parse the owner of an IP trigger, such as 24.0.2.0.192 for
+// 192.0.2.0/24 or 128.1.zz.db8.2001 for 2001:db8::1/128
+func parseIpTrigger(name string) (netip.Prefix, bool) {
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, false
+	}
+
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	address := labels[1:]
+	for i, j := 0, len(address)-1; i < j; i, j = i+1, j-1 {
+		address[i], address[j] = address[j], address[i]
+	}
+
+	var text string
+	if len(address) == 4 && !strings.Contains(name, "zz") {
+		text = strings.Join(address, ".")
+	} else {
+		for i, label := range address {
+			if label == "zz" {
+				address[i] = ""
+			}
+		}
+		text = strings.Join(address, ":")
+		if strings.HasPrefix(text, ":") {
+			text = ":" + text
+		}
+		if strings.HasSuffix(text, ":") {
+			text += ":"
+		}
+	}
+
+	addr, err := netip.ParseAddr(text)
+	if err != nil || bits < 1 || bits > addr.BitLen() {
+		return netip.Prefix{}, false
+	}
+
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+// Read a response policy zone in RFC 1035 format. The origin is
+// taken from the zone's SOA if it's not given. Returns the zone and
+// the number of triggers that were skipped because they're invalid or
+// not supported.
+func parseZone(name string, reader io.Reader, origin string, path string) (*zone, int, error) {
+	if origin != "" {
+		origin = strings.ToLower(dns.Fqdn(origin))
+	}
+
+	parser := dns.NewZoneParser(reader, origin, path)
+	parser.SetIncludeAllowed(false)
+
+	parsed := &zone{
+		name:    name,
+		origin:  origin,
+		qname:   newNameTriggers(),
+		nsdname: newNameTriggers(),
+		ip:      map[int]map[netip.Prefix]*policy{},
+	}
+
+	// Records for each owner, in the order the owners were found
+	owners := []string{}
+	records := map[string][]dns.RR{}
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+
+		if soa, ok := rr.(*dns.SOA); ok && parsed.soa == nil {
+			parsed.soa = soa
+			if parsed.origin == "" {
+				parsed.origin = owner
+			}
+			continue
+		}
+
+		if parsed.origin == "" {
+			return nil, 0, fmt.Errorf("%s: the zone has no SOA to take its origin from", path)
+		}
+
+		// The NS records of the zone itself aren't policy
+		if owner == parsed.origin {
+			continue
+		}
+
+		if _, ok := records[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		records[owner] = append(records[owner], rr)
+	}
+
+	if err := parser.Err(); err != nil {
+		return nil, 0, err
+	}
+	if parsed.soa == nil {
+		return nil, 0, fmt.Errorf("%s: the zone has no SOA", path)
+	}
+
+	skipped := 0
+	for _, owner := range owners {
+		trigger, ok := strings.CutSuffix(owner, "."+parsed.origin)
+		if !ok {
+			skipped++
+			continue
+		}
+
+		rule, ok := newPolicy(records[owner])
+		if !ok {
+			skipped++
+			continue
+		}
+
+		labels := dns.SplitDomainName(trigger)
+		switch labels[len(labels)-1] {
+		case ipLabel:
+			prefix, ok := parseIpTrigger(strings.Join(labels[:len(labels)-1], "."))
+			if !ok {
+				skipped++
+				continue
+			}
+			if _, ok := parsed.ip[prefix.Bits()]; !ok {
+				parsed.ip[prefix.Bits()] = map[netip.Prefix]*policy{}
+				parsed.ipBits = append(parsed.ipBits, prefix.Bits())
+			}
+			rule.trigger = prefix.String()
+			parsed.ip[prefix.Bits()][prefix] = rule
+		case nsdnameLabel:
+			rule.trigger = dns.Fqdn(strings.Join(labels[:len(labels)-1], "."))
+			parsed.nsdname.add(rule.trigger, rule)
+		case nsipLabel, clientIpLabel:
+			skipped++
+		default:
+			rule.trigger = dns.Fqdn(trigger)
+			parsed.qname.add(rule.trigger, rule)
+		}
+	}
+
+	// Longest prefixes are the most specific
+	slices.Sort(parsed.ipBits)
+	slices.Reverse(parsed.ipBits)
+
+	return parsed, skipped, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/blocklist"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/daemon"
+	"github.com/thenaterhood/spuddns/localzone"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/resolver"
+	"github.com/thenaterhood/spuddns/rpz"
+	"github.com/thenaterhood/spuddns/server"
+	"github.com/thenaterhood/spuddns/system"
+)
+
+// How long queries being answered are given to finish at shutdown
+const shutdownTimeout = 10 * time.Second
+
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func logCacheStats(state app.AppState) {
+	stats := state.Cache.Stats()
+	state.Log.Info(
+		"cache stats",
+		"entries", stats.Entries,
+		"bytes", stats.Bytes,
+		"max_entries", stats.MaxEntries,
+		"max_bytes", stats.MaxBytes,
+		"hits", stats.Hits,
+		"misses", stats.Misses,
+		"evictions", stats.Evictions,
+	)
+}
+
+func getCacheConfig(config *app.AppConfig, logger *slog.Logger, metrics metrics.MetricsInterface) cache.CacheConfig {
+	cacheConfig := cache.CacheConfig{
+		Logger:  logger,
+		Metrics: metrics,
+		Enable:  !config.DisableCache,
+
+		MaxEntries:     config.CacheMaxEntries,
+		MaxBytes:       config.CacheMaxBytes,
+		EvictionPolicy: config.CacheEvictionPolicy,
+		PersistSync:    config.PersistentCacheSync,
+	}
+	if config.ServeStale {
+		cacheConfig.MaxStale = time.Duration(config.ServeStaleMaxAge) * time.Second
+	}
+
+	return cacheConfig
+}
+
+// Run the server until it's stopped by a signal, returning the
+// exit status
+func serve(conffile string) int {
+	config, err := app.GetConfig(conffile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n%v\n", conffile, err)
+		return 1
+	}
+
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(slog.Level(config.LogLevel))
+	stdoutLogger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+
+	if len(config.UpstreamResolvers) < 1 {
+		stdoutLogger.Warn("no upstream resolvers are configured!")
+	}
+	for _, deprecation := range config.Deprecations() {
+		stdoutLogger.Warn("config uses a deprecated setting", "detail", deprecation)
+	}
+
+	metrics := metrics.GetMetrics(metrics.MetricsConfig{
+		Enable: !config.DisableMetrics,
+		Logger: stdoutLogger,
+	})
+
+	cache, cacheErr := cache.GetCache(getCacheConfig(config, stdoutLogger, metrics))
+	if cacheErr != nil {
+		stdoutLogger.Warn("failed to initialize cache - disabling caching", "err", cacheErr)
+	}
+
+	state := app.AppState{
+		Blocklist: blocklist.NewBlocklist(blocklist.BlocklistConfig{
+			Lists:      config.Blocklists,
+			Allowlists: config.Allowlists,
+			Logger:     stdoutLogger,
+			Metrics:    metrics,
+		}),
+		Cache: cache,
+		LocalZones: localzone.NewLocalZones(localzone.LocalZonesConfig{
+			Zones:  config.GetLocalZones(),
+			Logger: stdoutLogger,
+		}),
+		Log:     stdoutLogger,
+		Metrics: metrics,
+		Rpz: rpz.NewRpz(rpz.RpzConfig{
+			Zones:   config.GetRpzZones(),
+			Logger:  stdoutLogger,
+			Metrics: metrics,
+		}),
+		UpstreamHealth: resolver.NewUpstreamHealth(resolver.UpstreamHealthConfig{
+			Logger:           stdoutLogger,
+			Metrics:          metrics,
+			FailureThreshold: config.UpstreamFailureThreshold,
+		}),
+	}
+
+	liveConfig := app.NewLiveConfig(conffile, config)
+	liveConfig.OnReload(func(_ *app.AppConfig, current *app.AppConfig) {
+		logLevel.Set(slog.Level(current.LogLevel))
+		for _, deprecation := range current.Deprecations() {
+			stdoutLogger.Warn("config uses a deprecated setting", "detail", deprecation)
+		}
+	})
+
+	// Background tasks, which are stopped in the reverse order at
+	// shutdown
+	stops := []context.CancelFunc{}
+
+	persistentCache := daemon.NewPersistentCache(liveConfig, &state)
+	stops = append(stops, persistentCache.Start())
+
+	stops = append(stops, state.LocalZones.Watch())
+	liveConfig.OnReload(func(_ *app.AppConfig, current *app.AppConfig) {
+		if err := state.LocalZones.Reconfigure(current.GetLocalZones()); err != nil {
+			state.Log.Error("failed to read local zones - keeping the previous ones", "err", err)
+		}
+	})
+
+	stops = append(stops, state.Blocklist.Watch())
+	liveConfig.OnReload(func(_ *app.AppConfig, current *app.AppConfig) {
+		if err := state.Blocklist.Reconfigure(current.Blocklists, current.Allowlists); err != nil {
+			state.Log.Error("failed to read blocklists - keeping the previous ones", "err", err)
+		}
+	})
+
+	stops = append(stops, state.Rpz.Watch())
+	liveConfig.OnReload(func(_ *app.AppConfig, current *app.AppConfig) {
+		if err := state.Rpz.Reconfigure(current.GetRpzZones()); err != nil {
+			state.Log.Error("failed to read response policy zones - keeping the previous ones", "err", err)
+		}
+	})
+
+	upstreamProber := daemon.NewUpstreamProber(liveConfig, &state)
+	stops = append(stops, upstreamProber.Start())
+
+	if !config.DisableCache {
+		if config.PredictiveCache || config.ResilientCache {
+			cacheMinder := daemon.NewCacheMinder(liveConfig, state)
+			state.Cache.SetExpireCallback(cacheMinder.RefreshExpiringCacheItem)
+		}
+		cachePipeline := daemon.NewCachePipeline(liveConfig, &state)
+		stops = append(stops, cachePipeline.Start())
+
+		cacheSweeper := daemon.NewCacheSweeper(liveConfig, &state)
+		stops = append(stops, cacheSweeper.Start())
+	}
+
+	if config.RespectResolveConf {
+		resolvconf, err := system.NewResolvConfFromPath(config.ResolvConfPath, state.Log)
+		if err != nil {
+			state.Log.Warn("failed to read resolvconf on start - will retry", "error", err)
+		}
+
+		if resolvconf != nil {
+			config.ResolvConf = resolvconf
+			stops = append(stops, resolvconf.Watch())
+		}
+	}
+
+	config.EtcHosts = system.NewEtcHosts(state.Log)
+
+	metricsErr := state.Metrics.Start()
+	if metricsErr != nil {
+		state.Log.Warn("failed to start metrics", "err", metricsErr)
+	}
+
+	dnsServer := server.NewDnsServer(liveConfig, state)
+	dnsServer.Start()
+	liveConfig.OnReload(dnsServer.Reconfigure)
+
+	var adminServer *server.AdminServer
+	if config.AdminApiEnable {
+		adminServer = server.NewAdminServer(liveConfig, state)
+		adminServer.Start()
+	}
+
+	if err := dropPrivileges(65534, 65534); err != nil {
+		state.Log.Warn("failed to drop privileges after initialization", "err", err)
+	} else {
+		state.Log.Debug("successfully dropped privileges after initialization")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+	for sig := range signals {
+		state.Log.Info("received signal", "signal", sig)
+
+		switch sig {
+		case syscall.SIGHUP:
+			if err := liveConfig.Reload(); err != nil {
+				state.Log.Error("failed to reload config - keeping the running config", "config", conffile, "err", err)
+			} else {
+				state.Log.Info("reloaded config", "config", conffile)
+			}
+		case syscall.SIGUSR1:
+			logCacheStats(state)
+		default:
+			state.Log.Info("shutting down", "timeout", shutdownTimeout)
+
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := dnsServer.Shutdown(ctx); err != nil {
+				state.Log.Warn("queries may have been dropped at shutdown", "err", err)
+			}
+			if adminServer != nil {
+				if err := adminServer.Shutdown(ctx); err != nil {
+					state.Log.Warn("failed to stop admin api", "err", err)
+				}
+			}
+			cancel()
+
+			for i := len(stops) - 1; i >= 0; i-- {
+				stops[i]()
+			}
+
+			state.Log.Info("stopped")
+			return 0
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+// Resolver recorded for entries added through the admin API
+const adminSeedResolver = "admin"
+
+// An HTTP API for inspecting and controlling the running server,
+// authenticated with a bearer token
+type AdminServer struct {
+	appConfig *app.LiveConfig
+	appState  *app.AppState
+	server    *http.Server
+}
+
+// A cache entry as it's returned by the admin API
+type adminCacheEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Seconds until the entry expires. This is negative for
+	// expired entries that may still be served stale.
+	Ttl      int      `json:"ttl"`
+	Hits     int      `json:"hits"`
+	Resolver string   `json:"resolver"`
+	Rcode    string   `json:"rcode"`
+	Answers  []string `json:"answers"`
+}
+
+type adminSeedRequest struct {
+	// Records in zone file format, e.g. "example.com. 300 IN A 192.0.2.1"
+	Records []string `json:"records"`
+}
+
+type adminUpstreams struct {
+	Name      string   `json:"name"`
+	Upstreams []string `json:"upstreams"`
+	Strategy  string   `json:"strategy"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func writeJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", models.ContentTypeJson)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Require the admin token on every request
+func (as *AdminServer) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := as.appConfig.Get().AdminApiToken
+		given, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if token == "" || !isBearer || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			as.appState.Log.Warn("unauthorized admin api request", "path", r.URL.Path, "client", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// List the cache entries, optionally only those whose name contains
+// search, that are under the domain suffix, or that are of type
+func (as *AdminServer) handleListCache(w http.ResponseWriter, r *http.Request) {
+	search := strings.ToLower(r.URL.Query().Get("search"))
+	suffix := r.URL.Query().Get("suffix")
+
+	var qtype uint16
+	if name := r.URL.Query().Get("type"); name != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown record type '%s'", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := []adminCacheEntry{}
+	for _, entry := range as.appState.Cache.Entries() {
+		name := entry.Question.Name
+		if search != "" && !strings.Contains(strings.ToLower(name), search) {
+			continue
+		}
+		if suffix != "" && !dns.IsSubDomain(dns.Fqdn(suffix), dns.Fqdn(name)) {
+			continue
+		}
+		if qtype != 0 && entry.Question.Qtype != qtype {
+			continue
+		}
+
+		answers := []string{}
+		for _, rr := range entry.Response.AnswerRRs() {
+			answers = append(answers, rr.String())
+		}
+
+		entries = append(entries, adminCacheEntry{
+			Name:     name,
+			Type:     dns.TypeToString[entry.Question.Qtype],
+			Ttl:      int(time.Until(entry.Expires).Seconds()),
+			Hits:     entry.Hits,
+			Resolver: entry.Resolver,
+			Rcode:    dns.RcodeToString[entry.Response.Rcode()],
+			Answers:  answers,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+
+	writeJson(w, http.StatusOK, entries)
+}
+
+func (as *AdminServer) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, as.appState.Cache.Stats())
+}
+
+// Remove a single name (of every type), a domain and the names under
+// it, or, with neither, everything from the cache
+func (as *AdminServer) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	suffix := r.URL.Query().Get("suffix")
+
+	var removed int
+	switch {
+	case name != "" && suffix != "":
+		http.Error(w, "Only one of name and suffix may be given", http.StatusBadRequest)
+		return
+	case name != "":
+		removed = as.appState.Cache.Delete(name)
+	case suffix != "":
+		removed = as.appState.Cache.DeleteSuffix(suffix)
+	default:
+		removed = as.appState.Cache.DeleteSuffix(".")
+	}
+
+	as.appState.Log.Info("flushed cache through the admin api", "name", name, "suffix", suffix, "removed", removed)
+	writeJson(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// Add entries to the cache. Records with the same name and type are
+// stored as a single entry, which expires with the lowest TTL.
+func (as *AdminServer) handleSeedCache(w http.ResponseWriter, r *http.Request) {
+	var request adminSeedRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	questions := []dns.Question{}
+	answers := map[dns.Question][]dns.RR{}
+	for _, record := range request.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			http.Error(w, fmt.Sprintf("Invalid record '%s': %v", record, err), http.StatusBadRequest)
+			return
+		}
+
+		question := dns.Question{Name: rr.Header().Name, Qtype: rr.Header().Rrtype, Qclass: rr.Header().Class}
+		if _, ok := answers[question]; !ok {
+			questions = append(questions, question)
+		}
+		answers[question] = append(answers[question], rr)
+	}
+
+	for _, question := range questions {
+		msg := new(dns.Msg)
+		msg.Answer = answers[question]
+
+		response, err := models.NewDnsResponseFromMsg(msg)
+		if err == nil {
+			response.Resolver = adminSeedResolver
+			err = as.appState.Cache.CacheDnsResponse(question, *response)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to cache %s: %v", question.Name, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	as.appState.Log.Info("seeded cache through the admin api", "entries", len(questions))
+	writeJson(w, http.StatusOK, map[string]int{"seeded": len(questions)})
+}
+
+// Show the upstream resolvers a query for a name, from the given
+// client, would be sent to
+func (as *AdminServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "A name is required", http.StatusBadRequest)
+		return
+	}
+	name = dns.Fqdn(name)
+
+	var clientId, clientIp *string
+	if id := r.URL.Query().Get("client_id"); id != "" {
+		clientId = &id
+	}
+	if ip := r.URL.Query().Get("client_ip"); ip != "" {
+		clientIp = &ip
+	}
+
+	config := as.appConfig.Get()
+	result := adminUpstreams{
+		Name:      name,
+		Upstreams: config.GetUpstreamResolvers(name, clientId, clientIp),
+		Strategy:  config.GetUpstreamStrategy(name, clientId, clientIp),
+	}
+	if _, err := config.GetACItem(clientId, clientIp); err != nil {
+		result.Error = err.Error()
+	}
+
+	writeJson(w, http.StatusOK, result)
+}
+
+func (as *AdminServer) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := as.appConfig.Reload(); err != nil {
+		as.appState.Log.Error("failed to reload config through the admin api - keeping the running config", "err", err)
+		http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	as.appState.Log.Info("reloaded config through the admin api")
+	writeJson(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (as *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache", as.authenticate(as.handleListCache))
+	mux.HandleFunc("DELETE /cache", as.authenticate(as.handleFlushCache))
+	mux.HandleFunc("POST /cache", as.authenticate(as.handleSeedCache))
+	mux.HandleFunc("GET /cache/stats", as.authenticate(as.handleCacheStats))
+	mux.HandleFunc("GET /upstreams", as.authenticate(as.handleUpstreams))
+	mux.HandleFunc("POST /config/reload", as.authenticate(as.handleReloadConfig))
+	return mux
+}
+
+func (as *AdminServer) Start() {
+	ready := make(chan struct{})
+	server := as.server
+
+	go func() {
+		as.appState.Log.Info("starting admin api", "addr", server.Addr)
+		close(ready)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			as.appState.Log.Error("failed to start admin api", "error", err.Error())
+		}
+	}()
+
+	<-ready
+}
+
+func (as *AdminServer) Shutdown(ctx context.Context) error {
+	return as.server.Shutdown(ctx)
+}
+
+func NewAdminServer(config *app.LiveConfig, state app.AppState) *AdminServer {
+	server := &AdminServer{
+		appConfig: config,
+		appState:  &state,
+	}
+
+	server.server = &http.Server{
+		Addr:    config.Get().AdminApiAddress,
+		Handler: server.handler(),
+	}
+
+	return server
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/metrics"
+	"github.com/thenaterhood/spuddns/models"
+)
+
+const adminTestToken = "test-token"
+
+func getAdminTestServer(t *testing.T, appCfg app.AppConfig) (*AdminServer, cache.Cache) {
+	t.Helper()
+
+	logger := getAppState(nil).Log
+	spudcache, err := cache.GetCache(cache.CacheConfig{
+		Enable:  true,
+		Logger:  logger,
+		Metrics: metrics.DummyMetrics{},
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	appCfg.AdminApiEnable = true
+	appCfg.AdminApiToken = adminTestToken
+
+	return NewAdminServer(app.NewLiveConfig("", &appCfg), *getAppState(spudcache)), spudcache
+}
+
+func adminTestRequest(t *testing.T, server *AdminServer, method string, url string, body string, result any) int {
+	t.Helper()
+
+	request := httptest.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+adminTestToken)
+	recorder := httptest.NewRecorder()
+	server.handler().ServeHTTP(recorder, request)
+
+	if result != nil && recorder.Code == http.StatusOK {
+		if err := json.NewDecoder(recorder.Body).Decode(result); err != nil {
+			t.Fatalf("invalid admin api response: %v", err)
+		}
+	}
+
+	return recorder.Code
+}
+
+func cacheAdminTestEntry(t *testing.T, c cache.Cache, name string, qtype uint16) {
+	t.Helper()
+
+	response, err := models.NewDnsResponseFromDnsAnswers([]models.DNSAnswer{
+		{Name: name, Type: qtype, TTL: 300 * time.Second, Data: map[uint16]string{dns.TypeA: "192.0.2.1", dns.TypeAAAA: "2001:db8::1"}[qtype]},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+
+	if err := c.CacheDnsResponse(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, *response); err != nil {
+		t.Fatalf("cache set errored: %v", err)
+	}
+}
+
+func TestAdminApiRequiresToken(t *testing.T) {
+	server, _ := getAdminTestServer(t, app.GetDefaultConfig())
+
+	for _, header := range []string{"", "Bearer wrong", adminTestToken} {
+		request := httptest.NewRequest(http.MethodGet, "/cache", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		server.handler().ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("expected authorization '%s' to be rejected, got %d", header, recorder.Code)
+		}
+	}
+}
+
+func TestAdminApiListsAndSearchesCache(t *testing.T) {
+	server, spudcache := getAdminTestServer(t, app.GetDefaultConfig())
+	cacheAdminTestEntry(t, spudcache, "www.example.com.", dns.TypeA)
+	cacheAdminTestEntry(t, spudcache, "www.example.com.", dns.TypeAAAA)
+	cacheAdminTestEntry(t, spudcache, "example.org.", dns.TypeA)
+
+	entries := []adminCacheEntry{}
+	if code := adminTestRequest(t, server, http.MethodGet, "/cache", "", &entries); code != http.StatusOK {
+		t.Fatalf("listing the cache failed with %d", code)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	if entries[0].Name != "example.org." || entries[0].Ttl <= 290 || entries[0].Ttl > 300 || len(entries[0].Answers) != 1 {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+
+	adminTestRequest(t, server, http.MethodGet, "/cache?suffix=example.com&type=aaaa", "", &entries)
+	if len(entries) != 1 || entries[0].Name != "www.example.com." || entries[0].Type != "AAAA" {
+		t.Errorf("expected only the AAAA entry under example.com, got %v", entries)
+	}
+
+	adminTestRequest(t, server, http.MethodGet, "/cache?search=ORG", "", &entries)
+	if len(entries) != 1 || entries[0].Name != "example.org." {
+		t.Errorf("expected only example.org, got %v", entries)
+	}
+
+	stats := cache.CacheStats{}
+	adminTestRequest(t, server, http.MethodGet, "/cache/stats", "", &stats)
+	if stats.Entries != 3 {
+		t.Errorf("expected stats for 3 entries, got %+v", stats)
+	}
+}
+
+func TestAdminApiFlushesCache(t *testing.T) {
+	server, spudcache := getAdminTestServer(t, app.GetDefaultConfig())
+	cacheAdminTestEntry(t, spudcache, "www.example.com.", dns.TypeA)
+	cacheAdminTestEntry(t, spudcache, "www.example.com.", dns.TypeAAAA)
+	cacheAdminTestEntry(t, spudcache, "mail.example.com.", dns.TypeA)
+	cacheAdminTestEntry(t, spudcache, "example.org.", dns.TypeA)
+
+	result := map[string]int{}
+	adminTestRequest(t, server, http.MethodDelete, "/cache?name=www.example.com", "", &result)
+	if result["removed"] != 2 {
+		t.Errorf("expected both types for the name to be removed, got %v", result)
+	}
+
+	adminTestRequest(t, server, http.MethodDelete, "/cache?suffix=example.com", "", &result)
+	if result["removed"] != 1 {
+		t.Errorf("expected the remaining entry under the suffix to be removed, got %v", result)
+	}
+
+	adminTestRequest(t, server, http.MethodDelete, "/cache", "", &result)
+	if result["removed"] != 1 || spudcache.Stats().Entries != 0 {
+		t.Errorf("expected everything to be removed, got %v", result)
+	}
+}
+
+func TestAdminApiSeedsCache(t *testing.T) {
+	server, spudcache := getAdminTestServer(t, app.GetDefaultConfig())
+
+	body := `{"records": [
+		"seeded.example.com. 600 IN A 192.0.2.10",
+		"seeded.example.com. 300 IN A 192.0.2.11",
+		"seeded.example.com. 600 IN TXT \"hello\""
+	]}`
+	result := map[string]int{}
+	if code := adminTestRequest(t, server, http.MethodPost, "/cache", body, &result); code != http.StatusOK || result["seeded"] != 2 {
+		t.Fatalf("expected 2 entries to be seeded, got %d %v", code, result)
+	}
+
+	query, _ := models.NewDnsQueryFromQuestions([]dns.Question{{Name: "seeded.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}})
+	response, err := spudcache.QueryDns(*query)
+	if err != nil || response == nil {
+		t.Fatalf("seeded entry was not cached: %v", err)
+	}
+	if len(response.AnswerRRs()) != 2 {
+		t.Errorf("expected both seeded records, got %v", response.AnswerRRs())
+	}
+	if response.GetTtl() > 300*time.Second {
+		t.Errorf("expected the lowest ttl to be used, got %v", response.GetTtl())
+	}
+
+	if code := adminTestRequest(t, server, http.MethodPost, "/cache", `{"records": ["not a record"]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid record to be rejected, got %d", code)
+	}
+}
+
+func TestAdminApiShowsUpstreams(t *testing.T) {
+	appCfg := app.GetDefaultConfig()
+	appCfg.UpstreamResolvers = []string{"1.1.1.1"}
+	appCfg.ConditionalForwards = map[string][]string{"corp.example": {"10.0.0.1"}}
+	appCfg.ConditionalForwardStrategies = map[string]string{"corp.example": "parallel"}
+	server, _ := getAdminTestServer(t, appCfg)
+
+	result := adminUpstreams{}
+	adminTestRequest(t, server, http.MethodGet, "/upstreams?name=host.corp.example", "", &result)
+	if len(result.Upstreams) != 1 || result.Upstreams[0] != "10.0.0.1" || result.Strategy != "parallel" {
+		t.Errorf("expected the conditional forward, got %+v", result)
+	}
+
+	adminTestRequest(t, server, http.MethodGet, "/upstreams?name=example.org", "", &result)
+	if len(result.Upstreams) != 1 || result.Upstreams[0] != "1.1.1.1" {
+		t.Errorf("expected the default upstream, got %+v", result)
+	}
+}
+
+func TestAdminApiReloadsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spuddns.json")
+	if err := os.WriteFile(path, []byte(`{"admin_api_enable": true, "admin_api_token": "test-token", "upstream_resolvers": ["9.9.9.9"]}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.AdminApiEnable = true
+	appCfg.AdminApiToken = adminTestToken
+	liveConfig := app.NewLiveConfig(path, &appCfg)
+	server := NewAdminServer(liveConfig, *getAppState(&cache.DummyCache{}))
+
+	if code := adminTestRequest(t, server, http.MethodPost, "/config/reload", "", nil); code != http.StatusOK {
+		t.Fatalf("reloading the config failed with %d", code)
+	}
+	if upstreams := liveConfig.Get().UpstreamResolvers; len(upstreams) != 1 || upstreams[0] != "9.9.9.9" {
+		t.Errorf("config was not reloaded, got upstreams %v", upstreams)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"upstream_resolver": []}`), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if code := adminTestRequest(t, server, http.MethodPost, "/config/reload", "", nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected an invalid config to be rejected, got %d", code)
+	}
+}
@@ -1,14 +1,20 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/thenaterhood/spuddns/app"
+	"github.com/thenaterhood/spuddns/blocklist"
 	"github.com/thenaterhood/spuddns/cache"
+	"github.com/thenaterhood/spuddns/internal/testfile"
 	"github.com/thenaterhood/spuddns/metrics"
 	"github.com/thenaterhood/spuddns/models"
 	"github.com/thenaterhood/spuddns/resolver"
@@ -34,20 +40,48 @@ func getAppState(cache cache.Cache) *app.AppState {
 	}
 }
 
-func runDnsServerTest(t *testing.T, appCfg app.AppConfig, appState app.AppState, clientId *string, qName string) *dns.Msg {
-	server := NewDnsServer(appCfg, appState)
+type largeResponseResolver struct {
+	count int
+}
+
+func (r largeResponseResolver) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	answers := []models.DNSAnswer{}
+	for i := 0; i < r.count; i++ {
+		answers = append(answers, models.DNSAnswer{
+			Name: q.FirstQuestion().Name,
+			Type: dns.TypeA,
+			TTL:  30 * time.Second,
+			Data: fmt.Sprintf("203.0.113.%d", i+1),
+		})
+	}
+	return models.NewDnsResponseFromDnsAnswers(answers)
+}
+
+func startDnsServerTest(appCfg app.AppConfig, appState app.AppState) (DnsServer, func()) {
+	server := NewDnsServer(app.NewLiveConfig("", &appCfg), appState)
 
-	waitLock := sync.Mutex{}
-	server.standard_dns_server.NotifyStartedFunc = waitLock.Unlock
+	udpLock := sync.Mutex{}
+	tcpLock := sync.Mutex{}
+	server.standard_dns_server.NotifyStartedFunc = udpLock.Unlock
 	server.standard_dns_server.Addr = ":0"
-	waitLock.Lock()
-	defer server.standard_dns_server.Shutdown()
+	server.standard_dns_tcp_server.NotifyStartedFunc = tcpLock.Unlock
+	server.standard_dns_tcp_server.Addr = ":0"
+	udpLock.Lock()
+	tcpLock.Lock()
 
 	go func() {
 		server.Start()
 	}()
-	waitLock.Lock()
+	udpLock.Lock()
+	tcpLock.Lock()
+
+	return server, func() {
+		server.standard_dns_server.Shutdown()
+		server.standard_dns_tcp_server.Shutdown()
+	}
+}
 
+func exchangeDnsServerTest(t *testing.T, server DnsServer, network string, clientId *string, qName string, udpSize uint16) *dns.Msg {
 	q, err := models.NewDnsQueryFromQuestions(
 		[]dns.Question{{Name: qName, Qtype: dns.TypeA}},
 	)
@@ -59,9 +93,16 @@ func runDnsServerTest(t *testing.T, appCfg app.AppConfig, appState app.AppState,
 	}
 
 	c := new(dns.Client)
+	c.Net = network
 	m := q.PreparedMsg()
+	if udpSize > 0 {
+		m.SetEdns0(udpSize, false)
+	}
 
 	addr := server.standard_dns_server.PacketConn.LocalAddr().String() // Get address via the PacketConn that gets set.
+	if network == "tcp" {
+		addr = server.standard_dns_tcp_server.Listener.Addr().String()
+	}
 	r, _, err := c.Exchange(m, addr)
 	if err != nil {
 		t.Fatal("failed to exchange", "name", qName, "err", err)
@@ -70,6 +111,13 @@ func runDnsServerTest(t *testing.T, appCfg app.AppConfig, appState app.AppState,
 	return r
 }
 
+func runDnsServerTest(t *testing.T, appCfg app.AppConfig, appState app.AppState, clientId *string, qName string) *dns.Msg {
+	server, shutdown := startDnsServerTest(appCfg, appState)
+	defer shutdown()
+
+	return exchangeDnsServerTest(t, server, "udp", clientId, qName, 0)
+}
+
 func TestServerResolvesBasicQuery(t *testing.T) {
 
 	appCfg := app.GetDefaultConfig()
@@ -200,3 +248,385 @@ func TestServerRejectsNonEdnsQueryWhenAuthRequired(t *testing.T) {
 		t.Error("got answers but did not expect answers")
 	}
 }
+
+func TestServerAnswersBlockedQueries(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+	appCfg.EnableACLs = true
+	appCfg.ACLs = map[string]app.AclItem{
+		"strict": {BlocklistResponse: blocklist.ResponseNxdomain},
+		"*":      {},
+	}
+
+	path := testfile.Write(t, "ads", "0.0.0.0 example.com\n")
+
+	appState := getAppState(&cache.DummyCache{})
+	appState.Blocklist = blocklist.NewBlocklist(blocklist.BlocklistConfig{
+		Lists:   map[string]string{"ads": path},
+		Logger:  appState.Log,
+		Metrics: appState.Metrics,
+	})
+
+	server, shutdown := startDnsServerTest(appCfg, *appState)
+	defer shutdown()
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "example.com.", 0)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "0.0.0.0" {
+		t.Errorf("expected a null answer for a blocked name, got %v", r.Answer)
+	}
+
+	cpeId := "strict"
+	r = exchangeDnsServerTest(t, server, "udp", &cpeId, "example.com.", 0)
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for a client set to nxdomain, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	r = exchangeDnsServerTest(t, server, "udp", nil, "google.com.", 0)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("expected a name that isn't blocked to resolve, got %v", r.Answer)
+	}
+}
+
+func TestServerResolvesBasicQueryOverTcp(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	server, shutdown := startDnsServerTest(appCfg, *getAppState(&cache.DummyCache{}))
+	defer shutdown()
+
+	r := exchangeDnsServerTest(t, server, "tcp", nil, "example.com.", 0)
+	if len(r.Answer) < 1 {
+		t.Fatal("got no answers but expected answers")
+	}
+	a := r.Answer[0].(*dns.A).A
+	if a.String() != "127.0.0.1" {
+		t.Error("unexpected result for example.com", a.String(), "!= 127.0.0.1")
+	}
+}
+
+func TestServerTruncatesLargeUdpResponse(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	appState := getAppState(&cache.DummyCache{})
+	appState.DefaultForwarder = largeResponseResolver{count: 60}
+
+	server, shutdown := startDnsServerTest(appCfg, *appState)
+	defer shutdown()
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "example.com.", 0)
+	if !r.Truncated {
+		t.Error("expected oversized udp response to be truncated")
+	}
+	if len(r.Answer) >= 60 {
+		t.Errorf("expected truncated answers, got %d", len(r.Answer))
+	}
+
+	r = exchangeDnsServerTest(t, server, "udp", nil, "example.com.", 4096)
+	if r.Truncated {
+		t.Error("response should fit in the advertised edns0 buffer size")
+	}
+	if len(r.Answer) != 60 {
+		t.Errorf("expected 60 answers, got %d", len(r.Answer))
+	}
+	if r.IsEdns0() == nil {
+		t.Error("expected an OPT record in the reply to an edns0 query")
+	}
+
+	r = exchangeDnsServerTest(t, server, "tcp", nil, "example.com.", 0)
+	if r.Truncated {
+		t.Error("tcp response should not be truncated")
+	}
+	if len(r.Answer) != 60 {
+		t.Errorf("expected 60 answers over tcp, got %d", len(r.Answer))
+	}
+}
+
+func TestServerServesStaleAnswerWhenUpstreamFails(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+	appCfg.RespectResolveConf = false
+	appCfg.UpstreamResolvers = []string{"udp://127.0.0.1:1"}
+
+	appState := getAppState(nil)
+	staleCache, err := cache.GetCache(cache.CacheConfig{
+		Enable:   true,
+		Logger:   appState.Log,
+		Metrics:  appState.Metrics,
+		MaxStale: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to get cache: %v", err)
+	}
+	appState.Cache = staleCache
+
+	expired, err := models.NewDnsResponseFromDnsAnswers(
+		[]models.DNSAnswer{
+			{
+				Name: "stale.example.",
+				Type: dns.TypeA,
+				TTL:  0,
+				Data: "203.0.113.50",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+	staleCache.CacheDnsResponse(dns.Question{Name: "stale.example.", Qtype: dns.TypeA}, *expired)
+
+	server, shutdown := startDnsServerTest(appCfg, *appState)
+	defer shutdown()
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "stale.example.", 4096)
+	if len(r.Answer) < 1 {
+		t.Fatalf("expected a stale answer, got rcode %d", r.Rcode)
+	}
+
+	a := r.Answer[0].(*dns.A)
+	if a.A.String() != "203.0.113.50" {
+		t.Error("unexpected stale result", a.A.String(), "!= 203.0.113.50")
+	}
+	if a.Hdr.Ttl < 1 || a.Hdr.Ttl > 30 {
+		t.Errorf("stale answer should have a short ttl, got %d", a.Hdr.Ttl)
+	}
+
+	foundEde := false
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+				foundEde = true
+			}
+		}
+	}
+	if !foundEde {
+		t.Error("stale answer is missing the stale answer extended dns error")
+	}
+}
+
+func TestServerServesCachedNegativeAnswer(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+	appCfg.RespectResolveConf = false
+	appCfg.UpstreamResolvers = []string{"udp://127.0.0.1:1"}
+
+	appState := getAppState(nil)
+	negativeCache, err := cache.GetCache(cache.CacheConfig{
+		Enable:  true,
+		Logger:  appState.Log,
+		Metrics: appState.Metrics,
+	})
+	if err != nil {
+		t.Fatalf("failed to get cache: %v", err)
+	}
+	appState.Cache = negativeCache
+
+	soa, _ := dns.NewRR("example. 300 IN SOA ns.example. admin.example. 1 7200 3600 1209600 60")
+	negative, err := models.NewNegativeDnsResponse(dns.RcodeNameError, soa)
+	if err != nil {
+		t.Fatalf("unexpected error getting hardcoded dns response: %v", err)
+	}
+	negativeCache.CacheDnsResponse(dns.Question{Name: "missing.example.", Qtype: dns.TypeA}, *negative)
+
+	server, shutdown := startDnsServerTest(appCfg, *appState)
+	defer shutdown()
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "missing.example.", 4096)
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got rcode %d", r.Rcode)
+	}
+
+	if len(r.Ns) != 1 {
+		t.Fatalf("expected the SOA in the authority section, got %v", r.Ns)
+	}
+
+	if r.Ns[0].Header().Ttl < 1 || r.Ns[0].Header().Ttl > 60 {
+		t.Errorf("SOA should carry the remaining negative ttl, got %d", r.Ns[0].Header().Ttl)
+	}
+}
+
+// Resolver that waits to be released before answering
+type blockingResolver struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r blockingResolver) QueryDns(q models.DnsQuery) (*models.DnsResponse, error) {
+	close(r.started)
+	<-r.release
+	return largeResponseResolver{count: 1}.QueryDns(q)
+}
+
+func TestServerShutdownFinishesInFlightQueries(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	upstream := blockingResolver{started: make(chan struct{}), release: make(chan struct{})}
+	appState := getAppState(&cache.DummyCache{})
+	appState.DefaultForwarder = upstream
+
+	server, _ := startDnsServerTest(appCfg, *appState)
+
+	replies := make(chan *dns.Msg, 1)
+	go func() {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		c := &dns.Client{Net: "tcp"}
+		r, _, err := c.Exchange(m, server.standard_dns_tcp_server.Listener.Addr().String())
+		if err != nil {
+			t.Errorf("failed to exchange: %v", err)
+		}
+		replies <- r
+	}()
+	<-upstream.started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown finished before the query being answered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(upstream.release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown errored: %v", err)
+	}
+
+	if r := <-replies; r == nil || len(r.Answer) != 1 {
+		t.Errorf("expected the in-flight query to be answered, got %v", r)
+	}
+}
+
+func TestServerRebindsOnlyChangedListeners(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	server, shutdown := startDnsServerTest(appCfg, *getAppState(&cache.DummyCache{}))
+	defer shutdown()
+
+	standard := server.standard_dns_server
+
+	withHttp := appCfg
+	withHttp.DnsOverHttpEnable = true
+	withHttp.DnsOverHttpPort = 0
+	server.Reconfigure(&appCfg, &withHttp)
+	defer server.dns_over_http_server.Close()
+
+	if server.standard_dns_server != standard {
+		t.Errorf("dns server was rebound when its settings didn't change")
+	}
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "example.com.", 0)
+	if len(r.Answer) != 1 {
+		t.Errorf("dns server stopped answering when another listener was rebound")
+	}
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	listener.Close()
+
+	newPort := withHttp
+	newPort.BindAddress = "127.0.0.1"
+	newPort.DnsServerPort = port
+	server.Reconfigure(&withHttp, &newPort)
+	defer server.standard_dns_server.Shutdown()
+	defer server.standard_dns_tcp_server.Shutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	c := new(dns.Client)
+	for attempt := 0; attempt < 50; attempt++ {
+		r, _, err = c.Exchange(m, fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err != nil || len(r.Answer) != 1 {
+		t.Errorf("dns server did not answer on its new port: %v", err)
+	}
+}
+
+func TestServerKeepsListenerWhenRebindFails(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	server, shutdown := startDnsServerTest(appCfg, *getAppState(&cache.DummyCache{}))
+	defer shutdown()
+
+	standard := server.standard_dns_server
+
+	inUse, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer inUse.Close()
+
+	newPort := appCfg
+	newPort.BindAddress = "127.0.0.1"
+	newPort.DnsServerPort = inUse.LocalAddr().(*net.UDPAddr).Port
+	server.Reconfigure(&appCfg, &newPort)
+
+	if server.standard_dns_server != standard {
+		t.Errorf("dns server was replaced when its new address couldn't be bound")
+	}
+
+	r := exchangeDnsServerTest(t, server, "udp", nil, "example.com.", 0)
+	if len(r.Answer) != 1 {
+		t.Errorf("dns server stopped answering when its new address couldn't be bound")
+	}
+}
+
+func TestServerIsNotReboundAfterShutdown(t *testing.T) {
+
+	appCfg := app.GetDefaultConfig()
+	appCfg.BindAddress = ""
+	appCfg.DnsServerPort = 0
+
+	server, _ := startDnsServerTest(appCfg, *getAppState(&cache.DummyCache{}))
+	standard := server.standard_dns_server
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown errored: %v", err)
+	}
+
+	// As though the config was reloaded through the admin API
+	// while shutting down
+	withHttp := appCfg
+	withHttp.DnsServerPort = 1
+	withHttp.DnsOverHttpEnable = true
+	server.Reconfigure(&appCfg, &withHttp)
+
+	if server.standard_dns_server != standard || server.dns_over_http_server != nil {
+		t.Errorf("listeners were started again after shutting down")
+	}
+}
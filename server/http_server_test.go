@@ -22,7 +22,7 @@ func runHttpServerTest(
 	ednsClientId *string,
 	httpClientId *string,
 ) *dns.Msg {
-	dnsServer := NewDnsServer(appCfg, appState)
+	dnsServer := NewDnsServer(app.NewLiveConfig("", &appCfg), appState)
 
 	responseRecorder := httptest.NewRecorder()
 	cpeId := ""
@@ -2,14 +2,20 @@ package server
 
 import (
 	"cmp"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/thenaterhood/spuddns/app"
@@ -17,11 +23,55 @@ import (
 )
 
 type DnsServer struct {
-	appConfig            *app.AppConfig
-	appState             *app.AppState
-	standard_dns_server  *dns.Server
-	dns_over_tls_server  *dns.Server
-	dns_over_http_server *http.Server
+	appConfig               *app.LiveConfig
+	appState                *app.AppState
+	standard_dns_server     *dns.Server
+	standard_dns_tcp_server *dns.Server
+	dns_over_tls_server     *dns.Server
+	dns_over_http_server    *http.Server
+	// Bound when the DNS over HTTP server is rebound for a new
+	// config, and nil when the server binds its own
+	dns_over_http_listener net.Listener
+	// The DNS over TLS certificate, which is replaced without
+	// rebinding when only the certificate changes
+	tls_certificate *atomic.Pointer[tls.Certificate]
+	// Held while the listeners are started, rebound or shut down,
+	// since a reload can come from the admin API while shutting down
+	listenerMutex *sync.Mutex
+	// Set once the listeners are shut down, so a reload doesn't
+	// start them again
+	stopped bool
+}
+
+// How long listeners being rebound for a new config are given to
+// finish answering queries
+const reconfigureTimeout = 5 * time.Second
+
+// Get the largest response the client will accept over UDP,
+// per its EDNS0 buffer size if one was advertised
+func maxUdpResponseSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	return dns.MinMsgSize
+}
+
+// Prepare a reply for the wire, adding an OPT record if the client
+// used EDNS0 and truncating it if it won't fit in a UDP response
+func prepareReply(w dns.ResponseWriter, r *dns.Msg, reply *dns.Msg) *dns.Msg {
+	if reply == nil {
+		return nil
+	}
+
+	if opt := r.IsEdns0(); opt != nil && reply.IsEdns0() == nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	if w.LocalAddr() != nil && w.LocalAddr().Network() == "udp" {
+		reply.Truncate(maxUdpResponseSize(r))
+	}
+
+	return reply
 }
 
 // Handle a DNS over HTTP(S) request
@@ -96,10 +146,15 @@ func (ds DnsServer) handleDnsOverHTTP(w http.ResponseWriter, r *http.Request) {
 	dnsReq.ClientId = &auth
 	dnsReq.ClientIp = &r.RemoteAddr
 
-	resp, err := ds.appState.ResolveQueryComplete(*dnsReq, ds.appConfig)
+	resp, err := ds.appState.ResolveQueryComplete(*dnsReq, ds.appConfig.Get())
 	if err != nil {
 		ds.appState.Log.Warn("error handling dns over http request", "error", err)
 	}
+	if resp != nil && resp.Dropped {
+		// Close the connection without answering, as a dropped
+		// query over UDP would time out
+		panic(http.ErrAbortHandler)
+	}
 	if resp != nil {
 		writeResp(resp.AsReplyToMsg(dnsReq.PreparedMsg()))
 	} else {
@@ -116,7 +171,7 @@ func (ds *DnsServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	dnsQuery, err := models.NewDnsQueryFromMsg(r)
 	if err != nil {
 		ds.appState.Log.Warn("failed to get DnsQuery from msg", "err", err)
-		w.WriteMsg(models.NewServFailDnsResponse().AsReplyToMsg(r))
+		w.WriteMsg(prepareReply(w, r, models.NewServFailDnsResponse().AsReplyToMsg(r)))
 		return
 	}
 
@@ -126,116 +181,402 @@ func (ds *DnsServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	dnsQuery.ClientId = &auth
 	dnsQuery.ClientIp = &clientIp
 
-	resp, err := ds.appState.ResolveQueryComplete(*dnsQuery, ds.appConfig)
+	resp, err := ds.appState.ResolveQueryComplete(*dnsQuery, ds.appConfig.Get())
 	if err != nil {
 		ds.appState.Log.Warn("error handling dns request", "error", err)
 	}
 
+	if resp != nil && resp.Dropped {
+		ds.appState.Log.Debug("dropping dns request", "msg", r)
+		return
+	}
+
 	if resp != nil {
-		err = w.WriteMsg(resp.AsReplyToMsg(r))
+		reply := prepareReply(w, r, resp.AsReplyToMsg(r))
+		err = w.WriteMsg(reply)
 		if err != nil {
-			ds.appState.Log.Warn("failed to write dns response", "err", err, "msg", resp.AsReplyToMsg(r))
+			ds.appState.Log.Warn("failed to write dns response", "err", err, "msg", reply)
 		}
 		return
 	}
 
-	w.WriteMsg(models.NewServFailDnsResponse().AsReplyToMsg(r))
+	w.WriteMsg(prepareReply(w, r, models.NewServFailDnsResponse().AsReplyToMsg(r)))
 }
 
-func (ds *DnsServer) Start() error {
+// Bind the sockets for DNS listeners before they're started, so the
+// listeners they replace can keep running if they can't be bound
+func bindDnsServers(servers ...*dns.Server) error {
+	for i, server := range servers {
+		var err error
+		switch server.Net {
+		case "udp":
+			server.PacketConn, err = net.ListenPacket("udp", server.Addr)
+		case "tcp-tls":
+			server.Listener, err = tls.Listen("tcp", server.Addr, server.TLSConfig)
+		default:
+			server.Listener, err = net.Listen("tcp", server.Addr)
+		}
+
+		if err != nil {
+			for _, bound := range servers[:i] {
+				closeBoundDnsServer(bound)
+			}
+			return describeBindError(server.Addr, err)
+		}
+	}
+
+	return nil
+}
+
+func closeBoundDnsServer(server *dns.Server) {
+	if server.PacketConn != nil {
+		server.PacketConn.Close()
+	}
+	if server.Listener != nil {
+		server.Listener.Close()
+	}
+}
+
+// Explain why a listener couldn't be bound once privileges are
+// dropped, which is usually a port below 1024
+func describeBindError(addr string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%s: %w (ports below 1024 need a restart to bind)", addr, err)
+	}
+	return fmt.Errorf("%s: %w", addr, err)
+}
+
+// Serve on a listener's bound socket, or bind one if it has none
+func serveDns(server *dns.Server) error {
+	if server.PacketConn != nil || server.Listener != nil {
+		return server.ActivateAndServe()
+	}
+	return server.ListenAndServe()
+}
+
+func (ds *DnsServer) startTls() {
+	ready := make(chan struct{})
+	server := ds.dns_over_tls_server
+
+	go func() {
+		ds.appState.Log.Info("starting DNS over TLS server", "addr", server.Addr)
+		close(ready)
+		err := serveDns(server)
+		if err != nil {
+			ds.appState.Log.Error("failed to start dns over tls server", "error", err.Error())
+		}
+	}()
+
+	<-ready
+}
+
+func (ds *DnsServer) startHttp() {
+	ready := make(chan struct{})
+	server := ds.dns_over_http_server
+	listener := ds.dns_over_http_listener
+
+	go func() {
+		ds.appState.Log.Info("start DNS over HTTP server", "addr", server.Addr)
+		close(ready)
+		var err error
+		if listener != nil {
+			err = server.Serve(listener)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ds.appState.Log.Error("failed to start dns over http server", "error", err.Error())
+		}
+	}()
+
+	<-ready
+}
 
-	tls_ready := make(chan struct{})
-	http_ready := make(chan struct{})
+func (ds *DnsServer) startStandard() {
 	dns_ready := make(chan struct{})
+	dns_tcp_ready := make(chan struct{})
+	server := ds.standard_dns_server
+	tcpServer := ds.standard_dns_tcp_server
+
+	go func() {
+		ds.appState.Log.Info("starting DNS server", "addr", server.Addr)
+		close(dns_ready)
+		err := serveDns(server)
+		if err != nil {
+			ds.appState.Log.Error("failed to start server", "error", err.Error())
+		}
+	}()
+
+	go func() {
+		ds.appState.Log.Info("starting DNS server (tcp)", "addr", tcpServer.Addr)
+		close(dns_tcp_ready)
+		err := serveDns(tcpServer)
+		if err != nil {
+			ds.appState.Log.Error("failed to start tcp server", "error", err.Error())
+		}
+	}()
+
+	<-dns_ready
+	<-dns_tcp_ready
+}
+
+func (ds *DnsServer) Start() error {
+	ds.listenerMutex.Lock()
+	defer ds.listenerMutex.Unlock()
 
 	if ds.dns_over_tls_server != nil {
-		defer ds.dns_over_tls_server.Shutdown()
+		ds.startTls()
+	}
+
+	if ds.dns_over_http_server != nil {
+		ds.startHttp()
+	}
+
+	ds.startStandard()
+
+	return nil
+}
+
+// Stop accepting queries and wait for the ones being answered to
+// finish, or for the context to be done
+func (ds *DnsServer) Shutdown(ctx context.Context) error {
+	ds.listenerMutex.Lock()
+	defer ds.listenerMutex.Unlock()
+	ds.stopped = true
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+
+	for _, server := range []*dns.Server{ds.standard_dns_server, ds.standard_dns_tcp_server, ds.dns_over_tls_server} {
+		if server == nil {
+			continue
+		}
+
+		wg.Add(1)
 		go func() {
-			ds.appState.Log.Info("starting DNS over HTTPS server", "addr", ds.dns_over_tls_server.Addr)
-			close(tls_ready)
-			err := ds.dns_over_tls_server.ListenAndServe()
-			if err != nil {
-				ds.appState.Log.Error("failed to start dns over https server", "error", err.Error())
+			defer wg.Done()
+			if err := server.ShutdownContext(ctx); err != nil {
+				errs <- fmt.Errorf("%s server on %s: %w", server.Net, server.Addr, err)
 			}
 		}()
-	} else {
-		close(tls_ready)
 	}
 
 	if ds.dns_over_http_server != nil {
+		wg.Add(1)
 		go func() {
-			ds.appState.Log.Info("start DNS over HTTP server", "addr", ds.dns_over_http_server.Addr)
-			close(http_ready)
-			err := ds.dns_over_http_server.ListenAndServe()
-			if err != nil {
-				ds.appState.Log.Error("failed to start dns over http server", "error", err.Error())
+			defer wg.Done()
+			if err := ds.dns_over_http_server.Shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("http server on %s: %w", ds.dns_over_http_server.Addr, err)
 			}
 		}()
-	} else {
-		close(http_ready)
 	}
 
-	go func() {
-		ds.appState.Log.Info("starting DNS server", "port", ds.appConfig.DnsServerPort)
-		close(dns_ready)
-		err := ds.standard_dns_server.ListenAndServe()
-		defer ds.standard_dns_server.Shutdown()
-		if err != nil {
-			ds.appState.Log.Error("failed to start server", "error", err.Error())
-		}
-	}()
+	wg.Wait()
+	close(errs)
 
-	<-tls_ready
-	<-http_ready
-	<-dns_ready
+	shutdownErrs := []error{}
+	for err := range errs {
+		shutdownErrs = append(shutdownErrs, err)
+	}
 
-	return nil
+	return errors.Join(shutdownErrs...)
 }
 
-func NewDnsServer(config app.AppConfig, state app.AppState) DnsServer {
-	port := config.DnsServerPort
-	bind := config.BindAddress
+// Rebind the listeners whose settings changed when the config is
+// reloaded. Listeners that didn't change keep running, so queries
+// they're answering aren't interrupted, and a listener whose new
+// address can't be bound keeps running on its old one.
+func (ds *DnsServer) Reconfigure(previous *app.AppConfig, current *app.AppConfig) {
+	ds.listenerMutex.Lock()
+	defer ds.listenerMutex.Unlock()
+	if ds.stopped {
+		return
+	}
 
-	server := DnsServer{
-		appConfig: &config,
-		appState:  &state,
-		standard_dns_server: &dns.Server{
-			Addr: fmt.Sprintf("%s:%d", bind, port),
-			Net:  "udp",
-		},
+	ctx, cancel := context.WithTimeout(context.Background(), reconfigureTimeout)
+	defer cancel()
+
+	if previous.BindAddress != current.BindAddress || previous.DnsServerPort != current.DnsServerPort {
+		ds.reconfigureStandard(ctx, *current)
+	}
+
+	if previous.BindAddress != current.BindAddress ||
+		previous.DnsOverTlsEnable != current.DnsOverTlsEnable ||
+		previous.DnsOverTlsPort != current.DnsOverTlsPort {
+		ds.reconfigureTls(ctx, *current)
+	} else if current.DnsOverTlsEnable &&
+		(previous.DnsOverTlsCertFile != current.DnsOverTlsCertFile || previous.DnsOverTlsKeyFile != current.DnsOverTlsKeyFile) {
+		if err := ds.loadCertificate(*current); err != nil {
+			ds.appState.Log.Error("failed to load dns over tls certificate for new config - keeping the previous one", "err", err)
+		} else {
+			ds.appState.Log.Info("loaded dns over tls certificate for new config")
+		}
 	}
 
-	server.standard_dns_server.Handler = dns.HandlerFunc(server.handleDNSRequest)
+	if previous.BindAddress != current.BindAddress ||
+		previous.DnsOverHttpEnable != current.DnsOverHttpEnable ||
+		previous.DnsOverHttpPort != current.DnsOverHttpPort {
+		ds.reconfigureHttp(ctx, *current)
+	}
+}
+
+func (ds *DnsServer) stopForReconfigure(ctx context.Context, server interface{ ShutdownContext(context.Context) error }) {
+	if err := server.ShutdownContext(ctx); err != nil {
+		ds.appState.Log.Warn("failed to stop listener for new config", "err", err)
+	}
+}
 
+func (ds *DnsServer) reconfigureStandard(ctx context.Context, config app.AppConfig) {
+	udpServer, tcpServer := ds.newStandardServers(config)
+	if err := bindDnsServers(udpServer, tcpServer); err != nil {
+		ds.appState.Log.Error("failed to rebind dns server for new config - keeping the previous address", "err", err)
+		return
+	}
+
+	ds.appState.Log.Info("rebinding dns server for new config")
+	ds.stopForReconfigure(ctx, ds.standard_dns_server)
+	ds.stopForReconfigure(ctx, ds.standard_dns_tcp_server)
+	ds.standard_dns_server, ds.standard_dns_tcp_server = udpServer, tcpServer
+	ds.startStandard()
+}
+
+func (ds *DnsServer) reconfigureTls(ctx context.Context, config app.AppConfig) {
+	var server *dns.Server
 	if config.DnsOverTlsEnable {
-		cert, err := tls.LoadX509KeyPair(config.DnsOverTlsCertFile, config.DnsOverTlsKeyFile)
-		if err != nil {
-			log.Fatalf("Error loading certificate: %v", err)
+		// The certificate is only replaced once the new listener
+		// is bound, since the old listener uses it too
+		previousCertificate := ds.tls_certificate.Load()
+		if err := ds.loadCertificate(config); err != nil {
+			ds.appState.Log.Error("failed to load dns over tls certificate for new config - keeping the previous listener", "err", err)
+			return
+		}
+
+		server = ds.newTlsServer(config)
+		if err := bindDnsServers(server); err != nil {
+			ds.tls_certificate.Store(previousCertificate)
+			ds.appState.Log.Error("failed to rebind dns over tls server for new config - keeping the previous listener", "err", err)
+			return
 		}
+	}
 
-		// Create TLS configuration
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+	ds.appState.Log.Info("rebinding dns over tls server for new config")
+	if ds.dns_over_tls_server != nil {
+		ds.stopForReconfigure(ctx, ds.dns_over_tls_server)
+	}
+	ds.dns_over_tls_server = server
+	if server != nil {
+		ds.startTls()
+	}
+}
+
+func (ds *DnsServer) reconfigureHttp(ctx context.Context, config app.AppConfig) {
+	server := ds.newHttpServer(config)
+	var listener net.Listener
+	if server != nil {
+		var err error
+		if listener, err = net.Listen("tcp", server.Addr); err != nil {
+			ds.appState.Log.Error("failed to rebind dns over http server for new config - keeping the previous listener", "err", describeBindError(server.Addr, err))
+			return
 		}
-		server.dns_over_tls_server = &dns.Server{
-			Addr:      fmt.Sprintf("%s:%d", bind, config.DnsOverTlsPort),
-			Net:       "tcp-tls",
-			TLSConfig: tlsConfig,
-			Handler:   dns.HandlerFunc(server.handleDNSRequest),
+	}
+
+	ds.appState.Log.Info("rebinding dns over http server for new config")
+	if ds.dns_over_http_server != nil {
+		if err := ds.dns_over_http_server.Shutdown(ctx); err != nil {
+			ds.appState.Log.Warn("failed to stop listener for new config", "err", err)
 		}
 	}
+	ds.dns_over_http_server, ds.dns_over_http_listener = server, listener
+	if server != nil {
+		ds.startHttp()
+	}
+}
+
+func (ds *DnsServer) newStandardServers(config app.AppConfig) (*dns.Server, *dns.Server) {
+	addr := fmt.Sprintf("%s:%d", config.BindAddress, config.DnsServerPort)
+
+	udpServer := &dns.Server{
+		Addr:    addr,
+		Net:     "udp",
+		Handler: dns.HandlerFunc(ds.handleDNSRequest),
+	}
+	tcpServer := &dns.Server{
+		Addr:    addr,
+		Net:     "tcp",
+		Handler: dns.HandlerFunc(ds.handleDNSRequest),
+	}
+
+	return udpServer, tcpServer
+}
+
+// Load the DNS over TLS certificate, which is used for new
+// connections from then on
+func (ds *DnsServer) loadCertificate(config app.AppConfig) error {
+	cert, err := tls.LoadX509KeyPair(config.DnsOverTlsCertFile, config.DnsOverTlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	ds.tls_certificate.Store(&cert)
+	return nil
+}
+
+func (ds *DnsServer) newTlsServer(config app.AppConfig) *dns.Server {
+	if !config.DnsOverTlsEnable {
+		return nil
+	}
+
+	// The certificate is looked up for each connection so it can be
+	// replaced without rebinding
+	tlsConfig := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return ds.tls_certificate.Load(), nil
+		},
+	}
+
+	return &dns.Server{
+		Addr:      fmt.Sprintf("%s:%d", config.BindAddress, config.DnsOverTlsPort),
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   dns.HandlerFunc(ds.handleDNSRequest),
+	}
+}
+
+func (ds *DnsServer) newHttpServer(config app.AppConfig) *http.Server {
+	if !config.DnsOverHttpEnable {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ds.handleDnsOverHTTP)
+	mux.HandleFunc("/dns-query", ds.handleDnsOverHTTP)
+	mux.HandleFunc("/{auth}", ds.handleDnsOverHTTP)
+	mux.HandleFunc("/{auth}/dns-query", ds.handleDnsOverHTTP)
+
+	return &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.BindAddress, config.DnsOverHttpPort),
+		Handler: mux,
+	}
+}
+
+func NewDnsServer(config *app.LiveConfig, state app.AppState) DnsServer {
+	server := DnsServer{
+		appConfig:       config,
+		appState:        &state,
+		tls_certificate: &atomic.Pointer[tls.Certificate]{},
+		listenerMutex:   &sync.Mutex{},
+	}
 
-	if config.DnsOverHttpEnable {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", server.handleDnsOverHTTP)
-		mux.HandleFunc("/dns-query", server.handleDnsOverHTTP)
-		mux.HandleFunc("/{auth}", server.handleDnsOverHTTP)
-		mux.HandleFunc("/{auth}/dns-query", server.handleDnsOverHTTP)
-		server.dns_over_http_server = &http.Server{
-			Addr:    fmt.Sprintf("%s:%d", bind, config.DnsOverHttpPort),
-			Handler: mux,
+	current := *config.Get()
+	server.standard_dns_server, server.standard_dns_tcp_server = server.newStandardServers(current)
+	if current.DnsOverTlsEnable {
+		if err := server.loadCertificate(current); err != nil {
+			state.Log.Error("failed to start dns over tls server", "err", err)
+		} else {
+			server.dns_over_tls_server = server.newTlsServer(current)
 		}
 	}
+	server.dns_over_http_server = server.newHttpServer(current)
 
 	return server
 }